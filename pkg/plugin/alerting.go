@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"fmt"
+	"time"
+)
+
+// AlertingSettings contains execution settings for alerting requests,
+// which make alert results reproducible and consistent with vmalert.
+type AlertingSettings struct {
+	// EvaluationInterval aligns evaluation timestamps of alerting queries to its multiples,
+	// e.g. to the evaluation interval of alert rules. Alignment is disabled if empty.
+	EvaluationInterval string `json:"evaluationInterval,omitempty"`
+	// QueryOffset shifts evaluation timestamps of alerting queries back in time,
+	// so the latest samples are not missing because of -search.latencyOffset
+	QueryOffset string `json:"queryOffset,omitempty"`
+	// NoCache disables the rollup result cache for alerting queries with nocache=1
+	NoCache bool `json:"noCache,omitempty"`
+}
+
+func (as AlertingSettings) validate() error {
+	_, _, err := as.parseDurations()
+	return err
+}
+
+// parseDurations returns the evaluation interval and the query offset
+func (as AlertingSettings) parseDurations() (interval, offset time.Duration, err error) {
+	if interval, err = parseNonNegativeDuration(as.EvaluationInterval); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse evaluation interval: %w", err)
+	}
+	if offset, err = parseNonNegativeDuration(as.QueryOffset); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse query offset: %w", err)
+	}
+	return interval, offset, nil
+}
+
+func parseNonNegativeDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration %q can't be negative", s)
+	}
+	return d, nil
+}
+
+// evaluationTimeRange returns the time range of the alerting query shifted by the query offset
+// and with the end aligned to the evaluation interval. The duration of the range is preserved.
+func (as AlertingSettings) evaluationTimeRange(tr TimeRange) TimeRange {
+	interval, offset, _ := as.parseDurations()
+	to := tr.To.Add(-offset)
+	if interval > 0 {
+		// align to unix timestamps like vmalert does
+		ts := to.UnixNano()
+		to = time.Unix(0, ts-ts%int64(interval)).In(tr.To.Location())
+	}
+	delta := tr.To.Sub(to)
+	return TimeRange{From: tr.From.Add(-delta), To: to}
+}
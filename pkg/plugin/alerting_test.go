@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestAlertingSettings_validate(t *testing.T) {
+	f := func(as AlertingSettings, wantErr bool) {
+		t.Helper()
+		if err := as.validate(); (err != nil) != wantErr {
+			t.Fatalf("validate() error = %v, wantErr %v", err, wantErr)
+		}
+	}
+
+	f(AlertingSettings{}, false)
+	f(AlertingSettings{EvaluationInterval: "1m", QueryOffset: "30s", NoCache: true}, false)
+	f(AlertingSettings{EvaluationInterval: "1"}, true)
+	f(AlertingSettings{QueryOffset: "-30s"}, true)
+}
+
+func TestAlertingSettings_evaluationTimeRange(t *testing.T) {
+	f := func(as AlertingSettings, from, to, wantFrom, wantTo int64) {
+		t.Helper()
+		got := as.evaluationTimeRange(TimeRange{From: time.Unix(from, 0), To: time.Unix(to, 0)})
+		if got.From.Unix() != wantFrom || got.To.Unix() != wantTo {
+			t.Fatalf("unexpected time range: %d-%d; want %d-%d", got.From.Unix(), got.To.Unix(), wantFrom, wantTo)
+		}
+	}
+
+	// no adjustments
+	f(AlertingSettings{}, 1670226733, 1670227033, 1670226733, 1670227033)
+
+	// alignment
+	f(AlertingSettings{EvaluationInterval: "1m"}, 1670226733, 1670227033, 1670226720, 1670227020)
+
+	// offset
+	f(AlertingSettings{QueryOffset: "30s"}, 1670226733, 1670227033, 1670226703, 1670227003)
+
+	// offset and alignment
+	f(AlertingSettings{EvaluationInterval: "1m", QueryOffset: "30s"}, 1670226733, 1670227033, 1670226660, 1670226960)
+}
+
+func TestDatasourceQueryWithAlertingSettings(t *testing.T) {
+	f := func(forAlerting bool, wantTime, wantNoCache string) {
+		t.Helper()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			params := r.URL.Query()
+			if got := params.Get("time"); got != wantTime {
+				t.Errorf("expected time %q; got %q", wantTime, got)
+			}
+			if got := params.Get("nocache"); got != wantNoCache {
+				t.Errorf("expected nocache %q; got %q", wantNoCache, got)
+			}
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}))
+		defer srv.Close()
+
+		headers := map[string]string{}
+		if forAlerting {
+			headers[requestFromAlert] = "true"
+		}
+		ds := NewDatasource()
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+					URL:      srv.URL,
+					JSONData: []byte(`{"httpMethod":"GET","alerting":{"evaluationInterval":"1m","queryOffset":"30s","noCache":true}}`),
+				},
+			},
+			Headers: headers,
+			Queries: []backend.DataQuery{
+				{
+					RefID:     "A",
+					TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670227033, 0)},
+					JSON:      []byte(`{"refId":"A","instant":true,"expr":"up"}`),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if rsp.Responses["A"].Error != nil {
+			t.Fatalf("unexpected error: %s", rsp.Responses["A"].Error)
+		}
+	}
+
+	// dashboard query
+	f(false, "1670227033", "")
+
+	// alerting query
+	f(true, "1670226960", "1")
+}
@@ -0,0 +1,244 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// queryTypeAlertAnnotations returns firing and pending periods of alerts written by vmalert as annotations
+	queryTypeAlertAnnotations = "alertAnnotations"
+
+	alertsMetric         = "ALERTS"
+	alertsForStateMetric = "ALERTS_FOR_STATE"
+	alertStateLabel      = "alertstate"
+	alertNameLabel       = "alertname"
+)
+
+// alertRegion is a period when the alert was in the same state
+type alertRegion struct {
+	labels Labels
+	start  time.Time
+	end    time.Time
+	// activeAt is the time the alert became active according to ALERTS_FOR_STATE
+	activeAt time.Time
+}
+
+// prepareAlertAnnotationsQuery sets up the query for reading ALERTS series over the whole time range
+func prepareAlertAnnotationsQuery(q *Query) error {
+	q.Expr = strings.TrimSpace(q.Expr)
+	if q.Expr == "" {
+		q.Expr = alertsMetric
+	}
+	if !isAlertsSelector(q.Expr) {
+		return fmt.Errorf("expression must be a series selector for %s, e.g. %s{severity=\"critical\"}; got %q", alertsMetric, alertsMetric, q.Expr)
+	}
+	q.Instant = false
+	q.Range = true
+	return nil
+}
+
+// isAlertsSelector reports whether expr is a single series selector for ALERTS,
+// so its filters can be applied to ALERTS_FOR_STATE as well
+func isAlertsSelector(expr string) bool {
+	rest, ok := strings.CutPrefix(expr, alertsMetric)
+	if !ok {
+		return false
+	}
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return true
+	}
+	if rest[0] != '{' {
+		return false
+	}
+	// the first closing brace outside quoted values must end the expression
+	for i := 1; i < len(rest); {
+		switch rest[i] {
+		case '"', '\'', '`':
+			i = skipString(rest, i)
+			continue
+		case '{':
+			return false
+		case '}':
+			return i == len(rest)-1
+		}
+		i++
+	}
+	return false
+}
+
+// alertAnnotations converts ALERTS series of the response into annotation regions.
+// ALERTS_FOR_STATE series are requested to find the time alerts became active,
+// since it may precede the beginning of the time range. They are requested via fetch,
+// so they are read from the same storage tiers as ALERTS series.
+func (di *DatasourceInstance) alertAnnotations(q *Query, reqURL string, r *Response, fetch func(reqURL string) (*Response, error)) (data.Frames, error) {
+	if r.Data.ResultType != matrix {
+		return nil, fmt.Errorf("unexpected result type %q; expecting %q", r.Data.ResultType, matrix)
+	}
+	var alerts promRange
+	if err := json.Unmarshal(r.Data.Result, &alerts.Result); err != nil {
+		return nil, fmt.Errorf("failed to decode result: %w", err)
+	}
+	step := time.Duration(q.IntervalMs) * time.Millisecond
+
+	activeAts := make(map[string][]Value)
+	u, err := url.Parse(reqURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse request url: %w", err)
+	}
+	expr := u.Query().Get("query")
+	forStateURL, err := setURLParam(reqURL, "query", alertsForStateMetric+strings.TrimPrefix(expr, alertsMetric))
+	if err != nil {
+		return nil, err
+	}
+	forState, err := fetch(forStateURL)
+	if err != nil {
+		// annotations are still useful without the exact activation time
+		di.logger.Warn("Failed to fetch "+alertsForStateMetric, "refId", q.RefID, "error", err)
+	} else if forState.Data.ResultType == matrix {
+		var pr promRange
+		if err := json.Unmarshal(forState.Data.Result, &pr.Result); err == nil {
+			for _, res := range pr.Result {
+				activeAts[alertSeriesKey(res.Labels)] = res.Values
+			}
+		}
+	}
+
+	var regions []alertRegion
+	for _, res := range alerts.Result {
+		regions = append(regions, alertRegions(res, step, activeAts[alertSeriesKey(res.Labels)])...)
+	}
+	frame, err := alertRegionsFrame(regions, q.TimeRange.From)
+	if err != nil {
+		return nil, err
+	}
+	return data.Frames{frame}, nil
+}
+
+// alertSeriesKey returns the key of the alert series without the metric name and state
+func alertSeriesKey(labels Labels) string {
+	l := make(data.Labels, len(labels))
+	for k, v := range labels {
+		if k != metricsName && k != alertStateLabel {
+			l[k] = v
+		}
+	}
+	return l.String()
+}
+
+// alertRegions splits values of the ALERTS series into continuous regions.
+// Values are missing when the alert isn't in the state of the series.
+func alertRegions(res Result, step time.Duration, forState []Value) []alertRegion {
+	var regions []alertRegion
+	var cur *alertRegion
+	var prev time.Time
+	for _, v := range res.Values {
+		f, ok := v[0].(float64)
+		if !ok {
+			continue
+		}
+		ts, err := parseFloatToTime(f)
+		if err != nil {
+			continue
+		}
+		if cur != nil && ts.Sub(prev) > step {
+			regions = append(regions, *cur)
+			cur = nil
+		}
+		if cur == nil {
+			cur = &alertRegion{labels: res.Labels, start: ts, activeAt: activeAtFromForState(forState, ts)}
+		}
+		cur.end = ts
+		prev = ts
+	}
+	if cur != nil {
+		regions = append(regions, *cur)
+	}
+	return regions
+}
+
+// activeAtFromForState returns the activation time from ALERTS_FOR_STATE value at ts
+func activeAtFromForState(forState []Value, ts time.Time) time.Time {
+	for _, v := range forState {
+		f, ok := v[0].(float64)
+		if !ok {
+			continue
+		}
+		vts, err := parseFloatToTime(f)
+		if err != nil || !vts.Equal(ts) {
+			continue
+		}
+		s, ok := v[1].(string)
+		if !ok {
+			return time.Time{}
+		}
+		activeAt, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}
+		}
+		t, err := parseFloatToTime(activeAt)
+		if err != nil {
+			return time.Time{}
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// alertRegionsFrame returns a frame with a region annotation per alert region.
+// Pending regions starting at the beginning of the time range start at the activation time.
+func alertRegionsFrame(regions []alertRegion, from time.Time) (*data.Frame, error) {
+	sort.SliceStable(regions, func(i, j int) bool {
+		return regions[i].start.Before(regions[j].start)
+	})
+	times := make([]time.Time, len(regions))
+	timeEnds := make([]time.Time, len(regions))
+	titles := make([]string, len(regions))
+	texts := make([]string, len(regions))
+	tags := make([]json.RawMessage, len(regions))
+	for i, r := range regions {
+		state := r.labels[alertStateLabel]
+		start := r.start
+		if state == "pending" && !r.activeAt.IsZero() && r.activeAt.Before(start) && !start.After(from) {
+			start = r.activeAt
+		}
+		times[i] = start
+		timeEnds[i] = r.end
+		titles[i] = r.labels[alertNameLabel]
+
+		text := fmt.Sprintf("%s is %s", r.labels[alertNameLabel], state)
+		if !r.activeAt.IsZero() {
+			text += fmt.Sprintf(", active since %s", r.activeAt.UTC().Format(time.RFC3339))
+		}
+		texts[i] = text
+
+		t := make([]string, 0, len(r.labels))
+		for k, v := range r.labels {
+			if k != metricsName {
+				t = append(t, k+"="+v)
+			}
+		}
+		sort.Strings(t)
+		// tags are passed as a list, since label values may contain commas
+		b, err := json.Marshal(t)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal tags: %w", err)
+		}
+		tags[i] = b
+	}
+	return data.NewFrame("alerts",
+		data.NewField("time", nil, times),
+		data.NewField("timeEnd", nil, timeEnds),
+		data.NewField("title", nil, titles),
+		data.NewField("text", nil, texts),
+		data.NewField("tags", nil, tags),
+	), nil
+}
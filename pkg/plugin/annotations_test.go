@@ -0,0 +1,138 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func Test_isAlertsSelector(t *testing.T) {
+	f := func(expr string, want bool) {
+		t.Helper()
+		if got := isAlertsSelector(expr); got != want {
+			t.Errorf("isAlertsSelector(%q): expected %v; got %v", expr, want, got)
+		}
+	}
+	f("ALERTS", true)
+	f(`ALERTS{alertname="ServiceDown"}`, true)
+	f(`ALERTS {severity="critical"}`, true)
+	f("ALERTS_FOR_STATE", false)
+	f("up", false)
+	f("ALERTS > 0", false)
+	f(`ALERTS{a="x"} or foo{b="y"}`, false)
+	f(`ALERTS{a="x"} > 0`, false)
+	f(`ALERTS{a="x",b="}"}`, true)
+	f(`ALERTS{a="x"`, false)
+	f(`ALERTS{a="x"}}`, false)
+	f("ALERTS offset 1h", false)
+}
+
+func Test_alertRegions(t *testing.T) {
+	f := func(timestamps []int64, step time.Duration, want [][2]int64) {
+		t.Helper()
+		values := make([]Value, len(timestamps))
+		for i, ts := range timestamps {
+			values[i] = Value{float64(ts), "1"}
+		}
+		got := alertRegions(Result{Labels: Labels{"alertname": "a"}, Values: values}, step, nil)
+		if len(got) != len(want) {
+			t.Fatalf("expected %d regions; got %d", len(want), len(got))
+		}
+		for i, r := range got {
+			if g := [2]int64{r.start.Unix(), r.end.Unix()}; g != want[i] {
+				t.Errorf("region %d: expected %v; got %v", i, want[i], g)
+			}
+		}
+	}
+
+	// no values
+	f(nil, time.Minute, nil)
+
+	// single region
+	f([]int64{60, 120, 180}, time.Minute, [][2]int64{{60, 180}})
+
+	// gap splits regions
+	f([]int64{60, 120, 300, 360}, time.Minute, [][2]int64{{60, 120}, {300, 360}})
+}
+
+func TestDatasourceQueryAlertAnnotations(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != rangeQueryPath {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		switch q := r.URL.Query().Get("query"); q {
+		case `ALERTS{severity="critical"}`:
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"__name__":"ALERTS","alertname":"ServiceDown","alertstate":"pending","job":"a","severity":"critical"},"values":[[1670226000,"1"],[1670226030,"1"]]},` +
+				`{"metric":{"__name__":"ALERTS","alertname":"ServiceDown","alertstate":"firing","job":"a,b","severity":"critical"},"values":[[1670226060,"1"],[1670226090,"1"]]}]}}`))
+		case `ALERTS_FOR_STATE{severity="critical"}`:
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"__name__":"ALERTS_FOR_STATE","alertname":"ServiceDown","job":"a","severity":"critical"},"values":[[1670226000,"1670225940"],[1670226060,"1670225940"]]}]}}`))
+		default:
+			t.Errorf("unexpected query: %s", q)
+		}
+	}))
+	defer srv.Close()
+
+	f := func(expr string, wantErr bool) backend.DataResponse {
+		t.Helper()
+		ds := NewDatasource()
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+					URL:      srv.URL,
+					JSONData: []byte(`{"httpMethod":"GET"}`),
+				},
+			},
+			Queries: []backend.DataQuery{
+				{
+					RefID:     "A",
+					QueryType: queryTypeAlertAnnotations,
+					TimeRange: backend.TimeRange{From: time.Unix(1670226000, 0), To: time.Unix(1670226090, 0)},
+					JSON:      []byte(`{"refId":"A","expr":` + strconv.Quote(expr) + `,"interval":"30s"}`),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		response := rsp.Responses["A"]
+		if (response.Error != nil) != wantErr {
+			t.Fatalf("unexpected error: %v", response.Error)
+		}
+		return response
+	}
+
+	f("up", true)
+
+	response := f(`ALERTS{severity="critical"}`, false)
+	if len(response.Frames) != 1 {
+		t.Fatalf("expected 1 frame; got %d", len(response.Frames))
+	}
+	frame := response.Frames[0]
+	if n := frame.Rows(); n != 2 {
+		t.Fatalf("expected 2 regions; got %d", n)
+	}
+	// the pending region starts at the activation time preceding the time range
+	if got := frame.Fields[0].At(0).(time.Time); got.Unix() != 1670225940 {
+		t.Errorf("unexpected start of the pending region: %d", got.Unix())
+	}
+	if got := frame.Fields[1].At(0).(time.Time); got.Unix() != 1670226030 {
+		t.Errorf("unexpected end of the pending region: %d", got.Unix())
+	}
+	if got := frame.Fields[0].At(1).(time.Time); got.Unix() != 1670226060 {
+		t.Errorf("unexpected start of the firing region: %d", got.Unix())
+	}
+	if got := frame.Fields[2].At(1).(string); got != "ServiceDown" {
+		t.Errorf("unexpected title: %q", got)
+	}
+	if got, want := string(frame.Fields[4].At(1).(json.RawMessage)), `["alertname=ServiceDown","alertstate=firing","job=a,b","severity=critical"]`; got != want {
+		t.Errorf("unexpected tags: expected %q; got %q", want, got)
+	}
+}
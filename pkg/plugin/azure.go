@@ -0,0 +1,245 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+const (
+	azureAuthClientSecret     = "clientsecret"
+	azureAuthManagedIdentity  = "msi"
+	azureAuthWorkloadIdentity = "workloadidentity"
+
+	// azureMiddlewareName is the name of the http client middleware authenticating requests in Azure AD
+	azureMiddlewareName = "AzureAuthentication"
+	// defaultAzureResourceID is the resource of Azure Monitor managed Prometheus
+	defaultAzureResourceID = "https://prometheus.monitor.azure.com"
+	// azureIMDSEndpoint is the token endpoint of Azure Instance Metadata Service
+	azureIMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	// azureTokenRefreshBefore is how long before the expiration tokens are refreshed
+	azureTokenRefreshBefore = 5 * time.Minute
+)
+
+// azureAuthorityHosts contains Azure AD hosts of known Azure clouds
+var azureAuthorityHosts = map[string]string{
+	"AzureCloud":        "https://login.microsoftonline.com",
+	"AzureChinaCloud":   "https://login.chinacloudapi.cn",
+	"AzureUSGovernment": "https://login.microsoftonline.us",
+	"AzureGermanCloud":  "https://login.microsoftonline.de",
+}
+
+// AzureCredentials contains credentials for authentication in Azure AD
+type AzureCredentials struct {
+	// AuthType is one of "clientsecret", "msi" or "workloadidentity"
+	AuthType   string `json:"authType"`
+	AzureCloud string `json:"azureCloud,omitempty"`
+	TenantID   string `json:"tenantId,omitempty"`
+	ClientID   string `json:"clientId,omitempty"`
+}
+
+// azureTokenProvider acquires Azure AD access tokens and caches them until they are about to expire
+type azureTokenProvider struct {
+	creds AzureCredentials
+	// resource is the id of the resource the token is requested for
+	resource     string
+	clientSecret string
+	// tokenFile is the federated token file of the workload identity
+	tokenFile string
+	// authorityHost and imdsEndpoint are token endpoints for app and managed identities
+	authorityHost string
+	imdsEndpoint  string
+	client        *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// newAzureTokenProvider returns the token provider for the credentials.
+// Credentials missing in the datasource settings are read from the environment
+// configured by Grafana for Azure plugins and by Azure workload identity webhook.
+func newAzureTokenProvider(creds AzureCredentials, resource, clientSecret string) (*azureTokenProvider, error) {
+	if resource == "" {
+		resource = defaultAzureResourceID
+	}
+	p := &azureTokenProvider{
+		creds:        creds,
+		resource:     strings.TrimSuffix(resource, "/"),
+		clientSecret: clientSecret,
+		imdsEndpoint: azureIMDSEndpoint,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+	cloud := creds.AzureCloud
+	if cloud == "" {
+		cloud = envOr("GFAZPL_AZURE_CLOUD", "AzureCloud")
+	}
+	p.authorityHost = azureAuthorityHosts[cloud]
+	if host := os.Getenv("AZURE_AUTHORITY_HOST"); host != "" {
+		p.authorityHost = strings.TrimSuffix(host, "/")
+	}
+
+	switch creds.AuthType {
+	case azureAuthClientSecret:
+		if p.authorityHost == "" {
+			return nil, fmt.Errorf("unsupported azure cloud %q", cloud)
+		}
+		if creds.TenantID == "" || creds.ClientID == "" || clientSecret == "" {
+			return nil, fmt.Errorf("tenant id, client id and client secret are required for %q authentication", creds.AuthType)
+		}
+	case azureAuthManagedIdentity:
+		if p.creds.ClientID == "" {
+			p.creds.ClientID = os.Getenv("GFAZPL_MANAGED_IDENTITY_CLIENT_ID")
+		}
+	case azureAuthWorkloadIdentity:
+		if p.creds.TenantID == "" {
+			p.creds.TenantID = envOr("GFAZPL_WORKLOAD_IDENTITY_TENANT_ID", os.Getenv("AZURE_TENANT_ID"))
+		}
+		if p.creds.ClientID == "" {
+			p.creds.ClientID = envOr("GFAZPL_WORKLOAD_IDENTITY_CLIENT_ID", os.Getenv("AZURE_CLIENT_ID"))
+		}
+		p.tokenFile = envOr("GFAZPL_WORKLOAD_IDENTITY_TOKEN_FILE", os.Getenv("AZURE_FEDERATED_TOKEN_FILE"))
+		if p.authorityHost == "" {
+			return nil, fmt.Errorf("unsupported azure cloud %q", cloud)
+		}
+		if p.creds.TenantID == "" || p.creds.ClientID == "" || p.tokenFile == "" {
+			return nil, fmt.Errorf("tenant id, client id and federated token file are required for %q authentication", creds.AuthType)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported azure auth type %q; supported values are %q, %q and %q",
+			creds.AuthType, azureAuthClientSecret, azureAuthManagedIdentity, azureAuthWorkloadIdentity)
+	}
+	return p, nil
+}
+
+func envOr(key, defaultValue string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+// getToken returns the cached token or acquires a new one if it is about to expire
+func (p *azureTokenProvider) getToken(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Until(p.expiresAt) > azureTokenRefreshBefore {
+		return p.token, nil
+	}
+	token, expiresIn, err := p.fetchToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	p.token, p.expiresAt = token, time.Now().Add(expiresIn)
+	return p.token, nil
+}
+
+// azureTokenResponse is the token response of Azure AD and managed identity endpoints
+type azureTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	// ExpiresIn is a number in Azure AD responses and a string in IMDS responses
+	ExpiresIn        json.Number `json:"expires_in"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+func (p *azureTokenProvider) fetchToken(ctx context.Context) (string, time.Duration, error) {
+	var req *http.Request
+	var err error
+	switch p.creds.AuthType {
+	case azureAuthManagedIdentity:
+		req, err = p.managedIdentityRequest(ctx)
+	default:
+		req, err = p.appTokenRequest(ctx)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to request azure token: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var tr azureTokenResponse
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read azure token response: %w", err)
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", 0, fmt.Errorf("failed to decode azure token response with status code %d: %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.AccessToken == "" {
+		return "", 0, fmt.Errorf("failed to acquire azure token: status code %d: %s %s", resp.StatusCode, tr.Error, tr.ErrorDescription)
+	}
+	expiresIn, err := tr.ExpiresIn.Int64()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to parse azure token expiration %q: %w", tr.ExpiresIn, err)
+	}
+	return tr.AccessToken, time.Duration(expiresIn) * time.Second, nil
+}
+
+// appTokenRequest returns the client credentials request for the app registration or workload identity
+func (p *azureTokenProvider) appTokenRequest(ctx context.Context) (*http.Request, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", p.creds.ClientID)
+	form.Set("scope", p.resource+"/.default")
+	if p.creds.AuthType == azureAuthWorkloadIdentity {
+		// the federated token is rotated, so it is read on every request
+		assertion, err := os.ReadFile(p.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read federated token file: %w", err)
+		}
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	} else {
+		form.Set("client_secret", p.clientSecret)
+	}
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", p.authorityHost, url.PathEscape(p.creds.TenantID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create azure token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// managedIdentityRequest returns the token request to the Instance Metadata Service
+func (p *azureTokenProvider) managedIdentityRequest(ctx context.Context) (*http.Request, error) {
+	params := url.Values{}
+	params.Set("api-version", "2018-02-01")
+	params.Set("resource", p.resource)
+	if p.creds.ClientID != "" {
+		params.Set("client_id", p.creds.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.imdsEndpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create azure token request: %w", err)
+	}
+	req.Header.Set("Metadata", "true")
+	return req, nil
+}
+
+// azureAuthMiddleware sets the Azure AD access token to every request
+func azureAuthMiddleware(p *azureTokenProvider) httpclient.Middleware {
+	return httpclient.NamedMiddlewareFunc(azureMiddlewareName, func(_ httpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			token, err := p.getToken(req.Context())
+			if err != nil {
+				return nil, fmt.Errorf("failed to authenticate in azure: %w", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			return next.RoundTrip(req)
+		})
+	})
+}
@@ -0,0 +1,170 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestNewAzureTokenProvider(t *testing.T) {
+	f := func(creds AzureCredentials, clientSecret string, wantErr bool) {
+		t.Helper()
+		_, err := newAzureTokenProvider(creds, "", clientSecret)
+		if (err != nil) != wantErr {
+			t.Fatalf("expected error %v; got %v", wantErr, err)
+		}
+	}
+	t.Setenv("AZURE_TENANT_ID", "")
+	t.Setenv("AZURE_CLIENT_ID", "")
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", "")
+
+	f(AzureCredentials{AuthType: azureAuthManagedIdentity}, "", false)
+	f(AzureCredentials{AuthType: azureAuthClientSecret, TenantID: "t", ClientID: "c"}, "secret", false)
+	f(AzureCredentials{AuthType: azureAuthClientSecret, TenantID: "t", ClientID: "c"}, "", true)
+	f(AzureCredentials{AuthType: azureAuthClientSecret, AzureCloud: "Mars", TenantID: "t", ClientID: "c"}, "secret", true)
+	f(AzureCredentials{AuthType: azureAuthWorkloadIdentity}, "", true)
+	f(AzureCredentials{AuthType: "password"}, "", true)
+}
+
+func TestAzureTokenProvider_getToken(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/tenant-1/oauth2/v2.0/token":
+			if err := r.ParseForm(); err != nil {
+				t.Errorf("failed to parse form: %s", err)
+			}
+			if got := r.PostForm.Get("scope"); got != "https://vm.example.com/.default" {
+				t.Errorf("unexpected scope: %q", got)
+			}
+			switch r.PostForm.Get("client_id") {
+			case "app":
+				if got := r.PostForm.Get("client_secret"); got != "secret" {
+					t.Errorf("unexpected client secret: %q", got)
+				}
+			case "workload":
+				if got := r.PostForm.Get("client_assertion"); got != "federated-token" {
+					t.Errorf("unexpected client assertion: %q", got)
+				}
+			default:
+				t.Errorf("unexpected client id: %q", r.PostForm.Get("client_id"))
+			}
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","access_token":"app-token","expires_in":3600}`))
+		case "/metadata/identity/oauth2/token":
+			if r.Header.Get("Metadata") != "true" {
+				t.Errorf("expected Metadata header")
+			}
+			if got := r.URL.Query().Get("resource"); got != "https://vm.example.com" {
+				t.Errorf("unexpected resource: %q", got)
+			}
+			// IMDS returns expires_in as a string
+			_, _ = w.Write([]byte(`{"access_token":"msi-token","expires_in":"3600"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_request","error_description":"unknown tenant"}`))
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("AZURE_AUTHORITY_HOST", srv.URL)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("federated-token\n"), 0o600); err != nil {
+		t.Fatalf("failed to write token file: %s", err)
+	}
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", tokenFile)
+
+	f := func(creds AzureCredentials, clientSecret, wantToken string, wantErr bool) {
+		t.Helper()
+		p, err := newAzureTokenProvider(creds, "https://vm.example.com/", clientSecret)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		p.imdsEndpoint = srv.URL + "/metadata/identity/oauth2/token"
+		token, err := p.getToken(context.Background())
+		if (err != nil) != wantErr {
+			t.Fatalf("expected error %v; got %v", wantErr, err)
+		}
+		if token != wantToken {
+			t.Fatalf("expected token %q; got %q", wantToken, token)
+		}
+	}
+
+	f(AzureCredentials{AuthType: azureAuthClientSecret, TenantID: "tenant-1", ClientID: "app"}, "secret", "app-token", false)
+	f(AzureCredentials{AuthType: azureAuthWorkloadIdentity, TenantID: "tenant-1", ClientID: "workload"}, "", "app-token", false)
+	f(AzureCredentials{AuthType: azureAuthManagedIdentity}, "", "msi-token", false)
+	f(AzureCredentials{AuthType: azureAuthClientSecret, TenantID: "tenant-2", ClientID: "app"}, "secret", "", true)
+
+	// tokens are cached until they are about to expire
+	p, err := newAzureTokenProvider(AzureCredentials{AuthType: azureAuthClientSecret, TenantID: "tenant-1", ClientID: "app"}, "https://vm.example.com", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests.Store(0)
+	for i := 0; i < 3; i++ {
+		if _, err := p.getToken(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("expected 1 token request; got %d", n)
+	}
+	p.expiresAt = time.Now().Add(azureTokenRefreshBefore - time.Second)
+	if _, err := p.getToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Fatalf("expected the token to be refreshed; got %d token requests", n)
+	}
+}
+
+func TestDatasourceQueryAzureAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tenant-1/oauth2/v2.0/token":
+			_, _ = w.Write([]byte(`{"access_token":"app-token","expires_in":3600}`))
+		case instantQueryPath:
+			if got := r.Header.Get("Authorization"); got != "Bearer app-token" {
+				t.Errorf("unexpected Authorization header: %q", got)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("AZURE_AUTHORITY_HOST", srv.URL)
+
+	ds := NewDatasource()
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+				URL:                     srv.URL,
+				JSONData:                []byte(`{"httpMethod":"GET","azureCredentials":{"authType":"clientsecret","azureCloud":"AzureCloud","tenantId":"tenant-1","clientId":"app"}}`),
+				DecryptedSecureJSONData: map[string]string{"azureClientSecret": "secret"},
+			},
+		},
+		Queries: []backend.DataQuery{
+			{
+				RefID:     "A",
+				TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+				JSON:      []byte(`{"refId":"A","expr":"up","instant":true}`),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if response := rsp.Responses["A"]; response.Error != nil {
+		t.Fatalf("unexpected error: %s", response.Error)
+	}
+}
@@ -0,0 +1,265 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	exportPath         = "/api/v1/export"
+	queryExemplarsPath = "/api/v1/query_exemplars"
+
+	// probeSelector matches no series, so probes don't load VictoriaMetrics
+	probeSelector = `{__name__="vm_capabilities_probe"}`
+
+	// capabilitiesProbeTimeout limits the duration of probing capabilities
+	capabilitiesProbeTimeout = 30 * time.Second
+	// capabilitiesErrorTTL is how long a failed probe is cached, so unavailable VictoriaMetrics isn't probed on every call
+	capabilitiesErrorTTL = 10 * time.Second
+)
+
+// probedFunctions contains MetricsQL functions whose support depends on the VictoriaMetrics version
+// and the expressions used to probe them
+var probedFunctions = map[string]string{
+	"count_values_over_time": `count_values_over_time("v", vector(0)[1m:])`,
+	"histogram_fraction":     `histogram_fraction(0, 1, vector(0))`,
+	"increase_prometheus":    `increase_prometheus(vector(0)[1m:])`,
+	"label_match":            `label_match(vector(0), "a", "b")`,
+	"limit_offset":           `limit_offset(1, 0, vector(0))`,
+	"outlier_iqr_over_time":  `outlier_iqr_over_time(vector(0)[1m:])`,
+	"outliers_iqr":           `outliers_iqr(vector(0))`,
+	"rate_prometheus":        `rate_prometheus(vector(0)[1m:])`,
+}
+
+// Capabilities describes features of the connected VictoriaMetrics
+type Capabilities struct {
+	// Version, Mode and Backend are detected as in the health check
+	Version string `json:"version,omitempty"`
+	Mode    string `json:"mode"`
+	Backend string `json:"backend,omitempty"`
+	// Tenant is the tenant segment of the datasource url of the cluster version, e.g. "0" or "multitenant"
+	Tenant string `json:"tenant,omitempty"`
+	// TenantMode is the tenant routing mode of the datasource
+	TenantMode string `json:"tenantMode,omitempty"`
+	// Functions reports support of version-dependent MetricsQL functions
+	Functions map[string]bool `json:"functions,omitempty"`
+	// Features below are nil if they are unknown, e.g. because probes were rejected
+	// by authentication, which may depend on the identity of the user.
+	// LabelsMatch is set if /api/v1/labels supports match[] filters
+	LabelsMatch *bool `json:"labelsMatch,omitempty"`
+	// LabelsLimit is set if /api/v1/labels supports the limit param
+	LabelsLimit *bool `json:"labelsLimit,omitempty"`
+	// Exemplars is set if /api/v1/query_exemplars is supported
+	Exemplars *bool `json:"exemplars,omitempty"`
+	// Export and TSDBStatus are set if the export and TSDB status APIs are allowed
+	Export     *bool `json:"export,omitempty"`
+	TSDBStatus *bool `json:"tsdbStatus,omitempty"`
+	// CheckedAt is the time of probing
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// capabilities returns capabilities of VictoriaMetrics, probing them on the first call.
+// Capabilities are cached for the lifetime of the instance, so they are refreshed when settings change.
+// Failed probes are cached for capabilitiesErrorTTL.
+// The probe isn't bound to ctx, so concurrent callers share it and a cancelled caller doesn't abort it.
+func (di *DatasourceInstance) capabilities(ctx context.Context) (*Capabilities, error) {
+	if caps := di.caps.Load(); caps != nil {
+		return caps, nil
+	}
+	di.capsMu.Lock()
+	if di.capsErr != nil && time.Since(di.capsErrAt) < capabilitiesErrorTTL {
+		err := di.capsErr
+		di.capsMu.Unlock()
+		return nil, err
+	}
+	done := di.capsProbe
+	if done == nil {
+		done = make(chan struct{})
+		di.capsProbe = done
+		go di.probeCapabilitiesAsync(done)
+	}
+	di.capsMu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if caps := di.caps.Load(); caps != nil {
+		return caps, nil
+	}
+	di.capsMu.Lock()
+	defer di.capsMu.Unlock()
+	return nil, di.capsErr
+}
+
+// probeCapabilitiesAsync probes capabilities, stores the result and closes done.
+// Probes use the background context, so they are sent with datasource credentials
+// instead of the identity of the user whose request triggered them.
+func (di *DatasourceInstance) probeCapabilitiesAsync(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), capabilitiesProbeTimeout)
+	defer cancel()
+	caps, err := di.probeCapabilities(ctx)
+
+	di.capsMu.Lock()
+	if err == nil {
+		di.caps.Store(caps)
+	}
+	di.capsErr, di.capsErrAt = err, time.Now()
+	di.capsProbe = nil
+	di.capsMu.Unlock()
+	close(done)
+}
+
+// cachedCapabilities returns capabilities if they were already probed.
+// It doesn't wait for the running probe.
+func (di *DatasourceInstance) cachedCapabilities() *Capabilities {
+	return di.caps.Load()
+}
+
+func (di *DatasourceInstance) probeCapabilities(ctx context.Context) (*Capabilities, error) {
+	// failures of other probes mean missing features only if VictoriaMetrics is reachable
+	if _, err := di.checkQuery(ctx); err != nil {
+		return nil, err
+	}
+	caps := &Capabilities{
+		Tenant:     tenantSegment(di.url),
+		TenantMode: di.settings.Tenant.Mode,
+		CheckedAt:  time.Now(),
+	}
+	caps.Version, caps.Mode, caps.Backend = di.detectVersion(ctx)
+
+	now := time.Now()
+	start := strconv.FormatInt(now.Add(-5*time.Minute).Unix(), 10)
+	end := strconv.FormatInt(now.Unix(), 10)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	caps.Functions = make(map[string]bool, len(probedFunctions))
+	for name, expr := range probedFunctions {
+		wg.Add(1)
+		go func(name, expr string) {
+			defer wg.Done()
+			status, _, err := di.probe(ctx, instantQueryPath, url.Values{"query": {expr}, "time": {end}})
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case status == http.StatusOK:
+				caps.Functions[name] = true
+			case status == http.StatusBadRequest || status == http.StatusUnprocessableEntity:
+				// VictoriaMetrics responds with 400 or 422 to unknown functions
+				caps.Functions[name] = false
+			}
+		}(name, expr)
+	}
+
+	probeOK := func(p string, params url.Values) *bool {
+		status, _, err := di.probe(ctx, p, params)
+		if !probeKnown(status, err) {
+			return nil
+		}
+		return boolPtr(status == http.StatusOK)
+	}
+	// labelsCount returns the number of labels in the successful response or -1,
+	// and whether the result of the probe is known
+	labelsCount := func(params url.Values) (int, bool) {
+		status, body, err := di.probe(ctx, labelsPath, params)
+		if !probeKnown(status, err) {
+			return -1, false
+		}
+		if status != http.StatusOK {
+			return -1, true
+		}
+		var r struct {
+			Data []string `json:"data"`
+		}
+		if err := json.Unmarshal(body, &r); err != nil {
+			return -1, true
+		}
+		return len(r.Data), true
+	}
+	// servers ignoring match[] return all labels instead of none
+	if n, ok := labelsCount(url.Values{"match[]": {probeSelector}, "start": {start}, "end": {end}}); ok {
+		caps.LabelsMatch = boolPtr(n == 0)
+	}
+	// servers ignoring limit return all labels
+	if n, ok := labelsCount(url.Values{"limit": {"1"}, "start": {start}, "end": {end}}); ok {
+		caps.LabelsLimit = boolPtr(n >= 0 && n <= 1)
+	}
+	caps.Exemplars = probeOK(queryExemplarsPath, url.Values{"query": {probeSelector}, "start": {start}, "end": {end}})
+	caps.Export = probeOK(exportPath, url.Values{"match[]": {probeSelector}, "start": {start}, "end": {end}})
+	caps.TSDBStatus = probeOK(tsdbStatusPath, url.Values{"topN": {"1"}})
+
+	wg.Wait()
+	return caps, nil
+}
+
+// probeKnown returns false if the probe got no response or was rejected by authentication,
+// since probes are sent without the identity of users and vmauth may route requests by it
+func probeKnown(status int, err error) bool {
+	return err == nil && status != http.StatusUnauthorized && status != http.StatusForbidden
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// probe sends the GET request to the path of the datasource url and returns the response status and body
+func (di *DatasourceInstance) probe(ctx context.Context, p string, params url.Values) (int, []byte, error) {
+	u, err := newURL(di.url, p, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	values := u.Query()
+	for k, vl := range di.queryParams {
+		for _, v := range vl {
+			values.Add(k, v)
+		}
+	}
+	for k, vl := range params {
+		values[k] = vl
+	}
+	u.RawQuery = values.Encode()
+	resp, err := di.healthGet(ctx, u.String())
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthResponseSize))
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// Capabilities returns cached capabilities of the connected VictoriaMetrics
+func (d *Datasource) Capabilities(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	di, err := d.getInstance(ctx, backend.PluginConfigFromContext(ctx))
+	if err != nil {
+		d.logger.Error("Error loading datasource", "error", err)
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	caps, err := di.capabilities(ctx)
+	if err != nil {
+		writeError(rw, http.StatusBadGateway, fmt.Errorf("failed to probe capabilities: %w", err))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(caps); err != nil {
+		d.logger.Error("Error writing response", "error", err)
+	}
+}
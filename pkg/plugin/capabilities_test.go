@@ -0,0 +1,200 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestDatasourceCapabilities(t *testing.T) {
+	var metricsCalls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch r.URL.Path {
+		case "/metrics":
+			metricsCalls.Add(1)
+			_, _ = w.Write([]byte(`vm_app_version{version="vmselect-20240603-v1.102.0-cluster",short_version="v1.102.0"} 1` + "\n"))
+		case "/select/1/prometheus/api/v1/query":
+			if strings.HasPrefix(q.Get("query"), "outliers_iqr") {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"status":"error","error":"unknown func \"outliers_iqr\""}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		case "/select/1/prometheus/api/v1/labels":
+			// match[] is supported and limit is ignored
+			if q.Has("match[]") {
+				_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"status":"success","data":["__name__","job","instance"]}`))
+		case "/select/1/prometheus/api/v1/export":
+			w.WriteHeader(http.StatusOK)
+		case "/select/1/prometheus/api/v1/status/tsdb":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	ds := NewDatasource()
+	pluginCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL:      srv.URL + "/select/1/prometheus",
+			JSONData: []byte(`{"httpMethod":"GET"}`),
+		},
+	}
+	ctx := backend.WithPluginContext(context.Background(), pluginCtx)
+
+	getCapabilities := func() Capabilities {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/capabilities", nil).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		ds.Capabilities(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d; body: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		var caps Capabilities
+		if err := json.Unmarshal(rr.Body.Bytes(), &caps); err != nil {
+			t.Fatalf("failed to unmarshal capabilities: %s", err)
+		}
+		return caps
+	}
+
+	caps := getCapabilities()
+	if caps.CheckedAt.IsZero() {
+		t.Fatalf("expected checkedAt to be set")
+	}
+	caps.CheckedAt = caps.CheckedAt.UTC()
+	wantFunctions := make(map[string]bool, len(probedFunctions))
+	for name := range probedFunctions {
+		wantFunctions[name] = name != "outliers_iqr"
+	}
+	want := Capabilities{
+		Version:     "v1.102.0",
+		Mode:        modeCluster,
+		Tenant:      "1",
+		Functions:   wantFunctions,
+		LabelsMatch: boolPtr(true),
+		LabelsLimit: boolPtr(false),
+		Exemplars:   boolPtr(false),
+		Export:      boolPtr(true),
+		// forbidden probes may depend on the identity of the user, so the result is unknown
+		TSDBStatus: nil,
+		CheckedAt:  caps.CheckedAt,
+	}
+	if !reflect.DeepEqual(caps, want) {
+		t.Fatalf("expected capabilities %+v; got %+v", want, caps)
+	}
+
+	// capabilities are probed once per instance
+	getCapabilities()
+	if n := metricsCalls.Load(); n != 1 {
+		t.Fatalf("expected capabilities to be probed once; got %d probes", n)
+	}
+}
+
+func TestDatasourceCapabilities_Unavailable(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ds := NewDatasource()
+	pluginCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL:      srv.URL,
+			JSONData: []byte(`{"httpMethod":"GET"}`),
+		},
+	}
+	ctx := backend.WithPluginContext(context.Background(), pluginCtx)
+
+	f := func(wantCalls int32) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/capabilities", nil).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		ds.Capabilities(rr, req)
+		if rr.Code != http.StatusBadGateway {
+			t.Fatalf("expected status %d, got %d; body: %s", http.StatusBadGateway, rr.Code, rr.Body.String())
+		}
+		if n := calls.Load(); n != wantCalls {
+			t.Fatalf("expected %d requests; got %d", wantCalls, n)
+		}
+	}
+
+	// failed probes are cached for a short time
+	f(1)
+	f(1)
+
+	di, err := ds.getInstance(ctx, pluginCtx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	di.capsMu.Lock()
+	di.capsErrAt = di.capsErrAt.Add(-capabilitiesErrorTTL)
+	di.capsMu.Unlock()
+	f(2)
+}
+
+func TestDatasourceCapabilities_Detached(t *testing.T) {
+	release := make(chan struct{})
+	var authorized atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Grafana-User") != "" {
+			authorized.Add(1)
+		}
+		if r.URL.Path == "/api/v1/query" && r.URL.Query().Get("query") == "1" {
+			<-release
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+	}))
+	defer srv.Close()
+
+	ds := NewDatasource()
+	pluginCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL:      srv.URL,
+			JSONData: []byte(`{"httpMethod":"GET","headerForwarding":{"enabled":true,"userLoginHeader":"X-Grafana-User"}}`),
+		},
+	}
+	di, err := ds.getInstance(context.Background(), pluginCtx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the caller gives up, while the probe continues without its identity
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ctx = withForwardedHeaders(ctx, http.Header{"X-Grafana-User": {"admin"}})
+	if _, err := di.capabilities(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error; got %v", err)
+	}
+
+	// the query path doesn't wait for the running probe
+	if caps := di.cachedCapabilities(); caps != nil {
+		t.Fatalf("expected no capabilities before the probe finishes; got %+v", caps)
+	}
+
+	close(release)
+	if _, err := di.capabilities(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if di.cachedCapabilities() == nil {
+		t.Fatalf("expected cached capabilities")
+	}
+	if n := authorized.Load(); n != 0 {
+		t.Fatalf("expected probes without the identity of the caller; got %d requests with it", n)
+	}
+}
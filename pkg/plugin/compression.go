@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// acceptEncoding lists encodings negotiated for data query responses in the order of preference
+const acceptEncoding = "zstd, gzip"
+
+// zstdMaxWindow limits the memory used by the zstd decoder for a single response
+const zstdMaxWindow = 32 << 20
+
+var responseBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "victoriametrics_datasource",
+	Name:      "query_response_bytes_total",
+	Help:      "Size of data query responses received from VictoriaMetrics before and after decompression.",
+}, []string{"encoding", "stage"})
+
+type compressionKey struct{}
+
+// withCompression requests the compressed response for requests sent with the returned context
+func withCompression(ctx context.Context) context.Context {
+	return context.WithValue(ctx, compressionKey{}, true)
+}
+
+// compressionTransport negotiates the response encoding for requests marked with withCompression
+// and decompresses responses, so callers always read the decompressed body.
+// Other requests rely on the transparent gzip support of http.Transport.
+type compressionTransport struct {
+	next http.RoundTripper
+	// maxBytes limits the size of decompressed bodies
+	maxBytes int64
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t *compressionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if v, _ := req.Context().Value(compressionKey{}).(bool); !v || req.Header.Get("Accept-Encoding") != "" {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := decompressResponse(resp, t.maxBytes); err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// decompressResponse replaces the response body with the decompressed one limited to maxBytes
+// and counts received bytes
+func decompressResponse(resp *http.Response, maxBytes int64) error {
+	// the encoding is validated before it is used as a label, so proxies can't create arbitrary label values
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		encoding = "identity"
+	case "gzip", "zstd":
+	default:
+		return fmt.Errorf("unsupported response Content-Encoding %q", encoding)
+	}
+	compressed := &countingReader{r: resp.Body, counter: responseBytes.WithLabelValues(encoding, "compressed")}
+	var r io.Reader = compressed
+	var closeDecoder func()
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(compressed)
+		if err != nil {
+			return fmt.Errorf("failed to read gzip response: %w", err)
+		}
+		r = zr
+	case "zstd":
+		zr, err := zstd.NewReader(compressed, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return fmt.Errorf("failed to read zstd response: %w", err)
+		}
+		r, closeDecoder = zr, zr.Close
+	}
+	resp.Body = &decompressedBody{
+		Reader: &limitedReader{
+			r:     &countingReader{r: r, counter: responseBytes.WithLabelValues(encoding, "decompressed")},
+			limit: maxBytes,
+		},
+		body:  resp.Body,
+		close: closeDecoder,
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = encoding != "identity"
+	return nil
+}
+
+// countingReader adds the number of read bytes to the counter
+type countingReader struct {
+	r       io.Reader
+	counter prometheus.Counter
+}
+
+// Read implements io.Reader interface
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.counter.Add(float64(n))
+	return n, err
+}
+
+// decompressedBody closes the decoder along with the original body
+type decompressedBody struct {
+	io.Reader
+	body  io.Closer
+	close func()
+}
+
+// Close implements io.Closer interface
+func (b *decompressedBody) Close() error {
+	if b.close != nil {
+		b.close()
+	}
+	return b.body.Close()
+}
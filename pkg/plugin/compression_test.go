@@ -0,0 +1,178 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// responseBytesValue returns the value of the response bytes counter with the given labels
+func responseBytesValue(t *testing.T, encoding, stage string) float64 {
+	t.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %s", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "victoriametrics_datasource_query_response_bytes_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["encoding"] == encoding && labels["stage"] == stage {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestDatasourceQueryCompression(t *testing.T) {
+	body := []byte(`{"status":"success","data":{"resultType":"matrix","result":[` +
+		`{"metric":{"__name__":"up","job":"a"},"values":[[1670226733,"1"],[1670226763,"1"],[1670226793,"1"]]}]}}`)
+
+	compress := func(encoding string) []byte {
+		var buf bytes.Buffer
+		switch encoding {
+		case "gzip":
+			w := gzip.NewWriter(&buf)
+			_, _ = w.Write(body)
+			_ = w.Close()
+		case "zstd":
+			w, err := zstd.NewWriter(&buf)
+			if err != nil {
+				t.Fatalf("failed to create zstd writer: %s", err)
+			}
+			_, _ = w.Write(body)
+			_ = w.Close()
+		default:
+			return body
+		}
+		return buf.Bytes()
+	}
+
+	f := func(encoding string) {
+		t.Helper()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("Accept-Encoding"); got != acceptEncoding {
+				t.Errorf("unexpected Accept-Encoding: %q", got)
+			}
+			if encoding != "" {
+				w.Header().Set("Content-Encoding", encoding)
+			}
+			_, _ = w.Write(compress(encoding))
+		}))
+		defer srv.Close()
+
+		label := encoding
+		if label == "" {
+			label = "identity"
+		}
+		compressedBefore := responseBytesValue(t, label, "compressed")
+		decompressedBefore := responseBytesValue(t, label, "decompressed")
+
+		ds := NewDatasource()
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+					URL:      srv.URL,
+					JSONData: []byte(`{"httpMethod":"GET"}`),
+				},
+			},
+			Queries: []backend.DataQuery{
+				{
+					RefID:     "A",
+					TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+					JSON:      []byte(`{"refId":"A","expr":"up","range":true,"interval":"30s"}`),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		response := rsp.Responses["A"]
+		if response.Error != nil {
+			t.Fatalf("unexpected error: %s", response.Error)
+		}
+		if len(response.Frames) != 1 || response.Frames[0].Rows() != 3 {
+			t.Fatalf("unexpected frames: %v", response.Frames)
+		}
+
+		if got, want := responseBytesValue(t, label, "compressed")-compressedBefore, float64(len(compress(encoding))); got != want {
+			t.Errorf("expected %v compressed bytes; got %v", want, got)
+		}
+		if got, want := responseBytesValue(t, label, "decompressed")-decompressedBefore, float64(len(body)); got != want {
+			t.Errorf("expected %v decompressed bytes; got %v", want, got)
+		}
+	}
+
+	f("")
+	f("gzip")
+	f("zstd")
+}
+
+func TestDecompressResponse(t *testing.T) {
+	// 1MiB of zeros compresses to about 1KiB
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write(make([]byte, 1<<20))
+	_ = w.Close()
+
+	f := func(encoding string, maxBytes int64, wantErr string) {
+		t.Helper()
+		resp := &http.Response{
+			Header: http.Header{"Content-Encoding": {encoding}},
+			Body:   io.NopCloser(bytes.NewReader(buf.Bytes())),
+		}
+		err := decompressResponse(resp, maxBytes)
+		if err == nil {
+			_, err = io.Copy(io.Discard, resp.Body)
+		}
+		if wantErr == "" {
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			return
+		}
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("expected error containing %q; got %v", wantErr, err)
+		}
+	}
+
+	f("gzip", 1<<20, "")
+
+	// decompressed bodies are limited
+	f("gzip", 1<<10, "the limit of 1024 bytes")
+
+	// unsupported encodings are rejected before they are used as label values
+	f("br", 1<<20, `unsupported response Content-Encoding "br"`)
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %s", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "victoriametrics_datasource_query_response_bytes_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "encoding" && l.GetValue() == "br" {
+					t.Fatalf("unexpected counter for the unsupported encoding")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	tsdbStatusPath = "/api/v1/status/tsdb"
+
+	costActionRefuse    = "refuse"
+	costActionDowngrade = "downgrade"
+
+	// seriesCountTTL is how long numbers of series matching query selectors are cached,
+	// so refreshing dashboards don't request tsdb status for every query
+	seriesCountTTL = time.Minute
+)
+
+// QueryCostLimits contains thresholds for the estimated query cost.
+// Zero values disable the corresponding check.
+type QueryCostLimits struct {
+	// MaxSeries is the maximum number of series the query selectors may match
+	MaxSeries int64 `json:"maxSeries,omitempty"`
+	// MaxPoints is the maximum number of points (series multiplied by steps) the query may return
+	MaxPoints int64 `json:"maxPoints,omitempty"`
+	// Action defines what to do with a range query exceeding MaxPoints:
+	// "refuse" returns an error, "downgrade" increases the query step
+	Action string `json:"action,omitempty"`
+}
+
+func (l QueryCostLimits) enabled() bool {
+	return l.MaxSeries > 0 || l.MaxPoints > 0
+}
+
+func (l QueryCostLimits) validate() error {
+	switch l.Action {
+	case "", costActionRefuse, costActionDowngrade:
+		return nil
+	default:
+		return fmt.Errorf("unsupported query cost action %q; supported values are %q and %q", l.Action, costActionRefuse, costActionDowngrade)
+	}
+}
+
+// queryCost describes the estimated cost of the query
+type queryCost struct {
+	series int64
+	points int64
+}
+
+// checkQueryCost estimates the cost of the prepared query and compares it with configured limits.
+// It returns a non-zero step if the query must be re-executed with a coarser step,
+// the notice describing the adjustment, or an error if the query must be refused.
+// Failures during estimation are logged and do not prevent query execution.
+func (di *DatasourceInstance) checkQueryCost(ctx context.Context, baseURL string, params url.Values, q *Query) (time.Duration, *data.Notice, error) {
+	limits := di.settings.QueryCostLimits
+	if caps := di.cachedCapabilities(); caps != nil && caps.TSDBStatus != nil && !*caps.TSDBStatus {
+		// the estimation would fail anyway, while unknown support doesn't disable it
+		return 0, nil, nil
+	}
+	// the step of the prepared query may be raised to the downsampling interval
+	step := max(time.Duration(q.IntervalMs)*time.Millisecond, q.minStep)
+	cost, err := di.estimateQueryCost(ctx, baseURL, params, q, step)
+	if err != nil {
+		di.logger.Warn("Failed to estimate query cost", "refId", q.RefID, "error", err)
+		return 0, nil, nil
+	}
+
+	if limits.MaxSeries > 0 && cost.series > limits.MaxSeries {
+		return 0, nil, newCostLimitError(fmt.Errorf("query refused: its selectors match about %d series, which exceeds the limit of %d series; "+
+			"narrow down the selectors or raise the limit in the datasource settings", cost.series, limits.MaxSeries))
+	}
+	if limits.MaxPoints <= 0 || cost.points <= limits.MaxPoints {
+		return 0, nil, nil
+	}
+
+	refuseErr := newCostLimitError(fmt.Errorf("query refused: it would return about %d points (%d series), which exceeds the limit of %d points; "+
+		"reduce the time range, narrow down the selectors or raise the limit in the datasource settings", cost.points, cost.series, limits.MaxPoints))
+	if limits.Action != costActionDowngrade || !q.isRangeQuery() {
+		return 0, nil, refuseErr
+	}
+
+	// at least two points per series are required to draw a line
+	stepsAllowed := limits.MaxPoints / cost.series
+	if stepsAllowed < 2 {
+		return 0, nil, refuseErr
+	}
+	timerange := q.TimeRange.To.Sub(q.TimeRange.From)
+	required := timerange / time.Duration(stepsAllowed-1)
+	newStep := roundInterval(required)
+	if newStep < required {
+		// roundInterval may round down, so take the next rounded interval
+		newStep = roundInterval(2 * required)
+	}
+	if newStep <= step {
+		return 0, nil, nil
+	}
+	notice := &data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text: fmt.Sprintf("Query step was increased from %s to %s because the query would return about %d points, which exceeds the limit of %d points",
+			step, newStep, cost.points, limits.MaxPoints),
+	}
+	return newStep, notice, nil
+}
+
+// newCostLimitError returns the error for the query refused because of queryCostLimits
+func newCostLimitError(err error) *queryError {
+	qe := newQueryError(errorKindLimitExceeded, err)
+	// the limit is enforced by the plugin instead of VictoriaMetrics
+	qe.source = backend.ErrorSourcePlugin
+	return qe
+}
+
+// estimateQueryCost requests the number of series matching the query selectors
+// and multiplies it by the number of points implied by the step.
+// The estimation is requested from storage tiers answering the query, if they are configured.
+func (di *DatasourceInstance) estimateQueryCost(ctx context.Context, baseURL string, params url.Values, q *Query, step time.Duration) (queryCost, error) {
+	selectors := extractSeriesSelectors(q.Expr)
+	if len(selectors) == 0 {
+		return queryCost{}, fmt.Errorf("no series selectors found in the expression")
+	}
+	if len(di.tiers) == 0 {
+		return di.estimateRangeCost(ctx, baseURL, params, selectors, q, q.TimeRange.From, q.TimeRange.To, step)
+	}
+	var cost queryCost
+	for _, s := range di.querySegments(q, time.Now()) {
+		tierBase, err := di.tierURL(baseURL, s.tier)
+		if err != nil {
+			return queryCost{}, err
+		}
+		c, err := di.estimateRangeCost(ctx, tierBase, params, selectors, q, s.start, s.end, step)
+		if err != nil {
+			return queryCost{}, fmt.Errorf("tier %q: %w", s.tier.name, err)
+		}
+		// the same series are returned by all tiers, while their points are split between tiers
+		cost.series = max(cost.series, c.series)
+		cost.points += c.points
+	}
+	return cost, nil
+}
+
+// estimateRangeCost estimates the cost of the query for the time range from start to end
+// by requesting tsdb status from baseURL.
+// The tsdb status API counts series for a single day only, so series of the day of end are counted.
+// Series which stopped before that day are missed, so costs of long ranges with high churn are underestimated.
+func (di *DatasourceInstance) estimateRangeCost(ctx context.Context, baseURL string, params url.Values, selectors []string, q *Query, start, end time.Time, step time.Duration) (queryCost, error) {
+	u, err := newURL(baseURL, tsdbStatusPath, false)
+	if err != nil {
+		return queryCost{}, fmt.Errorf("failed to build tsdb status url: %w", err)
+	}
+	values := u.Query()
+	for k, vl := range params {
+		for _, v := range vl {
+			values.Add(k, v)
+		}
+	}
+	for _, s := range selectors {
+		values.Add("match[]", s)
+	}
+	values.Set("topN", "1")
+	values.Set("date", end.UTC().Format("2006-01-02"))
+	u.RawQuery = values.Encode()
+
+	series, err := di.seriesCount(ctx, u.String())
+	if err != nil {
+		return queryCost{}, err
+	}
+
+	points := int64(1)
+	if q.isRangeQuery() && step > 0 {
+		points = int64(end.Sub(start)/step) + 1
+	}
+	return queryCost{
+		series: series,
+		points: series * points,
+	}, nil
+}
+
+// seriesCount returns the number of series from the tsdb status response for reqURL.
+// Numbers are cached for seriesCountTTL.
+func (di *DatasourceInstance) seriesCount(ctx context.Context, reqURL string) (int64, error) {
+	if n, ok := di.seriesCounts.get(reqURL); ok {
+		return n, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create new request with context: %w", err)
+	}
+	resp, err := di.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to make http request: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.DefaultLogger.Error("failed to close response body", "err", err.Error())
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return 0, fmt.Errorf("got unexpected response status code: %d with response: %s", resp.StatusCode, string(body))
+	}
+
+	var r struct {
+		Data struct {
+			TotalSeries int64 `json:"totalSeries"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return 0, fmt.Errorf("failed to decode tsdb status response: %w", err)
+	}
+
+	di.seriesCounts.set(reqURL, r.Data.TotalSeries)
+	return r.Data.TotalSeries, nil
+}
+
+// seriesCountCache caches numbers of series by tsdb status request urls
+type seriesCountCache struct {
+	mu      sync.Mutex
+	entries map[string]seriesCountEntry
+}
+
+type seriesCountEntry struct {
+	series    int64
+	expiresAt time.Time
+}
+
+func (c *seriesCountCache) get(key string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expiresAt) {
+		return 0, false
+	}
+	return e.series, true
+}
+
+func (c *seriesCountCache) set(key string, series int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.entries == nil {
+		c.entries = make(map[string]seriesCountEntry)
+	}
+	for k, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = seriesCountEntry{series: series, expiresAt: now.Add(seriesCountTTL)}
+}
+
+// grouping keywords are followed by the list of label names instead of the series selector
+var groupingKeywords = map[string]bool{
+	"by":          true,
+	"without":     true,
+	"on":          true,
+	"ignoring":    true,
+	"group_left":  true,
+	"group_right": true,
+}
+
+// keywords which can't be metric names
+var exprKeywords = map[string]bool{
+	"and":               true,
+	"or":                true,
+	"unless":            true,
+	"if":                true,
+	"ifnot":             true,
+	"default":           true,
+	"atan2":             true,
+	"bool":              true,
+	"offset":            true,
+	"keep_metric_names": true,
+	"limit":             true,
+	"with":              true,
+	"inf":               true,
+	"nan":               true,
+}
+
+// extractSeriesSelectors returns series selectors found in the MetricsQL expression.
+// It is a lightweight lexer which doesn't validate the expression,
+// so the result is suitable only for estimations.
+func extractSeriesSelectors(expr string) []string {
+	var selectors []string
+	seen := make(map[string]bool)
+	add := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			selectors = append(selectors, s)
+		}
+	}
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			i = skipString(expr, i)
+		case c == '#':
+			for i < len(expr) && expr[i] != '\n' {
+				i++
+			}
+		case c == '[':
+			i = skipBlock(expr, i, '[', ']')
+		case c == '$':
+			// skip template variables left unresolved by the frontend, e.g. $__interval
+			i++
+			for i < len(expr) && isIdentChar(expr[i]) {
+				i++
+			}
+		case c == '{':
+			end := skipBlock(expr, i, '{', '}')
+			add(expr[i:end])
+			i = end
+		case isDigit(c):
+			for i < len(expr) && (isIdentChar(expr[i]) || expr[i] == '.') {
+				i++
+			}
+		case isIdentStart(c):
+			start := i
+			for i < len(expr) && (isIdentChar(expr[i]) || expr[i] == '.') {
+				i++
+			}
+			ident := expr[start:i]
+			next := i
+			for next < len(expr) && isSpace(expr[next]) {
+				next++
+			}
+			lower := strings.ToLower(ident)
+			switch {
+			case next < len(expr) && expr[next] == '(':
+				if groupingKeywords[lower] {
+					i = skipBlock(expr, next, '(', ')')
+				}
+			case exprKeywords[lower] || groupingKeywords[lower]:
+			case next < len(expr) && expr[next] == '{':
+				end := skipBlock(expr, next, '{', '}')
+				add(ident + expr[next:end])
+				i = end
+			default:
+				add(ident)
+			}
+		default:
+			i++
+		}
+	}
+	return selectors
+}
+
+// skipString returns the position right after the quoted string started at i
+func skipString(s string, i int) int {
+	quote := s[i]
+	i++
+	for i < len(s) {
+		switch s[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			return i + 1
+		}
+		i++
+	}
+	return i
+}
+
+// skipBlock returns the position right after the closing bracket for the block started at i
+func skipBlock(s string, i int, open, closing byte) int {
+	depth := 0
+	for i < len(s) {
+		switch s[i] {
+		case '"', '\'', '`':
+			i = skipString(s, i)
+			continue
+		case open:
+			depth++
+		case closing:
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
@@ -0,0 +1,294 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+func Test_extractSeriesSelectors(t *testing.T) {
+	f := func(expr string, want []string) {
+		t.Helper()
+		got := extractSeriesSelectors(expr)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("extractSeriesSelectors(%q) = %q, want %q", expr, got, want)
+		}
+	}
+
+	// no selectors
+	f("1 + 1", nil)
+
+	// bare metric name
+	f("up", []string{"up"})
+
+	// metric name with filters
+	f(`up{job="vmagent", instance=~".+"}`, []string{`up{job="vmagent", instance=~".+"}`})
+
+	// label filters only
+	f(`{__name__=~".+"}`, []string{`{__name__=~".+"}`})
+
+	// functions, durations and grouping
+	f(`sum(rate(http_requests_total{code="500"}[$__rate_interval])) by (job) / on(job) group_left sum(rate(http_requests_total[5m])) without (instance)`,
+		[]string{`http_requests_total{code="500"}`, "http_requests_total"})
+
+	// keywords, numbers and strings
+	f(`label_replace(up, "dst", "$1", "src", "(.*)") > bool 0.5 or vector(1e3) offset 5m`, []string{"up"})
+
+	// duplicated selectors and metric names with dots
+	f(`kubernetes.pod.cpu + kubernetes.pod.cpu`, []string{"kubernetes.pod.cpu"})
+
+	// unresolved template variables
+	f(`rate(up[$__interval]) * $__interval_ms`, []string{"up"})
+
+	// braces inside strings
+	f(`up{job="a}b"}`, []string{`up{job="a}b"}`})
+}
+
+func TestDatasourceInstance_checkQueryCost(t *testing.T) {
+	type opts struct {
+		totalSeries int64
+		statusCode  int
+		limits      QueryCostLimits
+		query       Query
+		wantStep    time.Duration
+		wantNotice  bool
+		wantErr     string
+	}
+	f := func(opts opts) {
+		t.Helper()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != tsdbStatusPath {
+				t.Errorf("unexpected path: %s", r.URL.Path)
+			}
+			if len(r.URL.Query()["match[]"]) == 0 {
+				t.Errorf("expected match[] param to be set")
+			}
+			if opts.statusCode != 0 {
+				w.WriteHeader(opts.statusCode)
+				return
+			}
+			_, _ = w.Write([]byte(`{"status":"success","data":{"totalSeries":` + strconv.FormatInt(opts.totalSeries, 10) + `}}`))
+		}))
+		defer srv.Close()
+
+		di := &DatasourceInstance{
+			url:        srv.URL,
+			httpClient: srv.Client(),
+			logger:     log.DefaultLogger,
+			settings:   DataSourceInstanceSettings{QueryCostLimits: opts.limits},
+		}
+		q := opts.query
+		if _, err := q.getQueryURL(di.url, nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		step, notice, err := di.checkQueryCost(context.Background(), di.url, nil, &q)
+		if opts.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), opts.wantErr) {
+				t.Fatalf("expected error containing %q; got %v", opts.wantErr, err)
+			}
+			var qe *queryError
+			if !errors.As(err, &qe) || qe.kind != errorKindLimitExceeded || qe.source != backend.ErrorSourcePlugin {
+				t.Fatalf("expected plugin limit exceeded error; got %#v", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if step != opts.wantStep {
+			t.Errorf("expected step %s; got %s", opts.wantStep, step)
+		}
+		if (notice != nil) != opts.wantNotice {
+			t.Errorf("expected notice %v; got %v", opts.wantNotice, notice)
+		}
+	}
+
+	rangeQuery := Query{
+		Range:         true,
+		Expr:          `rate({__name__=~".+"}[5m])`,
+		MaxDataPoints: 1000,
+		TimeRange: TimeRange{
+			From: time.Unix(1670226733, 0),
+			To:   time.Unix(1670226733, 0).Add(time.Hour),
+		},
+	}
+
+	// within limits
+	f(opts{
+		totalSeries: 10,
+		limits:      QueryCostLimits{MaxSeries: 100, MaxPoints: 100000},
+		query:       rangeQuery,
+	})
+
+	// too many series
+	f(opts{
+		totalSeries: 1000,
+		limits:      QueryCostLimits{MaxSeries: 100, Action: costActionDowngrade},
+		query:       rangeQuery,
+		wantErr:     "exceeds the limit of 100 series",
+	})
+
+	// too many points with refuse action
+	f(opts{
+		totalSeries: 100,
+		limits:      QueryCostLimits{MaxPoints: 10000},
+		query:       rangeQuery,
+		wantErr:     "exceeds the limit of 10000 points",
+	})
+
+	// too many points with downgrade action
+	f(opts{
+		totalSeries: 100,
+		limits:      QueryCostLimits{MaxPoints: 10000, Action: costActionDowngrade},
+		query:       rangeQuery,
+		wantStep:    time.Minute,
+		wantNotice:  true,
+	})
+
+	// downgrade isn't possible
+	f(opts{
+		totalSeries: 100,
+		limits:      QueryCostLimits{MaxPoints: 150, Action: costActionDowngrade},
+		query:       rangeQuery,
+		wantErr:     "exceeds the limit of 150 points",
+	})
+
+	// the step raised to the downsampling interval fits the limit
+	downsampledQuery := rangeQuery
+	downsampledQuery.minStep = 5 * time.Minute
+	f(opts{
+		totalSeries: 100,
+		limits:      QueryCostLimits{MaxPoints: 10000},
+		query:       downsampledQuery,
+	})
+
+	// estimation failure doesn't block the query
+	f(opts{
+		statusCode: http.StatusForbidden,
+		limits:     QueryCostLimits{MaxSeries: 1},
+		query:      rangeQuery,
+	})
+}
+
+func TestDatasourceQueryWithCostLimits(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(tsdbStatusPath, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"success","data":{"totalSeries":100}}`))
+	})
+	mux.HandleFunc(rangeQueryPath, func(w http.ResponseWriter, r *http.Request) {
+		if step := r.URL.Query().Get("step"); step != "1m0s" {
+			t.Errorf("expected downgraded step 1m0s; got %s", step)
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1670226733,"1"]]}]}}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ds := NewDatasource()
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+				URL:      srv.URL,
+				JSONData: []byte(`{"httpMethod":"GET","queryCostLimits":{"maxPoints":10000,"action":"downgrade"}}`),
+			},
+		},
+		Queries: []backend.DataQuery{
+			{
+				RefID:         "A",
+				MaxDataPoints: 1000,
+				TimeRange: backend.TimeRange{
+					From: time.Unix(1670226733, 0),
+					To:   time.Unix(1670226733, 0).Add(time.Hour),
+				},
+				JSON: []byte(`{"refId":"A","range":true,"expr":"up"}`),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	response := rsp.Responses["A"]
+	if response.Error != nil {
+		t.Fatalf("unexpected response error: %s", response.Error)
+	}
+	if len(response.Frames) != 1 {
+		t.Fatalf("expected 1 frame; got %d", len(response.Frames))
+	}
+	notices := response.Frames[0].Meta.Notices
+	if len(notices) != 1 || !strings.Contains(notices[0].Text, "from 15s to 1m0s") {
+		t.Fatalf("unexpected notices: %+v", notices)
+	}
+}
+
+func TestDatasourceInstance_estimateQueryCostCache(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		_, _ = w.Write([]byte(`{"status":"success","data":{"totalSeries":10}}`))
+	}))
+	defer srv.Close()
+
+	di := &DatasourceInstance{
+		url:        srv.URL,
+		httpClient: srv.Client(),
+		logger:     log.DefaultLogger,
+	}
+	f := func(expr string, wantCalls int32) {
+		t.Helper()
+		q := Query{Expr: expr, TimeRange: TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)}}
+		cost, err := di.estimateQueryCost(context.Background(), di.url, nil, &q, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if cost.series != 10 {
+			t.Fatalf("expected 10 series; got %d", cost.series)
+		}
+		if n := calls.Load(); n != wantCalls {
+			t.Fatalf("expected %d tsdb status requests; got %d", wantCalls, n)
+		}
+	}
+
+	f("up", 1)
+
+	// the number of series is cached per selectors
+	f("sum(up)", 1)
+	f("process_cpu_seconds_total", 2)
+}
+
+func TestDatasourceInstance_checkQueryCostCapabilities(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"success","data":{"totalSeries":1000}}`))
+	}))
+	defer srv.Close()
+
+	f := func(tsdbStatus *bool, wantErr bool) {
+		t.Helper()
+		di := &DatasourceInstance{
+			url:        srv.URL,
+			httpClient: srv.Client(),
+			logger:     log.DefaultLogger,
+			settings:   DataSourceInstanceSettings{QueryCostLimits: QueryCostLimits{MaxSeries: 100}},
+		}
+		di.caps.Store(&Capabilities{TSDBStatus: tsdbStatus})
+		q := Query{Expr: "up", TimeRange: TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)}}
+		_, _, err := di.checkQueryCost(context.Background(), di.url, nil, &q)
+		if (err != nil) != wantErr {
+			t.Fatalf("expected error %v; got %v", wantErr, err)
+		}
+	}
+
+	// the estimation is skipped only if the TSDB status API is known to be unavailable
+	f(boolPtr(false), false)
+	f(boolPtr(true), true)
+	f(nil, true)
+}
@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -20,6 +21,7 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
 var (
@@ -60,7 +62,11 @@ func NewDatasource() *Datasource {
 	mux.HandleFunc("/vmui", ds.VMUIQuery)
 	mux.HandleFunc("/api/v1/export", ds.VMAPIQuery)
 	mux.HandleFunc("/api/v1/export/csv", ds.VMAPIQuery)
-	ds.CallResourceHandler = httpadapter.New(mux)
+	mux.HandleFunc("/rules/dry-run", ds.RulesDryRun)
+	mux.HandleFunc("/capabilities", ds.Capabilities)
+	mux.HandleFunc("/vmalert/api/v1/rules", ds.VMAlertQuery)
+	mux.HandleFunc("/vmalert/api/v1/alerts", ds.VMAlertQuery)
+	ds.CallResourceHandler = httpadapter.New(ds.withHeaderForwarding(mux))
 
 	return &ds
 }
@@ -75,7 +81,46 @@ func newDatasourceInstance(ctx context.Context, settings backend.DataSourceInsta
 		logger.Error("Error parsing VM settings", "error", err)
 		return nil, err
 	}
-	opts.ForwardHTTPHeaders = true
+
+	var dstSettings DataSourceInstanceSettings
+	if err := json.Unmarshal(settings.JSONData, &dstSettings); err != nil {
+		return nil, fmt.Errorf("failed to parse datasource settings: %w", err)
+	}
+	if err := checkAuthMethods(opts, dstSettings); err != nil {
+		return nil, err
+	}
+	// forward all headers passed by Grafana unless the forwarding policy is configured
+	opts.ForwardHTTPHeaders = !dstSettings.HeaderForwarding.Enabled
+
+	var middlewares []httpclient.Middleware
+	if dstSettings.HeaderForwarding.Enabled {
+		middlewares = append(middlewares, forwardedHeadersMiddleware())
+	}
+	var minter *jwtMinter
+	if dstSettings.JWT.Enabled {
+		minter, err = newJWTMinter(dstSettings.JWT, settings.DecryptedSecureJSONData["jwtKey"], dstSettings.Teams)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse jwt settings: %w", err)
+		}
+		middlewares = append(middlewares, jwtMiddleware(minter))
+	}
+	if dstSettings.AzureCredentials != nil {
+		tp, err := newAzureTokenProvider(*dstSettings.AzureCredentials, dstSettings.AzureEndpointResourceID, settings.DecryptedSecureJSONData["azureClientSecret"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse azure settings: %w", err)
+		}
+		middlewares = append(middlewares, azureAuthMiddleware(tp))
+	}
+	if opts.SigV4 != nil {
+		signer, err := newSigV4Signer(ctx, *opts.SigV4, dstSettings.SigV4Service)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sigv4 settings: %w", err)
+		}
+		middlewares = append(middlewares, sigV4Middleware(signer))
+	}
+	if len(middlewares) > 0 {
+		opts.Middlewares = append(httpclient.DefaultMiddlewares(), middlewares...)
+	}
 
 	cl, err := httpclient.New(opts)
 	if err != nil {
@@ -90,15 +135,20 @@ func newDatasourceInstance(ctx context.Context, settings backend.DataSourceInsta
 		return nil, fmt.Errorf("failed to parse datasource url: %w", err)
 	}
 
-	var dstSettings DataSourceInstanceSettings
-	if err := json.Unmarshal(settings.JSONData, &dstSettings); err != nil {
-		return nil, fmt.Errorf("failed to parse datasource settings: %w", err)
-	}
 	queryParams, err := url.ParseQuery(dstSettings.QueryParams)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse query params: %w", err)
 	}
-	if len(dstSettings.VMUIURL) == 0 {
+	if err := dstSettings.Tenant.validate(settings.URL); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant settings: %w", err)
+	}
+	if dstSettings.VMAlertURL != "" {
+		if _, err := url.Parse(dstSettings.VMAlertURL); err != nil {
+			return nil, fmt.Errorf("failed to parse vmalert url: %w", err)
+		}
+	}
+	autoVMUIURL := len(dstSettings.VMUIURL) == 0
+	if autoVMUIURL {
 		vmuiUrl, err := newURL(settings.URL, "/vmui/", false)
 		if err != nil {
 			return nil, fmt.Errorf("failed to build VMUI url: %w", err)
@@ -113,13 +163,106 @@ func newDatasourceInstance(ctx context.Context, settings backend.DataSourceInsta
 		}
 		cl.Timeout = timeout
 	}
-	return &DatasourceInstance{
-		url:         settings.URL,
-		httpClient:  cl,
-		logger:      logger,
-		queryParams: queryParams,
-		settings:    dstSettings,
-	}, nil
+	var vmalertClient *http.Client
+	if dstSettings.VMAlertURL != "" {
+		// vmalert is a separate service, so credentials and headers meant for VictoriaMetrics aren't sent to it.
+		// TLS and proxy settings are kept, since vmalert is usually deployed next to VictoriaMetrics.
+		vmalertClient, err = httpclient.New(httpclient.Options{
+			Timeouts:           opts.Timeouts,
+			TLS:                opts.TLS,
+			ProxyOptions:       opts.ProxyOptions,
+			ConfigureTLSConfig: opts.ConfigureTLSConfig,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize vmalert HTTP client: %w", err)
+		}
+		vmalertClient.Timeout = cl.Timeout
+	}
+	if err := dstSettings.QueryCostLimits.validate(); err != nil {
+		return nil, fmt.Errorf("failed to parse query cost limits: %w", err)
+	}
+	if err := dstSettings.PartialResponse.validate(); err != nil {
+		return nil, fmt.Errorf("failed to parse partial response settings: %w", err)
+	}
+	if err := dstSettings.Alerting.validate(); err != nil {
+		return nil, fmt.Errorf("failed to parse alerting settings: %w", err)
+	}
+	if err := dstSettings.ResponseLimits.validate(); err != nil {
+		return nil, fmt.Errorf("failed to parse response limits: %w", err)
+	}
+	if err := validateLabelAccessRules(dstSettings.LabelAccess); err != nil {
+		return nil, fmt.Errorf("failed to parse label access rules: %w", err)
+	}
+	downsampling, err := parseDownsamplingPeriods(dstSettings.DownsamplingPeriods)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse downsampling periods: %w", err)
+	}
+	tiers, err := parseStorageTiers(dstSettings.StorageTiers, settings.URL, dstSettings.Tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse storage tiers: %w", err)
+	}
+	di := &DatasourceInstance{
+		url:           settings.URL,
+		httpClient:    cl,
+		vmalertClient: vmalertClient,
+		logger:        logger,
+		queryParams:   queryParams,
+		settings:      dstSettings,
+		autoVMUIURL:   autoVMUIURL,
+		jwt:           minter,
+		downsampling:  downsampling,
+		tiers:         tiers,
+	}
+	if len(dstSettings.Hedging.Replicas) > 0 {
+		di.hedger, err = newHedger(settings.URL, dstSettings.Hedging)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse hedging settings: %w", err)
+		}
+	}
+	if len(dstSettings.Endpoints.URLs) > 0 {
+		var interval time.Duration
+		if dstSettings.Endpoints.HealthCheckInterval != "" {
+			interval, err = time.ParseDuration(dstSettings.Endpoints.HealthCheckInterval)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse endpoints health check interval: %w", err)
+			}
+		}
+		di.endpoints, err = newEndpointPool(settings.URL, dstSettings.Endpoints)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse endpoints settings: %w", err)
+		}
+		cl.Transport = &failoverTransport{pool: di.endpoints, next: cl.Transport}
+		if interval > 0 {
+			di.endpoints.startHealthChecks(interval, di.checkHealth)
+		}
+	}
+	if di.hedger != nil && di.endpoints == nil {
+		cl.Transport = &replicaTransport{next: cl.Transport}
+	}
+	cl.Transport = &compressionTransport{next: cl.Transport, maxBytes: dstSettings.ResponseLimits.maxDecompressedBytes()}
+	return di, nil
+}
+
+// checkAuthMethods returns an error if more than one method setting the Authorization header is enabled,
+// since every method overwrites the header set by the previous one
+func checkAuthMethods(opts httpclient.Options, s DataSourceInstanceSettings) error {
+	var methods []string
+	if opts.BasicAuth != nil {
+		methods = append(methods, "basic auth")
+	}
+	if s.AzureCredentials != nil {
+		methods = append(methods, "Azure authentication")
+	}
+	if opts.SigV4 != nil {
+		methods = append(methods, "SigV4")
+	}
+	if s.JWT.Enabled && s.JWT.usesAuthorizationHeader() {
+		methods = append(methods, "JWT in the Authorization header")
+	}
+	if len(methods) > 1 {
+		return fmt.Errorf("only one of basic auth, Azure authentication, SigV4 and JWT in the Authorization header can be enabled; got %s", strings.Join(methods, ", "))
+	}
+	return nil
 }
 
 // DatasourceInstance is an example datasource which can respond to data queries, reports
@@ -130,15 +273,65 @@ type DatasourceInstance struct {
 	logger      log.Logger
 	queryParams url.Values
 	settings    DataSourceInstanceSettings
+	// autoVMUIURL is set if VMUI url is derived from the datasource url
+	autoVMUIURL bool
+	// endpoints is set if failover across multiple endpoints is configured
+	endpoints *endpointPool
+	// hedger is set if hedged requests to replicas are configured
+	hedger *hedger
+	// jwt is set if minting of tokens with the Grafana user identity is configured
+	jwt *jwtMinter
+	// vmalertClient sends requests to vmalert without credentials of VictoriaMetrics
+	vmalertClient *http.Client
+
+	// downsampling contains downsampling periods sorted by offset
+	downsampling []downsamplingPeriod
+	// tiers contains storage tiers sorted by retention
+	tiers []storageTier
+
+	// seriesCounts caches numbers of series used for query cost estimations
+	seriesCounts seriesCountCache
+	// caps contains capabilities of VictoriaMetrics once they are probed
+	caps atomic.Pointer[Capabilities]
+	// capsMu protects the error of the last probe and the channel closed when the running probe finishes
+	capsMu    sync.Mutex
+	capsErr   error
+	capsErrAt time.Time
+	capsProbe chan struct{}
 }
 
 // DataSourceInstanceSettings contains settings for the datasource instance.
 type DataSourceInstanceSettings struct {
 	QueryParams  string `json:"customQueryParameters,omitempty"`
 	VMUIURL      string `json:"vmuiUrl,omitempty"`
+	VMAlertURL   string `json:"vmalertUrl,omitempty"`
 	TimeInterval string `json:"timeInterval,omitempty"`
 	QueryTimeout string `json:"queryTimeout,omitempty"`
 	HTTPMethod   string `json:"httpMethod,omitempty"`
+	// DownsamplingPeriods are downsampling periods of VictoriaMetrics Enterprise
+	// in the -downsampling.period flag format, e.g. "30d:5m,180d:1h"
+	DownsamplingPeriods string `json:"downsamplingPeriods,omitempty"`
+	// StorageTiers route queries to storages by their time range
+	StorageTiers []StorageTier `json:"storageTiers,omitempty"`
+
+	AzureCredentials        *AzureCredentials `json:"azureCredentials,omitempty"`
+	AzureEndpointResourceID string            `json:"azureEndpointResourceId,omitempty"`
+	// SigV4Service is the AWS service name used for signing requests, e.g. "execute-api"
+	SigV4Service string `json:"sigV4Service,omitempty"`
+
+	QueryCostLimits  QueryCostLimits          `json:"queryCostLimits,omitempty"`
+	Tenant           TenantSettings           `json:"tenant,omitempty"`
+	Endpoints        EndpointsSettings        `json:"endpoints,omitempty"`
+	Hedging          HedgingSettings          `json:"hedging,omitempty"`
+	PartialResponse  PartialResponseSettings  `json:"partialResponse,omitempty"`
+	Alerting         AlertingSettings         `json:"alerting,omitempty"`
+	ResponseLimits   ResponseLimits           `json:"responseLimits,omitempty"`
+	HeaderForwarding HeaderForwardingSettings `json:"headerForwarding,omitempty"`
+	JWT              JWTSettings              `json:"jwt,omitempty"`
+	// Teams define team membership of Grafana users
+	Teams []TeamMembership `json:"teams,omitempty"`
+	// LabelAccess restricts series visible to Grafana users if set
+	LabelAccess []LabelAccessRule `json:"labelAccess,omitempty"`
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
@@ -146,6 +339,9 @@ type DataSourceInstanceSettings struct {
 // be disposed and a new one will be created using NewSampleDatasource factory function.
 func (di *DatasourceInstance) Dispose() {
 	// Clean up datasource instance resources.
+	if di.endpoints != nil {
+		di.endpoints.stop()
+	}
 	di.httpClient.CloseIdleConnections()
 }
 
@@ -166,18 +362,25 @@ func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataReques
 	if err != nil {
 		return nil, err
 	}
+	rc := requestContext{
+		forAlerting: forAlerting,
+		orgID:       req.PluginContext.OrgID,
+		user:        req.PluginContext.User,
+		headers:     requestHeaders(headers),
+	}
+	ctx = di.withRequestContext(ctx, rc)
 
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	for _, q := range req.Queries {
 		wg.Add(1)
-		go func(q backend.DataQuery, forAlerting bool) {
+		go func(q backend.DataQuery) {
 			defer wg.Done()
-			resp := di.query(ctx, q, forAlerting)
+			resp := di.query(ctx, q, rc)
 			mu.Lock()
 			response.Responses[q.RefID] = resp
 			mu.Unlock()
-		}(q, forAlerting)
+		}(q)
 	}
 	wg.Wait()
 
@@ -185,11 +388,16 @@ func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataReques
 }
 
 // query process backend.Query and return response
-func (di *DatasourceInstance) query(ctx context.Context, query backend.DataQuery, forAlerting bool) backend.DataResponse {
+func (di *DatasourceInstance) query(ctx context.Context, query backend.DataQuery, rc requestContext) backend.DataResponse {
+	switch query.QueryType {
+	case queryTypeVMAlertRules, queryTypeVMAlertAlerts:
+		return di.queryVMAlert(ctx, query.QueryType)
+	}
+
 	var q Query
 	if err := json.Unmarshal(query.JSON, &q); err != nil {
 		err = fmt.Errorf("failed to parse query json: %s", err)
-		return newResponseError(err, backend.StatusBadRequest)
+		return newQueryErrorResponse(newQueryError(errorKindBadQuery, err))
 	}
 
 	q.TimeRange = TimeRange(query.TimeRange)
@@ -197,36 +405,138 @@ func (di *DatasourceInstance) query(ctx context.Context, query backend.DataQuery
 	q.TimeInterval = di.settings.TimeInterval
 	q.BackendQueryInterval = query.Interval
 
-	reqURL, err := q.getQueryURL(di.url, di.queryParams)
+	reducer, err := newSeriesReducer(q.Reducer, q.ReducerPercentile)
 	if err != nil {
-		err = fmt.Errorf("failed to create request URL: %w", err)
-		return newResponseError(err, backend.StatusBadRequest)
+		return newQueryErrorResponse(newQueryError(errorKindBadQuery, err))
+	}
+	if reducer != nil && rc.forAlerting {
+		// reduce the range of every series in the backend instead of sending full series to the alerting engine
+		q.Instant = false
+		q.Range = true
+	}
+	if rc.forAlerting {
+		q.TimeRange = di.settings.Alerting.evaluationTimeRange(q.TimeRange)
+	}
+	if query.QueryType == queryTypeAlertAnnotations {
+		if err := prepareAlertAnnotationsQuery(&q); err != nil {
+			return newQueryErrorResponse(newQueryError(errorKindBadQuery, err))
+		}
 	}
 
-	req, err := http.NewRequestWithContext(ctx, di.settings.HTTPMethod, reqURL, nil)
+	baseURL, err := di.getBaseURL(rc, q.Tenant)
 	if err != nil {
-		err = fmt.Errorf("failed to create new request with context: %w", err)
-		return newResponseError(err, backend.StatusBadRequest)
+		err = fmt.Errorf("failed to resolve tenant: %w", err)
+		return newQueryErrorResponse(newAccessDeniedError(err))
 	}
-	resp, err := di.httpClient.Do(req)
+	queryParams, err := di.restrictParams(rc, di.queryParams)
 	if err != nil {
-		if !isTrivialError(err) {
-			// Return unexpected error to the caller.
-			return newResponseError(err, backend.StatusBadRequest)
-		}
+		err = fmt.Errorf("failed to restrict access: %w", err)
+		return newQueryErrorResponse(newAccessDeniedError(err))
+	}
+	if rc.forAlerting && di.settings.Alerting.NoCache {
+		queryParams.Set("nocache", "1")
+	}
+
+	// steps finer than the downsampling interval return misleading points for downsampled data
+	downsampled := downsamplingMinStep(di.downsampling, &q, time.Now())
+	q.minStep = downsampled.interval
+
+	// keep the original query, since getQueryURL modifies it
+	origQuery := q
+	reqURL, err := q.getQueryURL(baseURL, queryParams)
+	if err != nil {
+		err = fmt.Errorf("failed to create request URL: %w", err)
+		return newQueryErrorResponse(newQueryError(errorKindInternal, err))
+	}
 
-		// Something in the middle between client and datasource might be closing
-		// the connection. So we do a one more attempt in hope request will succeed.
-		req, err = http.NewRequestWithContext(ctx, di.settings.HTTPMethod, reqURL, nil)
+	var notices []data.Notice
+	if q.stepRaisedFrom > 0 && downsampled.interval > 0 {
+		notices = append(notices, *newDownsamplingNotice(downsampled, q.stepRaisedFrom))
+	}
+	if di.settings.QueryCostLimits.enabled() {
+		step, notice, err := di.checkQueryCost(ctx, baseURL, queryParams, &q)
 		if err != nil {
-			err = fmt.Errorf("failed to create new request with context: %w", err)
-			return newResponseError(err, backend.StatusBadRequest)
+			return newQueryErrorResponse(err)
+		}
+		if step > 0 {
+			q = origQuery
+			q.minStep = max(step, downsampled.interval)
+			reqURL, err = q.getQueryURL(baseURL, queryParams)
+			if err != nil {
+				err = fmt.Errorf("failed to create request URL: %w", err)
+				return newQueryErrorResponse(newQueryError(errorKindInternal, err))
+			}
+			notices = append(notices, *notice)
+		}
+	}
+
+	var tiers []string
+	fetch := func(reqURL string) (*Response, error) {
+		if len(di.tiers) == 0 {
+			return di.fetchResponse(ctx, reqURL, q.isRangeQuery())
+		}
+		r, names, err := di.fetchFromTiers(ctx, baseURL, reqURL, &q)
+		if err == nil {
+			tiers = names
 		}
-		resp, err = di.httpClient.Do(req)
+		return r, err
+	}
+	r, err := fetch(reqURL)
+	if err != nil {
+		return newQueryErrorResponse(err)
+	}
+	if r.IsPartial && rc.forAlerting {
+		switch di.settings.PartialResponse.Alerting {
+		case partialResponseFail:
+			return newQueryErrorResponse(newQueryError(errorKindUnavailable, errPartialResponse))
+		case partialResponseRetry:
+			reqURL, err = setURLParam(reqURL, "deny_partial_response", "1")
+			if err != nil {
+				return newQueryErrorResponse(newQueryError(errorKindInternal, err))
+			}
+			r, err = fetch(reqURL)
+			if err != nil {
+				return newQueryErrorResponse(err)
+			}
+		}
+	}
+	if r.IsPartial {
+		notices = append(notices, partialResponseNotice)
+	}
+
+	if query.QueryType == queryTypeAlertAnnotations {
+		frames, err := di.alertAnnotations(&q, reqURL, r, fetch)
 		if err != nil {
-			err = fmt.Errorf("failed to make http request: %w", err)
-			return newResponseError(err, backend.StatusBadRequest)
+			err = fmt.Errorf("failed to prepare annotations from response: %w", err)
+			return newQueryErrorResponse(newQueryError(errorKindInternal, err))
 		}
+		setStorageTiers(frames, tiers)
+		return backend.DataResponse{Frames: addNoticesToFrames(frames, notices...)}
+	}
+
+	r.ForAlerting = rc.forAlerting
+	r.Reducer = reducer
+
+	frames, err := r.getDataFrames()
+	if err != nil {
+		err = fmt.Errorf("failed to prepare data from response: %w", err)
+		return newQueryErrorResponse(newQueryError(errorKindInternal, err))
+	}
+	for i := range frames {
+		q.addMetadataToMultiFrame(frames[i])
+		q.addIntervalToFrame(frames[i])
+	}
+	setStorageTiers(frames, tiers)
+	frames = addNoticesToFrames(frames, notices...)
+
+	return backend.DataResponse{Frames: frames}
+}
+
+// fetchResponse sends the query request to the datasource and decodes the response
+func (di *DatasourceInstance) fetchResponse(ctx context.Context, reqURL string, hedge bool) (*Response, error) {
+	resp, err := di.do(withCompression(ctx), di.settings.HTTPMethod, reqURL, hedge)
+	if err != nil {
+		return nil, classifyRequestError(err)
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
@@ -237,53 +547,114 @@ func (di *DatasourceInstance) query(ctx context.Context, query backend.DataQuery
 	if resp.StatusCode != http.StatusOK {
 		body, readErr := io.ReadAll(io.LimitReader(resp.Body, 4096))
 		if readErr != nil || len(body) == 0 {
-			return newResponseError(
-				fmt.Errorf("got unexpected response status code: %d with request url: %q", resp.StatusCode, reqURL),
-				backend.Status(resp.StatusCode),
-			)
+			return nil, classifyResponseError(resp.StatusCode,
+				fmt.Errorf("got unexpected response status code: %d with request url: %q", resp.StatusCode, reqURL))
 		}
 		var errResp Response
 		if jsonErr := json.Unmarshal(body, &errResp); jsonErr == nil {
 			if errMsg := formatResponseError(errResp); errMsg != "" {
-				return newResponseError(
-					fmt.Errorf("%s", errMsg),
-					backend.Status(resp.StatusCode),
-				)
+				return nil, classifyResponseError(resp.StatusCode, fmt.Errorf("%s", errMsg))
 			}
 		}
-		return newResponseError(
-			fmt.Errorf("got unexpected response status code: %d with request url: %q and response: %s", resp.StatusCode, reqURL, string(body)),
-			backend.Status(resp.StatusCode),
-		)
+		return nil, classifyResponseError(resp.StatusCode,
+			fmt.Errorf("got unexpected response status code: %d with request url: %q and response: %s", resp.StatusCode, reqURL, string(body)))
 	}
 
-	var r Response
-	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		err = fmt.Errorf("failed to decode body response: %w", err)
-		return newResponseError(err, backend.StatusInternal)
+	r, err := di.settings.ResponseLimits.decodeResponse(resp.Body)
+	if err != nil {
+		return nil, err
 	}
 
 	if r.Status == "error" {
-		errMsg := formatResponseError(r)
+		errMsg := formatResponseError(*r)
 		if errMsg == "" {
 			errMsg = "ERROR: unknown error"
 		}
-		return newResponseError(fmt.Errorf("%s", errMsg), backend.StatusBadRequest)
+		return nil, classifyResponseError(http.StatusUnprocessableEntity, fmt.Errorf("%s", errMsg))
+	}
+	return r, nil
+}
+
+// setURLParam returns rawURL with the query param k set to v
+func setURLParam(rawURL, k, v string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse request url: %w", err)
 	}
+	values := u.Query()
+	values.Set(k, v)
+	u.RawQuery = values.Encode()
+	return u.String(), nil
+}
 
-	r.ForAlerting = forAlerting
+// do sends the request to the datasource. Trivial network errors are retried once.
+// If hedge is set and hedging is configured, the request is hedged across replicas.
+func (di *DatasourceInstance) do(ctx context.Context, method, reqURL string, hedge bool) (*http.Response, error) {
+	if hedge && di.hedger != nil {
+		return di.hedger.do(ctx, di.httpClient, method, reqURL)
+	}
+	return doQueryRequest(ctx, di.httpClient, method, reqURL)
+}
 
-	frames, err := r.getDataFrames()
+// doQueryRequest sends the query request with cl and retries it once on trivial network errors
+func doQueryRequest(ctx context.Context, cl *http.Client, method, reqURL string) (*http.Response, error) {
+	req, err := newQueryRequest(ctx, method, reqURL)
 	if err != nil {
-		err = fmt.Errorf("failed to prepare data from response: %w", err)
-		return newResponseError(err, backend.StatusInternal)
+		return nil, fmt.Errorf("%w: %w", errCreateRequest, err)
 	}
-	for i := range frames {
-		q.addMetadataToMultiFrame(frames[i])
-		q.addIntervalToFrame(frames[i])
+	resp, err := cl.Do(req)
+	if err == nil {
+		return resp, nil
+	}
+	if !isTrivialError(err) {
+		// Return unexpected error to the caller.
+		return nil, err
 	}
 
-	return backend.DataResponse{Frames: frames}
+	// Something in the middle between client and datasource might be closing
+	// the connection. So we do a one more attempt in hope request will succeed.
+	req, err = newQueryRequest(ctx, method, reqURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errCreateRequest, err)
+	}
+	resp, err = cl.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make http request: %w", err)
+	}
+	return resp, nil
+}
+
+// formBodyParams are query API params sent in the form body of POST requests.
+// Other params, e.g. custom query params and tenant filters, are kept in the URL,
+// so proxies like vmauth can route requests by them.
+var formBodyParams = []string{"query", "start", "end", "step", "time"}
+
+// newQueryRequest returns the request for reqURL.
+// POST requests send query API params as application/x-www-form-urlencoded body,
+// so long expressions don't hit URL length limits of proxies.
+func newQueryRequest(ctx context.Context, method, reqURL string) (*http.Request, error) {
+	if method != http.MethodPost {
+		return http.NewRequestWithContext(ctx, method, reqURL, nil)
+	}
+	u, err := url.Parse(reqURL)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	form := url.Values{}
+	for _, k := range formBodyParams {
+		if vs, ok := params[k]; ok {
+			form[k] = vs
+			params.Del(k)
+		}
+	}
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
 }
 
 func formatResponseError(r Response) string {
@@ -307,15 +678,53 @@ func (d *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRe
 		d.logger.Error("Error getting datasource instance", "err", err)
 		return res, nil
 	}
+	rc := requestContext{
+		orgID:   req.PluginContext.OrgID,
+		user:    req.PluginContext.User,
+		headers: requestHeaders(req.Headers),
+	}
+	ctx = di.withRequestContext(ctx, rc)
 	return d.checkHealthWithInstance(ctx, di)
 }
 
 // checkHealthWithInstance performs a lightweight query against the datasource
 // to verify connectivity and proper URL resolution, including vmauth/proxy setups.
+// If multiple endpoints are configured, every endpoint is checked.
+// Successful results contain the version, the mode and the latency of VictoriaMetrics in JSONDetails.
 func (d *Datasource) checkHealthWithInstance(ctx context.Context, di *DatasourceInstance) (*backend.CheckHealthResult, error) {
+	if di.endpoints != nil && len(di.endpoints.endpoints) > 1 {
+		res := di.checkEndpointsHealth(ctx)
+		if res.Status != backend.HealthStatusOk {
+			return res, nil
+		}
+		return newHealthCheckResult(res.Message, di.healthDetails(ctx)), nil
+	}
+	latency, err := di.checkQuery(ctx)
+	if err != nil {
+		return newHealthCheckErrorf("%s", err), nil
+	}
+	hd := di.healthDetails(ctx)
+	hd.LatencyMs = latency.Milliseconds()
+	return newHealthCheckResult("Data source is working", hd), nil
+}
+
+// checkHealth performs a lightweight query against the datasource url
+func (di *DatasourceInstance) checkHealth(ctx context.Context) *backend.CheckHealthResult {
+	if _, err := di.checkQuery(ctx); err != nil {
+		return newHealthCheckErrorf("%s", err)
+	}
+	return &backend.CheckHealthResult{
+		Status:  backend.HealthStatusOk,
+		Message: "Data source is working",
+	}
+}
+
+// checkQuery performs the query "1" against the datasource url and returns its round-trip latency.
+// Errors contain actionable messages.
+func (di *DatasourceInstance) checkQuery(ctx context.Context) (time.Duration, error) {
 	queryURL, err := newURL(di.url, instantQueryPath, false)
 	if err != nil {
-		return newHealthCheckErrorf("failed to build health endpoint: %s", err), nil
+		return 0, fmt.Errorf("failed to build health endpoint: %s", err)
 	}
 	values := queryURL.Query()
 	values.Set("query", "1")
@@ -327,13 +736,14 @@ func (d *Datasource) checkHealthWithInstance(ctx context.Context, di *Datasource
 		method = http.MethodGet
 	}
 
-	r, err := http.NewRequestWithContext(ctx, method, queryURL.String(), nil)
+	r, err := newQueryRequest(ctx, method, queryURL.String())
 	if err != nil {
-		return newHealthCheckErrorf("could not create request"), nil
+		return 0, fmt.Errorf("could not create request: %s", err)
 	}
+	start := time.Now()
 	resp, err := di.httpClient.Do(r)
 	if err != nil {
-		return newHealthCheckErrorf("request error"), nil
+		return 0, healthRequestError(queryURL.Host, err)
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
@@ -341,12 +751,10 @@ func (d *Datasource) checkHealthWithInstance(ctx context.Context, di *Datasource
 		}
 	}()
 	if resp.StatusCode != http.StatusOK {
-		return newHealthCheckErrorf("got response code %d", resp.StatusCode), nil
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, healthStatusError(instantQueryPath, resp.StatusCode, body)
 	}
-	return &backend.CheckHealthResult{
-		Status:  backend.HealthStatusOk,
-		Message: "Data source is working",
-	}, nil
+	return time.Since(start), nil
 }
 
 // RootHandler returns generic response to unsupported paths
@@ -406,9 +814,23 @@ func (d *Datasource) VMUIQuery(rw http.ResponseWriter, req *http.Request) {
 	for k, v := range vmuiReq.VMUI {
 		params.Add("g0."+k, v)
 	}
+	vmuiURL := di.settings.VMUIURL
+	if di.autoVMUIURL && di.settings.Tenant.enabled() {
+		baseURL, err := di.getBaseURL(newResourceRequestContext(req), req.URL.Query().Get(tenantParam))
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("failed to resolve tenant: %w", err))
+			return
+		}
+		u, err := newURL(baseURL, "/vmui/", false)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("failed to build VMUI url: %w", err))
+			return
+		}
+		vmuiURL = u.String()
+	}
 	rw.Header().Add("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
-	vmuiURL := di.settings.VMUIURL + "?#/?" + params.Encode()
+	vmuiURL += "?#/?" + params.Encode()
 	_, err = fmt.Fprintf(rw, `{"vmuiURL": %q}`, vmuiURL)
 	if err != nil {
 		log.DefaultLogger.Warn("Error writing response")
@@ -425,42 +847,44 @@ func (d *Datasource) VMAPIQuery(rw http.ResponseWriter, req *http.Request) {
 		writeError(rw, http.StatusInternalServerError, err)
 		return
 	}
-	u, err := newURL(di.url, req.URL.Path, false)
+	if di.accessRestricted() && !isRestrictablePath(req.URL.Path) {
+		// e.g. /api/v1/metadata ignores extra_filters[] and would list all metric names
+		writeError(rw, http.StatusForbidden, fmt.Errorf("%s can't be restricted to series allowed for the user", req.URL.Path))
+		return
+	}
+	rc := newResourceRequestContext(req)
+	params := req.URL.Query()
+	baseURL, err := di.getBaseURL(rc, params.Get(tenantParam))
 	if err != nil {
-		writeError(rw, http.StatusBadRequest, fmt.Errorf("failed to parse datasource url: %w", err))
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("failed to resolve tenant: %w", err))
+		return
+	}
+	if di.settings.Tenant.Mode == tenantModeVariable {
+		params.Del(tenantParam)
+	}
+	params, err = di.restrictParams(rc, params)
+	if err != nil {
+		writeError(rw, http.StatusForbidden, fmt.Errorf("failed to restrict access: %w", err))
 		return
 	}
-	u.RawQuery = req.URL.Query().Encode()
-	newReq, err := http.NewRequestWithContext(ctx, req.Method, u.String(), nil)
+	u, err := newURL(baseURL, req.URL.Path, false)
 	if err != nil {
-		writeError(rw, http.StatusBadRequest, fmt.Errorf("failed to create new request with context: %w", err))
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("failed to parse datasource url: %w", err))
 		return
 	}
-
-	resp, err := di.httpClient.Do(newReq)
+	u.RawQuery = params.Encode()
+	resp, err := di.do(ctx, req.Method, u.String(), false)
 	if err != nil {
-		if !isTrivialError(err) {
-			// Return unexpected error to the caller.
-			writeError(rw, http.StatusBadRequest, err)
-			return
-		}
-
-		newReq, err := http.NewRequestWithContext(ctx, req.Method, u.String(), nil)
-		if err != nil {
-			writeError(rw, http.StatusBadRequest, fmt.Errorf("failed to create new request with context: %w", err))
-			return
-		}
-
-		// Something in the middle between client and datasource might be closing
-		// the connection. So we do a one more attempt in hope request will succeed.
-		resp, err = di.httpClient.Do(newReq)
-		if err != nil {
-			writeError(rw, http.StatusBadRequest, fmt.Errorf("failed to make http request: %w", err))
-			return
-		}
+		qe := classifyRequestError(err)
+		writeError(rw, int(qe.status), qe)
+		return
 	}
 	defer resp.Body.Close()
+	d.proxyResponse(rw, resp, "VictoriaMetrics")
+}
 
+// proxyResponse writes the response of the service to rw
+func (d *Datasource) proxyResponse(rw http.ResponseWriter, resp *http.Response, service string) {
 	if resp.StatusCode != http.StatusOK {
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
@@ -468,8 +892,8 @@ func (d *Datasource) VMAPIQuery(rw http.ResponseWriter, req *http.Request) {
 			writeError(rw, http.StatusInternalServerError, fmt.Errorf("failed to read response: %w", err))
 			return
 		}
-		d.logger.Error("VM returned error", "status", resp.StatusCode, "body", string(body))
-		writeError(rw, resp.StatusCode, fmt.Errorf("VictoriaMetrics returned status %d: %s", resp.StatusCode, string(body)))
+		d.logger.Error(service+" returned error", "status", resp.StatusCode, "body", string(body))
+		writeError(rw, resp.StatusCode, classifyResponseError(resp.StatusCode, fmt.Errorf("%s returned status %d: %s", service, resp.StatusCode, string(body))))
 		return
 	}
 
@@ -514,6 +938,26 @@ func (d *Datasource) getInstance(ctx context.Context, pluginContext backend.Plug
 	return instance.(*DatasourceInstance), nil
 }
 
+// requestHeaders converts headers of backend.QueryDataRequest to http.Header.
+// Grafana passes forwarded HTTP headers with the "http_" prefix.
+func requestHeaders(headers map[string]string) http.Header {
+	h := make(http.Header, len(headers))
+	for k, v := range headers {
+		h.Set(strings.TrimPrefix(k, "http_"), v)
+	}
+	return h
+}
+
+// newResourceRequestContext returns requestContext for the resource call
+func newResourceRequestContext(req *http.Request) requestContext {
+	pluginCtx := backend.PluginConfigFromContext(req.Context())
+	return requestContext{
+		orgID:   pluginCtx.OrgID,
+		user:    pluginCtx.User,
+		headers: req.Header,
+	}
+}
+
 func checkAlertingRequest(headers map[string]string) (bool, error) {
 	var forAlerting bool
 	if val, ok := headers[requestFromAlert]; ok {
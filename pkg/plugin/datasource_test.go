@@ -10,6 +10,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -693,6 +694,14 @@ func TestNewURL(t *testing.T) {
 			expected:  "http://localhost:8427/-/healthy",
 			expectErr: false,
 		},
+		{
+			name:      "valid root slicing for cluster url with account and project",
+			urlStr:    "http://localhost:8481/select/1:2/prometheus",
+			path:      "/vmui/",
+			root:      true,
+			expected:  "http://localhost:8481/vmui",
+			expectErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -888,7 +897,13 @@ func TestVMAPIQuery_ContentEncoding(t *testing.T) {
 func TestCheckHealth(t *testing.T) {
 	t.Run("returns OK when backend responds with 200", func(t *testing.T) {
 		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.URL.Path != "/api/v1/query" {
+			switch r.URL.Path {
+			case "/api/v1/query":
+			case "/metrics", "/api/v1/status/buildinfo", "/api/v1/labels":
+				// version and capability probes
+				w.WriteHeader(http.StatusOK)
+				return
+			default:
 				t.Errorf("unexpected path: %s", r.URL.Path)
 			}
 			if r.URL.Query().Get("query") != "1" {
@@ -961,8 +976,10 @@ func TestCheckHealth(t *testing.T) {
 
 	t.Run("preserves /select/ prefix in URL for cluster setup", func(t *testing.T) {
 		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.URL.Path != "/select/0/prometheus/api/v1/query" {
-				t.Errorf("unexpected path: %s, expected /select/0/prometheus/api/v1/query", r.URL.Path)
+			switch r.URL.Path {
+			case "/select/0/prometheus/api/v1/query", "/select/0/prometheus/api/v1/status/buildinfo", "/select/0/prometheus/api/v1/labels", "/metrics":
+			default:
+				t.Errorf("unexpected path: %s, expected /select/0/prometheus/ prefix", r.URL.Path)
 			}
 			w.WriteHeader(http.StatusOK)
 		}))
@@ -987,9 +1004,20 @@ func TestCheckHealth(t *testing.T) {
 
 	t.Run("uses configured HTTP method", func(t *testing.T) {
 		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/v1/query" {
+				// version and capability probes
+				w.WriteHeader(http.StatusOK)
+				return
+			}
 			if r.Method != http.MethodPost {
 				t.Errorf("expected POST, got %s", r.Method)
 			}
+			if r.URL.RawQuery != "" {
+				t.Errorf("expected params in the form body; got url params %q", r.URL.RawQuery)
+			}
+			if q := r.PostFormValue("query"); q != "1" {
+				t.Errorf("expected query %q in the form body; got %q", "1", q)
+			}
 			w.WriteHeader(http.StatusOK)
 		}))
 		defer srv.Close()
@@ -1055,3 +1083,137 @@ func TestCheckHealth(t *testing.T) {
 		}
 	})
 }
+
+func Test_newQueryRequest(t *testing.T) {
+	f := func(method, reqURL, wantURL, wantBody string) {
+		t.Helper()
+		req, err := newQueryRequest(context.Background(), method, reqURL)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got := req.URL.String(); got != wantURL {
+			t.Errorf("expected url %q; got %q", wantURL, got)
+		}
+		var body string
+		if req.Body != nil {
+			b, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			body = string(b)
+			if ct := req.Header.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+				t.Errorf("unexpected content type: %q", ct)
+			}
+		}
+		if body != wantBody {
+			t.Errorf("expected body %q; got %q", wantBody, body)
+		}
+	}
+
+	// GET keeps all params in the url
+	f(http.MethodGet, "http://vm:8428/api/v1/query_range?query=up&start=1&end=2&step=15s",
+		"http://vm:8428/api/v1/query_range?query=up&start=1&end=2&step=15s", "")
+
+	// POST sends query params in the body
+	f(http.MethodPost, "http://vm:8428/api/v1/query_range?end=2&query=up&start=1&step=15s",
+		"http://vm:8428/api/v1/query_range", "end=2&query=up&start=1&step=15s")
+	f(http.MethodPost, "http://vm:8428/api/v1/query?query=up&time=1",
+		"http://vm:8428/api/v1/query", "query=up&time=1")
+
+	// custom and tenant params stay in the url
+	f(http.MethodPost, "http://vmauth:8427/select/0/prometheus/api/v1/query?extra_filters%5B%5D=%7Bteam%3D%22a%22%7D&nocache=1&query=up&time=1",
+		"http://vmauth:8427/select/0/prometheus/api/v1/query?extra_filters%5B%5D=%7Bteam%3D%22a%22%7D&nocache=1", "query=up&time=1")
+}
+
+func TestDatasourceQueryPostFormBody(t *testing.T) {
+	// a long regex alternation produced by a multi-value variable
+	var alternation []string
+	for i := 0; i < 5000; i++ {
+		alternation = append(alternation, fmt.Sprintf("instance-%d", i))
+	}
+	expr := `up{instance=~"` + strings.Join(alternation, "|") + `"}`
+
+	// maxURLLength is a typical URL length limit of proxies
+	const maxURLLength = 8 << 10
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("expected POST, got %s", r.Method)
+		}
+		if n := len(r.URL.String()); n > maxURLLength {
+			t.Errorf("expected url shorter than %d; got %d", maxURLLength, n)
+		}
+		if got := r.URL.Query().Get("nocache"); got != "1" {
+			t.Errorf("expected custom query params in the url; got %q", r.URL.RawQuery)
+		}
+		if got := r.PostFormValue("query"); got != expr {
+			t.Errorf("expected the expression in the form body; got %d bytes", len(got))
+		}
+		if r.PostFormValue("start") == "" || r.PostFormValue("end") == "" || r.PostFormValue("step") == "" {
+			t.Errorf("expected start, end and step in the form body; got %v", r.PostForm)
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	ds := NewDatasource()
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+				URL:      srv.URL,
+				JSONData: []byte(`{"httpMethod":"POST","customQueryParameters":"nocache=1"}`),
+			},
+		},
+		Queries: []backend.DataQuery{
+			{
+				RefID:     "A",
+				TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+				JSON:      []byte(`{"refId":"A","expr":` + strconv.Quote(expr) + `,"range":true,"interval":"30s"}`),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if response := rsp.Responses["A"]; response.Error != nil {
+		t.Fatalf("unexpected error: %s", response.Error)
+	}
+}
+
+func TestNewDatasourceInstanceAuthMethods(t *testing.T) {
+	f := func(jsonData string, basicAuth bool, wantErr string) {
+		t.Helper()
+		inst, err := newDatasourceInstance(context.Background(), backend.DataSourceInstanceSettings{
+			URL:                     "http://vmselect:8481/select/0/prometheus",
+			JSONData:                []byte(jsonData),
+			BasicAuthEnabled:        basicAuth,
+			BasicAuthUser:           "user",
+			DecryptedSecureJSONData: map[string]string{"basicAuthPassword": "pass", "jwtKey": "secret", "sigV4AccessKey": "KEY", "sigV4SecretKey": "secret"},
+		})
+		if wantErr == "" {
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			inst.(*DatasourceInstance).Dispose()
+			return
+		}
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("expected error containing %q; got %v", wantErr, err)
+		}
+	}
+
+	sigV4 := `"sigV4Auth":true,"sigV4AuthType":"keys","sigV4Region":"eu-west-1"`
+	azure := `"azureCredentials":{"authType":"msi"}`
+
+	// a single method
+	f(`{}`, true, "")
+	f(`{`+sigV4+`}`, false, "")
+	f(`{"jwt":{"enabled":true,"algorithm":"HS256"}}`, false, "")
+
+	// jwt in another header doesn't conflict with other methods
+	f(`{"jwt":{"enabled":true,"algorithm":"HS256","header":"X-Grafana-JWT"}}`, true, "")
+
+	// conflicting methods
+	f(`{`+sigV4+`}`, true, "got basic auth, SigV4")
+	f(`{`+azure+`,`+sigV4+`}`, false, "got Azure authentication, SigV4")
+	f(`{"jwt":{"enabled":true,"algorithm":"HS256","header":"authorization"}}`, true, "got basic auth, JWT in the Authorization header")
+}
@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// downsamplingPeriod means that samples older than offset are downsampled to interval
+type downsamplingPeriod struct {
+	offset   time.Duration
+	interval time.Duration
+}
+
+// parseDownsamplingPeriods parses periods in the format of the -downsampling.period flag
+// of VictoriaMetrics Enterprise, e.g. "30d:5m,180d:1h"
+func parseDownsamplingPeriods(s string) ([]downsamplingPeriod, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var periods []downsamplingPeriod
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "{") {
+			return nil, fmt.Errorf("unsupported downsampling period %q: series filters are not supported", p)
+		}
+		offsetStr, intervalStr, ok := strings.Cut(p, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid downsampling period %q: expecting offset:interval, e.g. 30d:5m", p)
+		}
+		offset, err := gtime.ParseDuration(offsetStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset in downsampling period %q: %w", p, err)
+		}
+		interval, err := gtime.ParseDuration(intervalStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval in downsampling period %q: %w", p, err)
+		}
+		if offset < 0 || interval <= 0 {
+			return nil, fmt.Errorf("invalid downsampling period %q: offset must be non-negative and interval must be positive", p)
+		}
+		periods = append(periods, downsamplingPeriod{offset: offset, interval: interval})
+	}
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].offset < periods[j].offset
+	})
+	return periods, nil
+}
+
+// downsamplingMinStep returns the coarsest downsampling period reached by the query at now.
+// Range queries reach back to TimeRange.From, instant queries to TimeRange.To.
+// The zero period is returned if the query doesn't reach downsampled data.
+func downsamplingMinStep(periods []downsamplingPeriod, q *Query, now time.Time) downsamplingPeriod {
+	oldest := q.TimeRange.To
+	if q.isRangeQuery() {
+		oldest = q.TimeRange.From
+	}
+	age := now.Sub(oldest)
+	var minStep downsamplingPeriod
+	for _, p := range periods {
+		if age > p.offset && p.interval > minStep.interval {
+			minStep = p
+		}
+	}
+	return minStep
+}
+
+// newDownsamplingNotice returns the notice about the step raised to the downsampling interval
+func newDownsamplingNotice(p downsamplingPeriod, step time.Duration) *data.Notice {
+	return &data.Notice{
+		Severity: data.NoticeSeverityInfo,
+		Text: fmt.Sprintf("Query step was increased from %s to %s because samples older than %s are downsampled to %s intervals",
+			step, p.interval, gtime.FormatInterval(p.offset), p.interval),
+	}
+}
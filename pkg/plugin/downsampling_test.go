@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func Test_parseDownsamplingPeriods(t *testing.T) {
+	f := func(s string, want []downsamplingPeriod, wantErr bool) {
+		t.Helper()
+		got, err := parseDownsamplingPeriods(s)
+		if (err != nil) != wantErr {
+			t.Fatalf("parseDownsamplingPeriods() error = %v, wantErr %v", err, wantErr)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parseDownsamplingPeriods() got = %v, want %v", got, want)
+		}
+	}
+
+	f("", nil, false)
+
+	// periods are sorted by offset
+	f("180d:1h, 30d:5m", []downsamplingPeriod{
+		{offset: 30 * day, interval: 5 * time.Minute},
+		{offset: 180 * day, interval: time.Hour},
+	}, false)
+
+	f("30d", nil, true)
+	f("30d:foo", nil, true)
+	f("30d:0s", nil, true)
+	f(`{env="dev"}:30d:5m`, nil, true)
+}
+
+func Test_downsamplingMinStep(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	periods := []downsamplingPeriod{
+		{offset: 30 * day, interval: 5 * time.Minute},
+		{offset: 180 * day, interval: time.Hour},
+	}
+	f := func(from, to time.Duration, instant bool, want time.Duration) {
+		t.Helper()
+		q := &Query{Instant: instant, TimeRange: TimeRange{From: now.Add(-from), To: now.Add(-to)}}
+		if got := downsamplingMinStep(periods, q, now); got.interval != want {
+			t.Errorf("downsamplingMinStep() got = %s, want %s", got.interval, want)
+		}
+	}
+
+	// recent data isn't downsampled
+	f(7*day, 0, false, 0)
+
+	// range queries are limited by the oldest period they reach
+	f(60*day, 0, false, 5*time.Minute)
+	f(365*day, 0, false, time.Hour)
+
+	// instant queries are evaluated at the end of the range
+	f(365*day, 0, true, 0)
+	f(365*day, 200*day, true, time.Hour)
+}
+
+func TestDatasourceQueryWithDownsampling(t *testing.T) {
+	var steps []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		steps = append(steps, r.URL.Query().Get("step"))
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1583786142,"1"]]}]}}`))
+	}))
+	defer srv.Close()
+
+	ds := NewDatasource()
+	pluginCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL:      srv.URL,
+			JSONData: []byte(`{"httpMethod":"GET","downsamplingPeriods":"30d:5m,180d:1h"}`),
+		},
+	}
+	f := func(from time.Duration, wantStep time.Duration, wantNotice string) {
+		t.Helper()
+		steps = steps[:0]
+		now := time.Now()
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: pluginCtx,
+			Queries: []backend.DataQuery{
+				{
+					RefID:         "A",
+					MaxDataPoints: 1000,
+					Interval:      15 * time.Second,
+					TimeRange:     backend.TimeRange{From: now.Add(-from), To: now.Add(-from + time.Hour)},
+					JSON:          []byte(`{"refId":"A","expr":"up"}`),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp := rsp.Responses["A"]
+		if resp.Error != nil {
+			t.Fatalf("unexpected error: %s", resp.Error)
+		}
+		if len(steps) != 1 || steps[0] != wantStep.String() {
+			t.Fatalf("expected step %s; got %q", wantStep, steps)
+		}
+		frame := resp.Frames[0]
+		if got := frame.Fields[0].Config.Interval; got != float64(wantStep.Milliseconds()) {
+			t.Fatalf("expected frame interval %d; got %v", wantStep.Milliseconds(), got)
+		}
+		var notices []string
+		if frame.Meta != nil {
+			for _, n := range frame.Meta.Notices {
+				notices = append(notices, n.Text)
+			}
+		}
+		if wantNotice == "" {
+			if len(notices) > 0 {
+				t.Fatalf("unexpected notices %q", notices)
+			}
+			return
+		}
+		if len(notices) != 1 || !strings.Contains(notices[0], wantNotice) {
+			b, _ := json.Marshal(notices)
+			t.Fatalf("expected notice containing %q; got %s", wantNotice, b)
+		}
+	}
+
+	// recent data
+	f(2*time.Hour, 15*time.Second, "")
+
+	// downsampled data
+	f(60*day, 5*time.Minute, "increased from 15s to 5m0s because samples older than 30d are downsampled")
+	f(365*day, time.Hour, "increased from 15s to 1h0m0s because samples older than 180d are downsampled")
+}
@@ -0,0 +1,313 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	endpointStrategyPriority   = "priority"
+	endpointStrategyRoundRobin = "round-robin"
+
+	defaultEndpointCooldown = 30 * time.Second
+)
+
+// EndpointsSettings contains settings for failover across multiple VictoriaMetrics endpoints.
+// The datasource url is always the first endpoint.
+type EndpointsSettings struct {
+	// URLs contains urls of additional endpoints. The path of every url must end with
+	// the path of the datasource url, e.g. http://vmselect-b:8481/select/0/prometheus
+	// or http://vmauth:8427/zone-b/select/0/prometheus for http://vmselect-a:8481/select/0/prometheus.
+	URLs []string `json:"urls,omitempty"`
+	// Strategy defines the order of endpoints: "priority" (default) always prefers
+	// the first healthy endpoint, "round-robin" spreads requests across healthy endpoints
+	Strategy string `json:"strategy,omitempty"`
+	// Cooldown is the duration an endpoint is considered unhealthy after a failure, 30s by default
+	Cooldown string `json:"cooldown,omitempty"`
+	// HealthCheckInterval is the interval of active health checks; active checks are disabled if empty
+	HealthCheckInterval string `json:"healthCheckInterval,omitempty"`
+}
+
+// endpoint is a VictoriaMetrics endpoint with passive and active health tracking
+type endpoint struct {
+	url *url.URL
+	// pathPrefix is prepended to request paths built for the datasource url
+	pathPrefix string
+	// unhealthyUntil is the unix nano timestamp until which the endpoint is skipped
+	unhealthyUntil atomic.Int64
+}
+
+func (e *endpoint) healthy(now time.Time) bool {
+	return e.unhealthyUntil.Load() <= now.UnixNano()
+}
+
+// endpointPool selects endpoints for requests according to the strategy and their health
+type endpointPool struct {
+	endpoints []*endpoint
+	strategy  string
+	cooldown  time.Duration
+	next      atomic.Uint64
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// newEndpointPool returns a pool for the datasource url and additional endpoints
+func newEndpointPool(rawURL string, es EndpointsSettings) (*endpointPool, error) {
+	switch es.Strategy {
+	case "", endpointStrategyPriority, endpointStrategyRoundRobin:
+	default:
+		return nil, fmt.Errorf("unsupported endpoints strategy %q; supported values are %q and %q", es.Strategy, endpointStrategyPriority, endpointStrategyRoundRobin)
+	}
+	cooldown := defaultEndpointCooldown
+	if es.Cooldown != "" {
+		d, err := time.ParseDuration(es.Cooldown)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse endpoints cooldown: %w", err)
+		}
+		cooldown = d
+	}
+
+	primary, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse datasource url: %w", err)
+	}
+	ep := &endpointPool{
+		endpoints: []*endpoint{{url: primary}},
+		strategy:  es.Strategy,
+		cooldown:  cooldown,
+		stopCh:    make(chan struct{}),
+	}
+	for _, raw := range es.URLs {
+		e, err := newEndpoint(primary, raw)
+		if err != nil {
+			return nil, err
+		}
+		ep.endpoints = append(ep.endpoints, e)
+	}
+	return ep, nil
+}
+
+// newEndpoint returns an endpoint for raw url serving the same API as the primary url
+func newEndpoint(primary *url.URL, raw string) (*endpoint, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse endpoint url %q: %w", raw, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("endpoint url %q must contain scheme and host", raw)
+	}
+	primaryPath := strings.TrimSuffix(primary.Path, "/")
+	p := strings.TrimSuffix(u.Path, "/")
+	if !strings.HasSuffix(p, primaryPath) {
+		return nil, fmt.Errorf("path of endpoint url %q must end with the datasource url path %q", raw, primary.Path)
+	}
+	return &endpoint{
+		url:        u,
+		pathPrefix: strings.TrimSuffix(p, primaryPath),
+	}, nil
+}
+
+// candidates returns endpoints in the order they must be tried.
+// Unhealthy endpoints are tried last, so requests are sent even if all endpoints failed recently.
+func (ep *endpointPool) candidates() []*endpoint {
+	n := len(ep.endpoints)
+	start := 0
+	if ep.strategy == endpointStrategyRoundRobin {
+		start = int(ep.next.Add(1)-1) % n
+	}
+	now := time.Now()
+	healthy := make([]*endpoint, 0, n)
+	var unhealthy []*endpoint
+	for i := 0; i < n; i++ {
+		e := ep.endpoints[(start+i)%n]
+		if e.healthy(now) {
+			healthy = append(healthy, e)
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (ep *endpointPool) markFailed(e *endpoint) {
+	e.unhealthyUntil.Store(time.Now().Add(ep.cooldown).UnixNano())
+}
+
+func (ep *endpointPool) markHealthy(e *endpoint) {
+	e.unhealthyUntil.Store(0)
+}
+
+// startHealthChecks runs check for every endpoint with the given interval until stop is called
+func (ep *endpointPool) startHealthChecks(interval time.Duration, check func(ctx context.Context) *backend.CheckHealthResult) {
+	ep.wg.Add(1)
+	go func() {
+		defer ep.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ep.stopCh:
+				return
+			case <-t.C:
+			}
+			for _, e := range ep.endpoints {
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				res := check(withEndpoint(ctx, e))
+				cancel()
+				if res.Status == backend.HealthStatusOk {
+					ep.markHealthy(e)
+					continue
+				}
+				log.DefaultLogger.Warn("Endpoint health check failed", "url", e.url.Redacted(), "message", res.Message)
+				ep.markFailed(e)
+			}
+		}
+	}()
+}
+
+// stop stops active health checks. It is safe to call it multiple times,
+// since the instance may be disposed more than once.
+func (ep *endpointPool) stop() {
+	ep.stopOnce.Do(func() {
+		close(ep.stopCh)
+	})
+	ep.wg.Wait()
+}
+
+type endpointKey struct{}
+
+// withEndpoint pins requests made with ctx to the given endpoint
+func withEndpoint(ctx context.Context, e *endpoint) context.Context {
+	return context.WithValue(ctx, endpointKey{}, e)
+}
+
+// failoverTransport sends requests built for the datasource url to the endpoints of the pool.
+// Network errors and 502, 503, 504 responses mark the endpoint as unhealthy
+// and the request is retried on the next endpoint.
+type failoverTransport struct {
+	pool *endpointPool
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (ft *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if primary := ft.pool.endpoints[0].url; req.URL.Host != primary.Host || req.URL.Scheme != primary.Scheme {
+		// requests to other services, e.g. vmalert, are sent as is
+		return ft.next.RoundTrip(req)
+	}
+	candidates := ft.pool.candidates()
+	if e, ok := req.Context().Value(endpointKey{}).(*endpoint); ok {
+		candidates = []*endpoint{e}
+	}
+
+	var lastErr error
+	for i, e := range candidates {
+		r, err := ft.pool.rewriteRequest(req, e)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := ft.next.RoundTrip(r)
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+		last := i == len(candidates)-1
+		if err != nil {
+			ft.pool.markFailed(e)
+			lastErr = err
+			if last || !canRetryRequest(req) {
+				return nil, err
+			}
+			log.DefaultLogger.Warn("Endpoint request failed, trying next endpoint", "url", e.url.Redacted(), "error", err)
+			continue
+		}
+		if !isUnavailableStatus(resp.StatusCode) {
+			ft.pool.markHealthy(e)
+			return resp, nil
+		}
+		ft.pool.markFailed(e)
+		if last || !canRetryRequest(req) {
+			return resp, nil
+		}
+		log.DefaultLogger.Warn("Endpoint is unavailable, trying next endpoint", "url", e.url.Redacted(), "status", resp.StatusCode)
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+	}
+	return nil, lastErr
+}
+
+// rewriteRequest returns a copy of req sent to the endpoint e
+func (ep *endpointPool) rewriteRequest(req *http.Request, e *endpoint) (*http.Request, error) {
+	if e == ep.endpoints[0] {
+		return req, nil
+	}
+	return e.rewriteRequest(req)
+}
+
+// rewriteRequest returns a copy of req built for the datasource url and sent to the endpoint
+func (e *endpoint) rewriteRequest(req *http.Request) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get request body: %w", err)
+		}
+		r.Body = body
+	}
+	r.URL.Scheme = e.url.Scheme
+	r.URL.Host = e.url.Host
+	r.URL.User = e.url.User
+	r.URL.Path = e.pathPrefix + req.URL.Path
+	r.URL.RawPath = ""
+	r.Host = ""
+	return r, nil
+}
+
+// canRetryRequest returns true if the request can be sent once more
+func canRetryRequest(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func isUnavailableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// checkEndpointsHealth checks every endpoint of the pool and combines results
+func (di *DatasourceInstance) checkEndpointsHealth(ctx context.Context) *backend.CheckHealthResult {
+	var failed []string
+	for _, e := range di.endpoints.endpoints {
+		res := di.checkHealth(withEndpoint(ctx, e))
+		if res.Status == backend.HealthStatusOk {
+			di.endpoints.markHealthy(e)
+			continue
+		}
+		di.endpoints.markFailed(e)
+		failed = append(failed, fmt.Sprintf("%s: %s", e.url.Redacted(), res.Message))
+	}
+	total := len(di.endpoints.endpoints)
+	switch {
+	case len(failed) == total:
+		return newHealthCheckErrorf("all endpoints are unavailable: %s", strings.Join(failed, "; "))
+	case len(failed) > 0:
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusOk,
+			Message: fmt.Sprintf("Data source is working, %d of %d endpoints are unavailable: %s", len(failed), total, strings.Join(failed, "; ")),
+		}
+	default:
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusOk,
+			Message: fmt.Sprintf("Data source is working, all %d endpoints are available", total),
+		}
+	}
+}
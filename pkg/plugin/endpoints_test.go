@@ -0,0 +1,235 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+func TestNewEndpointPool(t *testing.T) {
+	f := func(rawURL string, es EndpointsSettings, wantPrefixes []string, wantErr bool) {
+		t.Helper()
+		ep, err := newEndpointPool(rawURL, es)
+		if (err != nil) != wantErr {
+			t.Fatalf("newEndpointPool() error = %v, wantErr %v", err, wantErr)
+		}
+		if err != nil {
+			return
+		}
+		if len(ep.endpoints) != len(wantPrefixes) {
+			t.Fatalf("expected %d endpoints; got %d", len(wantPrefixes), len(ep.endpoints))
+		}
+		for i, e := range ep.endpoints {
+			if e.pathPrefix != wantPrefixes[i] {
+				t.Errorf("endpoint %d: expected path prefix %q; got %q", i, wantPrefixes[i], e.pathPrefix)
+			}
+		}
+	}
+
+	// same paths
+	f("http://vmselect-a:8481/select/0/prometheus", EndpointsSettings{
+		URLs: []string{"http://vmselect-b:8481/select/0/prometheus/"},
+	}, []string{"", ""}, false)
+
+	// endpoint behind a proxy with path prefix
+	f("http://vmselect-a:8481/select/0/prometheus", EndpointsSettings{
+		URLs:     []string{"https://vmauth:8427/zone-b/select/0/prometheus"},
+		Strategy: endpointStrategyRoundRobin,
+	}, []string{"", "/zone-b"}, false)
+
+	// datasource url without path
+	f("http://victoria-a:8428", EndpointsSettings{
+		URLs: []string{"http://victoria-b:8428"},
+	}, []string{"", ""}, false)
+
+	// mismatched path
+	f("http://vmselect-a:8481/select/0/prometheus", EndpointsSettings{
+		URLs: []string{"http://vmselect-b:8481/select/1/prometheus"},
+	}, nil, true)
+
+	// url without host
+	f("http://vmselect-a:8481", EndpointsSettings{
+		URLs: []string{"/select/0/prometheus"},
+	}, nil, true)
+
+	// unknown strategy
+	f("http://vmselect-a:8481", EndpointsSettings{
+		URLs:     []string{"http://vmselect-b:8481"},
+		Strategy: "random",
+	}, nil, true)
+
+	// invalid cooldown
+	f("http://vmselect-a:8481", EndpointsSettings{
+		URLs:     []string{"http://vmselect-b:8481"},
+		Cooldown: "soon",
+	}, nil, true)
+}
+
+func TestEndpointPool_candidates(t *testing.T) {
+	ep, err := newEndpointPool("http://a", EndpointsSettings{URLs: []string{"http://b", "http://c"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hosts := func() string {
+		var s []string
+		for _, e := range ep.candidates() {
+			s = append(s, e.url.Host)
+		}
+		return strings.Join(s, ",")
+	}
+
+	if got := hosts(); got != "a,b,c" {
+		t.Fatalf("unexpected priority order: %s", got)
+	}
+	ep.markFailed(ep.endpoints[0])
+	if got := hosts(); got != "b,c,a" {
+		t.Fatalf("unexpected order with unhealthy endpoint: %s", got)
+	}
+	ep.markHealthy(ep.endpoints[0])
+
+	ep.strategy = endpointStrategyRoundRobin
+	for _, want := range []string{"a,b,c", "b,c,a", "c,a,b", "a,b,c"} {
+		if got := hosts(); got != want {
+			t.Fatalf("unexpected round-robin order: %s; want %s", got, want)
+		}
+	}
+}
+
+func TestDatasourceQueryWithFailover(t *testing.T) {
+	var primaryCalls atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		primaryCalls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/zone-b/select/0/prometheus/api/v1/query" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1583786142, "1"]}}`))
+	}))
+	defer secondary.Close()
+
+	ds := NewDatasource()
+	pluginCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL:      primary.URL + "/select/0/prometheus",
+			JSONData: []byte(`{"httpMethod":"GET","endpoints":{"urls":["` + secondary.URL + `/zone-b/select/0/prometheus"],"cooldown":"1h"}}`),
+		},
+	}
+	query := func() {
+		t.Helper()
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: pluginCtx,
+			Queries: []backend.DataQuery{
+				{
+					RefID:     "A",
+					TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+					JSON:      []byte(`{"refId":"A","instant":true,"expr":"1"}`),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if rsp.Responses["A"].Error != nil {
+			t.Fatalf("unexpected error: %s", rsp.Responses["A"].Error)
+		}
+	}
+
+	query()
+	if n := primaryCalls.Load(); n != 1 {
+		t.Fatalf("expected 1 call to the primary endpoint; got %d", n)
+	}
+
+	// unhealthy primary endpoint is skipped during cooldown
+	query()
+	if n := primaryCalls.Load(); n != 1 {
+		t.Fatalf("expected primary endpoint to be skipped; got %d calls", n)
+	}
+}
+
+func TestCheckHealthWithEndpoints(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	newInstance := func(primary string, urls ...string) *DatasourceInstance {
+		t.Helper()
+		pool, err := newEndpointPool(primary, EndpointsSettings{URLs: urls})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return &DatasourceInstance{
+			url:        primary,
+			httpClient: &http.Client{Transport: &failoverTransport{pool: pool, next: http.DefaultTransport}},
+			endpoints:  pool,
+		}
+	}
+	ds := &Datasource{logger: log.DefaultLogger}
+
+	di := newInstance(healthy.URL, unhealthy.URL)
+	res, err := ds.checkHealthWithInstance(context.Background(), di)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res.Status != backend.HealthStatusOk || !strings.Contains(res.Message, "1 of 2 endpoints are unavailable") {
+		t.Fatalf("unexpected result: %v %s", res.Status, res.Message)
+	}
+	if di.endpoints.endpoints[1].healthy(time.Now()) {
+		t.Fatalf("expected unavailable endpoint to be marked as unhealthy")
+	}
+
+	di = newInstance(unhealthy.URL, unhealthy.URL)
+	res, err = ds.checkHealthWithInstance(context.Background(), di)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res.Status != backend.HealthStatusError {
+		t.Fatalf("expected error status; got %v %s", res.Status, res.Message)
+	}
+}
+
+func TestEndpointPool_startHealthChecks(t *testing.T) {
+	ep, err := newEndpointPool("http://a", EndpointsSettings{URLs: []string{"http://b"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ep.markFailed(ep.endpoints[0])
+
+	checked := make(chan struct{}, 2)
+	ep.startHealthChecks(10*time.Millisecond, func(ctx context.Context) *backend.CheckHealthResult {
+		e := ctx.Value(endpointKey{}).(*endpoint)
+		defer func() { checked <- struct{}{} }()
+		if e.url.Host == "b" {
+			return newHealthCheckErrorf("down")
+		}
+		return &backend.CheckHealthResult{Status: backend.HealthStatusOk}
+	})
+	<-checked
+	<-checked
+	ep.stop()
+	// stopping twice doesn't panic, e.g. on repeated disposal of the instance
+	ep.stop()
+
+	now := time.Now()
+	if !ep.endpoints[0].healthy(now) {
+		t.Errorf("expected endpoint a to be healthy")
+	}
+	if ep.endpoints[1].healthy(now) {
+		t.Errorf("expected endpoint b to be unhealthy")
+	}
+}
@@ -0,0 +1,230 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// errorKind is the class of the query execution error
+type errorKind string
+
+const (
+	// errorKindBadQuery means the query can't be executed as is, e.g. because of syntax errors
+	errorKindBadQuery errorKind = "bad_query"
+	// errorKindTimeout means the query wasn't answered in time
+	errorKindTimeout errorKind = "timeout"
+	// errorKindUnavailable means VictoriaMetrics or a proxy in front of it is unavailable
+	errorKindUnavailable errorKind = "unavailable"
+	// errorKindLimitExceeded means the query hit one of VictoriaMetrics limits
+	errorKindLimitExceeded errorKind = "limit_exceeded"
+	// errorKindAuth means the request was rejected by authentication or authorization
+	errorKindAuth errorKind = "auth"
+	// errorKindInternal means the plugin failed to build the request or to process the response
+	errorKindInternal errorKind = "internal"
+	// errorKindCanceled means the query was cancelled by the caller, e.g. when the dashboard was closed
+	errorKindCanceled errorKind = "canceled"
+
+	// statusClientClosedRequest is the non-standard status of requests cancelled by the client
+	statusClientClosedRequest = 499
+)
+
+// errCreateRequest is returned if the request to VictoriaMetrics can't be created, e.g. because of the malformed url
+var errCreateRequest = errors.New("failed to create new request with context")
+
+// queryError is a classified error of the query execution
+type queryError struct {
+	kind   errorKind
+	status backend.Status
+	source backend.ErrorSource
+	// hint contains an actionable suggestion for the user
+	hint string
+	err  error
+}
+
+// Error implements error interface
+func (e *queryError) Error() string {
+	if e.hint == "" {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%s; %s", e.err, e.hint)
+}
+
+// Unwrap returns the underlying error
+func (e *queryError) Unwrap() error {
+	return e.err
+}
+
+// newQueryError returns a queryError of the given kind with the status and source matching the kind
+func newQueryError(kind errorKind, err error) *queryError {
+	qe := &queryError{kind: kind, source: backend.ErrorSourceDownstream, err: err}
+	switch kind {
+	case errorKindBadQuery:
+		qe.status = backend.StatusBadRequest
+	case errorKindTimeout:
+		qe.status = backend.StatusTimeout
+	case errorKindUnavailable:
+		qe.status = backend.StatusBadGateway
+	case errorKindLimitExceeded:
+		qe.status = backend.Status(http.StatusUnprocessableEntity)
+	case errorKindAuth:
+		qe.status = backend.StatusUnauthorized
+	case errorKindCanceled:
+		// the cancellation isn't caused by VictoriaMetrics, so it mustn't count against it
+		qe.status = backend.Status(statusClientClosedRequest)
+		qe.source = backend.ErrorSourcePlugin
+	default:
+		qe.status = backend.StatusInternal
+		qe.source = backend.ErrorSourcePlugin
+	}
+	return qe
+}
+
+// limitError describes an error returned by VictoriaMetrics when the query hits a limit
+type limitError struct {
+	// flag is the command-line flag of the limit mentioned in the error message
+	flag string
+	kind errorKind
+	hint string
+}
+
+// limitErrors is a catalogue of VictoriaMetrics limits which may be hit by queries
+var limitErrors = []limitError{
+	{
+		flag: "-search.maxSamplesPerQuery",
+		kind: errorKindLimitExceeded,
+		hint: "the query selects too many raw samples; reduce the time range or the number of matching series, or increase -search.maxSamplesPerQuery on vmselect",
+	},
+	{
+		flag: "-search.maxSamplesPerSeries",
+		kind: errorKindLimitExceeded,
+		hint: "the query selects too many raw samples per series; reduce the time range or the lookbehind window in square brackets, or increase -search.maxSamplesPerSeries on vmselect",
+	},
+	{
+		flag: "-search.maxUniqueTimeseries",
+		kind: errorKindLimitExceeded,
+		hint: "the query matches too many series; add more specific label filters, or increase -search.maxUniqueTimeseries on vmselect and vmstorage",
+	},
+	{
+		flag: "-search.maxSeries",
+		kind: errorKindLimitExceeded,
+		hint: "the query matches too many series; add more specific label filters, or increase -search.maxSeries on vmselect",
+	},
+	{
+		flag: "-search.maxResponseSeries",
+		kind: errorKindLimitExceeded,
+		hint: "the query returns too many series; aggregate the result, e.g. with sum() by (...) or topk(), or increase -search.maxResponseSeries on vmselect",
+	},
+	{
+		flag: "-search.maxPointsPerTimeseries",
+		kind: errorKindLimitExceeded,
+		hint: "the query returns too many points per series; increase the step via Min interval or reduce the time range, or increase -search.maxPointsPerTimeseries on vmselect",
+	},
+	{
+		flag: "-search.maxPointsSubqueryPerTimeseries",
+		kind: errorKindLimitExceeded,
+		hint: "the subquery returns too many points per series; increase the subquery step, or increase -search.maxPointsSubqueryPerTimeseries on vmselect",
+	},
+	{
+		flag: "-search.maxMemoryPerQuery",
+		kind: errorKindLimitExceeded,
+		hint: "the query requires too much memory; reduce the time range or the number of matching series, or increase -search.maxMemoryPerQuery on vmselect",
+	},
+	{
+		flag: "-search.maxQueryLen",
+		kind: errorKindBadQuery,
+		hint: "the query is too long; simplify it or reduce the number of values of multi-value variables, or increase -search.maxQueryLen on vmselect",
+	},
+	{
+		flag: "-search.maxQueryDuration",
+		kind: errorKindTimeout,
+		hint: "the query takes too long; reduce the time range or the number of matching series, or increase -search.maxQueryDuration on vmselect",
+	},
+	{
+		flag: "-search.maxConcurrentRequests",
+		kind: errorKindUnavailable,
+		hint: "VictoriaMetrics is overloaded with concurrent queries; retry later, or increase -search.maxConcurrentRequests on vmselect",
+	},
+}
+
+// classifyResponseError returns a classified error for the unsuccessful response of VictoriaMetrics
+func classifyResponseError(statusCode int, err error) *queryError {
+	msg := err.Error()
+	for _, le := range limitErrors {
+		if strings.Contains(msg, le.flag) {
+			qe := newQueryError(le.kind, err)
+			qe.hint = le.hint
+			if le.kind == errorKindUnavailable {
+				qe.status = backend.StatusTooManyRequests
+			}
+			return qe
+		}
+	}
+
+	var qe *queryError
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		qe = newQueryError(errorKindAuth, err)
+		qe.hint = "check the authentication settings of the datasource and the access rules of the proxy in front of VictoriaMetrics"
+	case statusCode == http.StatusTooManyRequests:
+		qe = newQueryError(errorKindUnavailable, err)
+		qe.hint = "VictoriaMetrics or the proxy in front of it limits the request rate; retry later"
+	case statusCode == http.StatusGatewayTimeout || statusCode == http.StatusRequestTimeout:
+		qe = newQueryError(errorKindTimeout, err)
+	case statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable:
+		qe = newQueryError(errorKindUnavailable, err)
+	case statusCode >= 500:
+		qe = newQueryError(errorKindUnavailable, err)
+	default:
+		qe = newQueryError(errorKindBadQuery, err)
+	}
+	// keep the status received from VictoriaMetrics
+	qe.status = backend.Status(statusCode)
+	return qe
+}
+
+// newAccessDeniedError returns the error for requests denied by access restrictions of the datasource
+func newAccessDeniedError(err error) *queryError {
+	qe := newQueryError(errorKindAuth, err)
+	qe.status = backend.StatusForbidden
+	// the request is denied by the plugin without reaching VictoriaMetrics
+	qe.source = backend.ErrorSourcePlugin
+	return qe
+}
+
+// classifyRequestError returns a classified error for the request which got no response
+func classifyRequestError(err error) *queryError {
+	if errors.Is(err, errCreateRequest) {
+		return newQueryError(errorKindInternal, err)
+	}
+	if errors.Is(err, context.Canceled) {
+		return newQueryError(errorKindCanceled, err)
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		qe := newQueryError(errorKindTimeout, err)
+		qe.hint = "VictoriaMetrics didn't answer in time; reduce the time range of the query or increase the query timeout in datasource settings"
+		return qe
+	}
+	qe := newQueryError(errorKindUnavailable, err)
+	qe.hint = "check that VictoriaMetrics is reachable from Grafana at the datasource url"
+	return qe
+}
+
+// newQueryErrorResponse returns backend.DataResponse for err.
+// Status and error source are taken from queryError, if any.
+func newQueryErrorResponse(err error) backend.DataResponse {
+	var qe *queryError
+	if !errors.As(err, &qe) {
+		qe = newQueryError(errorKindInternal, err)
+	}
+	resp := newResponseError(err, qe.status)
+	resp.ErrorSource = qe.source
+	return resp
+}
@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func Test_classifyResponseError(t *testing.T) {
+	f := func(statusCode int, msg string, wantKind errorKind, wantStatus backend.Status, wantHint string) {
+		t.Helper()
+		qe := classifyResponseError(statusCode, errors.New(msg))
+		if qe.kind != wantKind {
+			t.Errorf("expected kind %q; got %q", wantKind, qe.kind)
+		}
+		if qe.status != wantStatus {
+			t.Errorf("expected status %d; got %d", wantStatus, qe.status)
+		}
+		if qe.source != backend.ErrorSourceDownstream {
+			t.Errorf("expected downstream error source; got %q", qe.source)
+		}
+		if !strings.Contains(qe.hint, wantHint) {
+			t.Errorf("expected hint containing %q; got %q", wantHint, qe.hint)
+		}
+	}
+
+	// syntax error
+	f(http.StatusUnprocessableEntity, `ERROR: 422, cannot parse query "sum(": unexpected end of stream`,
+		errorKindBadQuery, backend.Status(http.StatusUnprocessableEntity), "")
+
+	// limits
+	f(http.StatusUnprocessableEntity, `ERROR: 422, cannot select more than -search.maxSamplesPerQuery=1000000000 samples`,
+		errorKindLimitExceeded, backend.Status(http.StatusUnprocessableEntity), "increase -search.maxSamplesPerQuery")
+	f(http.StatusBadRequest, `ERROR: 422, the number of matching timeseries exceeds 300000; either narrow down the search or increase -search.maxUniqueTimeseries`,
+		errorKindLimitExceeded, backend.Status(http.StatusUnprocessableEntity), "increase -search.maxUniqueTimeseries")
+	f(http.StatusServiceUnavailable, `couldn't start executing the request in 10s, since -search.maxConcurrentRequests=8 concurrent requests are executed`,
+		errorKindUnavailable, backend.StatusTooManyRequests, "retry later")
+	f(http.StatusServiceUnavailable, `cannot execute query in -search.maxQueryDuration=30s`,
+		errorKindTimeout, backend.StatusTimeout, "increase -search.maxQueryDuration")
+
+	// statuses
+	f(http.StatusUnauthorized, "Unauthorized", errorKindAuth, backend.StatusUnauthorized, "authentication settings")
+	f(http.StatusForbidden, "access denied", errorKindAuth, backend.StatusForbidden, "authentication settings")
+	f(http.StatusTooManyRequests, "rate limit", errorKindUnavailable, backend.StatusTooManyRequests, "request rate")
+	f(http.StatusGatewayTimeout, "gateway timeout", errorKindTimeout, backend.StatusTimeout, "")
+	f(http.StatusBadGateway, "bad gateway", errorKindUnavailable, backend.StatusBadGateway, "")
+	f(http.StatusInternalServerError, "internal error", errorKindUnavailable, backend.StatusInternal, "")
+}
+
+func Test_classifyRequestError(t *testing.T) {
+	f := func(err error, wantKind errorKind, wantStatus backend.Status, wantSource backend.ErrorSource) {
+		t.Helper()
+		qe := classifyRequestError(err)
+		if qe.kind != wantKind {
+			t.Errorf("expected kind %q; got %q", wantKind, qe.kind)
+		}
+		if qe.status != wantStatus {
+			t.Errorf("expected status %d; got %d", wantStatus, qe.status)
+		}
+		if qe.source != wantSource {
+			t.Errorf("expected error source %q; got %q", wantSource, qe.source)
+		}
+	}
+
+	f(fmt.Errorf("Get \"http://vmselect\": %w", context.DeadlineExceeded), errorKindTimeout, backend.StatusTimeout, backend.ErrorSourceDownstream)
+	f(errors.New("dial tcp 127.0.0.1:8481: connect: connection refused"), errorKindUnavailable, backend.StatusBadGateway, backend.ErrorSourceDownstream)
+
+	// failures to build the request and cancellations by the caller don't count against VictoriaMetrics
+	f(fmt.Errorf("%w: %w", errCreateRequest, errors.New("invalid url")), errorKindInternal, backend.StatusInternal, backend.ErrorSourcePlugin)
+	f(fmt.Errorf("Get \"http://vmselect\": %w", context.Canceled), errorKindCanceled, backend.Status(statusClientClosedRequest), backend.ErrorSourcePlugin)
+}
+
+func TestDatasourceQueryErrorClassification(t *testing.T) {
+	f := func(handler http.HandlerFunc, wantStatus backend.Status, wantSource backend.ErrorSource, wantMsg string) {
+		t.Helper()
+		srv := httptest.NewServer(handler)
+		defer srv.Close()
+
+		ds := NewDatasource()
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+					URL:      srv.URL,
+					JSONData: []byte(`{"httpMethod":"GET"}`),
+				},
+			},
+			Queries: []backend.DataQuery{
+				{
+					RefID:     "A",
+					TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+					JSON:      []byte(`{"refId":"A","instant":true,"expr":"up"}`),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		response := rsp.Responses["A"]
+		if response.Error == nil {
+			t.Fatalf("expected error")
+		}
+		if response.Status != wantStatus {
+			t.Errorf("expected status %d; got %d", wantStatus, response.Status)
+		}
+		if response.ErrorSource != wantSource {
+			t.Errorf("expected error source %q; got %q", wantSource, response.ErrorSource)
+		}
+		if !strings.Contains(response.Error.Error(), wantMsg) {
+			t.Errorf("expected error containing %q; got %q", wantMsg, response.Error)
+		}
+	}
+
+	// limit exceeded
+	f(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(`{"status":"error","errorType":"422","error":"cannot select more than -search.maxSamplesPerQuery=100 samples"}`))
+	}, backend.Status(http.StatusUnprocessableEntity), backend.ErrorSourceDownstream, "increase -search.maxSamplesPerQuery on vmselect")
+
+	// unavailable
+	f(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, backend.Status(http.StatusServiceUnavailable), backend.ErrorSourceDownstream, "got unexpected response status code: 503")
+
+	// invalid response
+	f(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"value":[1670226733,"NaN"]`))
+	}, backend.StatusInternal, backend.ErrorSourcePlugin, "failed to decode body response")
+}
+
+func Test_newQueryErrorResponse(t *testing.T) {
+	f := func(err error, wantStatus backend.Status, wantSource backend.ErrorSource) {
+		t.Helper()
+		resp := newQueryErrorResponse(err)
+		if resp.Status != wantStatus {
+			t.Errorf("expected status %d; got %d", wantStatus, resp.Status)
+		}
+		if resp.ErrorSource != wantSource {
+			t.Errorf("expected error source %q; got %q", wantSource, resp.ErrorSource)
+		}
+	}
+
+	f(newQueryError(errorKindBadQuery, errors.New("bad query")), backend.StatusBadRequest, backend.ErrorSourceDownstream)
+
+	// requests denied by the plugin
+	f(newAccessDeniedError(errors.New("denied")), backend.StatusForbidden, backend.ErrorSourcePlugin)
+
+	// unclassified errors are internal
+	f(errors.New("unexpected"), backend.StatusInternal, backend.ErrorSourcePlugin)
+}
@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+// headersMiddlewareName is the name of the http client middleware setting forwarded headers
+const headersMiddlewareName = "ForwardedHeaders"
+
+// HeaderForwardingSettings contains the policy of forwarding headers of Grafana requests to VictoriaMetrics.
+// If the policy isn't enabled, all headers forwarded by Grafana are sent to VictoriaMetrics.
+type HeaderForwardingSettings struct {
+	// Enabled replaces forwarding of all headers with the policy below.
+	// The enabled policy with empty fields forwards no headers.
+	Enabled bool `json:"enabled,omitempty"`
+	// AllowedHeaders is the list of forwarded headers
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+	// UserLoginHeader, UserEmailHeader and OrgIDHeader are names of headers
+	// with the Grafana user login, email and org id, e.g. for routing in vmauth
+	UserLoginHeader string `json:"userLoginHeader,omitempty"`
+	UserEmailHeader string `json:"userEmailHeader,omitempty"`
+	OrgIDHeader     string `json:"orgIdHeader,omitempty"`
+	// ForwardOAuthToken forwards the OAuth access token of the user in the Authorization header
+	ForwardOAuthToken bool `json:"forwardOAuthToken,omitempty"`
+	// ForwardIDToken forwards the OAuth ID token of the user in the X-Id-Token header
+	ForwardIDToken bool `json:"forwardIdToken,omitempty"`
+}
+
+// headers returns headers to send to VictoriaMetrics for the request
+func (s HeaderForwardingSettings) headers(rc requestContext) http.Header {
+	h := make(http.Header)
+	for _, name := range s.AllowedHeaders {
+		if v := rc.headers.Values(name); len(v) > 0 {
+			h[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	if s.ForwardOAuthToken {
+		if v := rc.headers.Get(backend.OAuthIdentityTokenHeaderName); v != "" {
+			h.Set(backend.OAuthIdentityTokenHeaderName, v)
+		}
+	}
+	if s.ForwardIDToken {
+		if v := rc.headers.Get(backend.OAuthIdentityIDTokenHeaderName); v != "" {
+			h.Set(backend.OAuthIdentityIDTokenHeaderName, v)
+		}
+	}
+	if rc.user != nil {
+		if s.UserLoginHeader != "" && rc.user.Login != "" {
+			h.Set(s.UserLoginHeader, rc.user.Login)
+		}
+		if s.UserEmailHeader != "" && rc.user.Email != "" {
+			h.Set(s.UserEmailHeader, rc.user.Email)
+		}
+	}
+	if s.OrgIDHeader != "" && rc.orgID > 0 {
+		h.Set(s.OrgIDHeader, strconv.FormatInt(rc.orgID, 10))
+	}
+	return h
+}
+
+type forwardedHeadersKey struct{}
+
+// withForwardedHeaders returns the context with headers to set to requests sent with it
+func withForwardedHeaders(ctx context.Context, h http.Header) context.Context {
+	return context.WithValue(ctx, forwardedHeadersKey{}, h)
+}
+
+// forwardedHeadersMiddleware sets headers from the request context
+// unless they are already set, e.g. by authentication settings of the datasource
+func forwardedHeadersMiddleware() httpclient.Middleware {
+	return httpclient.NamedMiddlewareFunc(headersMiddlewareName, func(_ httpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			h, _ := req.Context().Value(forwardedHeadersKey{}).(http.Header)
+			for k, vs := range h {
+				if req.Header.Get(k) == "" {
+					req.Header[k] = vs
+				}
+			}
+			return next.RoundTrip(req)
+		})
+	})
+}
+
+// withRequestContext returns the context with forwarded headers and the identity
+// of the Grafana request for requests sent to VictoriaMetrics on its behalf
+func (di *DatasourceInstance) withRequestContext(ctx context.Context, rc requestContext) context.Context {
+	if di.settings.HeaderForwarding.Enabled {
+		ctx = withForwardedHeaders(ctx, di.settings.HeaderForwarding.headers(rc))
+	}
+	if di.jwt != nil {
+		ctx = withRequestIdentity(ctx, rc)
+	}
+	return ctx
+}
+
+// withHeaderForwarding applies the header forwarding policy and the identity propagation
+// of the datasource to resource calls
+func (d *Datasource) withHeaderForwarding(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		di, err := d.getInstance(ctx, backend.PluginConfigFromContext(ctx))
+		if err == nil {
+			req = req.WithContext(di.withRequestContext(ctx, newResourceRequestContext(req)))
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
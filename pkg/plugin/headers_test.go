@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestHeaderForwardingSettings_headers(t *testing.T) {
+	rc := requestContext{
+		orgID: 2,
+		user:  &backend.User{Login: "alice", Email: "alice@example.com"},
+		headers: http.Header{
+			"X-Team":        {"infra"},
+			"X-Secret":      {"s"},
+			"Authorization": {"Bearer access"},
+			"X-Id-Token":    {"id"},
+		},
+	}
+	f := func(s HeaderForwardingSettings, want http.Header) {
+		t.Helper()
+		if got := s.headers(rc); !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected headers %v; got %v", want, got)
+		}
+	}
+
+	// nothing is forwarded by default
+	f(HeaderForwardingSettings{Enabled: true}, http.Header{})
+
+	// allow-list
+	f(HeaderForwardingSettings{Enabled: true, AllowedHeaders: []string{"x-team", "X-Missing"}}, http.Header{"X-Team": {"infra"}})
+
+	// user identity
+	f(HeaderForwardingSettings{Enabled: true, UserLoginHeader: "X-Grafana-User", UserEmailHeader: "X-Grafana-Email", OrgIDHeader: "X-Grafana-Org-Id"}, http.Header{
+		"X-Grafana-User":   {"alice"},
+		"X-Grafana-Email":  {"alice@example.com"},
+		"X-Grafana-Org-Id": {"2"},
+	})
+
+	// oauth tokens
+	f(HeaderForwardingSettings{Enabled: true, ForwardOAuthToken: true, ForwardIDToken: true}, http.Header{
+		"Authorization": {"Bearer access"},
+		"X-Id-Token":    {"id"},
+	})
+}
+
+func TestDatasourceHeaderForwarding(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Team"); got != "infra" {
+			t.Errorf("expected X-Team header to be forwarded; got %q", got)
+		}
+		if got := r.Header.Get("X-Grafana-User"); got != "alice" {
+			t.Errorf("expected X-Grafana-User header; got %q", got)
+		}
+		if got := r.Header.Get("X-Secret"); got != "" {
+			t.Errorf("expected X-Secret header not to be forwarded; got %q", got)
+		}
+		if got := r.Header.Get("Authorization"); got != "" {
+			t.Errorf("expected Authorization header not to be forwarded; got %q", got)
+		}
+		if r.URL.Path == instantQueryPath {
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+	}))
+	defer srv.Close()
+
+	pluginCtx := backend.PluginContext{
+		OrgID: 1,
+		User:  &backend.User{Login: "alice"},
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL:      srv.URL,
+			JSONData: []byte(`{"httpMethod":"GET","headerForwarding":{"enabled":true,"allowedHeaders":["X-Team"],"userLoginHeader":"X-Grafana-User"}}`),
+		},
+	}
+	ds := NewDatasource()
+
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: pluginCtx,
+		Headers: map[string]string{
+			"http_X-Team":   "infra",
+			"http_X-Secret": "s",
+			"Authorization": "Bearer access",
+		},
+		Queries: []backend.DataQuery{
+			{
+				RefID:     "A",
+				TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+				JSON:      []byte(`{"refId":"A","expr":"up","instant":true}`),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if response := rsp.Responses["A"]; response.Error != nil {
+		t.Fatalf("unexpected error: %s", response.Error)
+	}
+
+	ctx := backend.WithPluginContext(context.Background(), pluginCtx)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/labels", nil).WithContext(ctx)
+	req.Header.Set("X-Team", "infra")
+	req.Header.Set("X-Secret", "s")
+	req.Header.Set("Authorization", "Bearer access")
+	rr := httptest.NewRecorder()
+	ds.withHeaderForwarding(http.HandlerFunc(ds.VMAPIQuery)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d; body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,284 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	buildInfoPath = "/api/v1/status/buildinfo"
+	labelsPath    = "/api/v1/labels"
+	metricsPath   = "/metrics"
+
+	modeSingleNode = "single-node"
+	modeCluster    = "cluster"
+	modeVMAuth     = "vmauth"
+	modeUnknown    = "unknown"
+
+	// maxHealthResponseSize limits responses read by health check probes
+	maxHealthResponseSize = 4 << 20
+)
+
+// vmAppVersionRe matches the vm_app_version metric exposed by VictoriaMetrics components,
+// e.g. vm_app_version{version="vmselect-20240603-v1.102.0-cluster",short_version="v1.102.0"} 1
+var vmAppVersionRe = regexp.MustCompile(`^vm_app_version\{.*?version="([^"]*)"(?:.*short_version="([^"]*)")?`)
+
+// healthDetails is returned in JSONDetails of successful health checks
+type healthDetails struct {
+	// Version is the VictoriaMetrics version, or the Prometheus version reported by buildinfo
+	Version string `json:"version,omitempty"`
+	// Mode is one of "single-node", "cluster", "vmauth" or "unknown"
+	Mode string `json:"mode"`
+	// Backend is the VictoriaMetrics version behind vmauth, derived from the datasource url
+	Backend string `json:"backend,omitempty"`
+	// LatencyMs is the round-trip latency of the health check query
+	LatencyMs int64 `json:"latencyMs,omitempty"`
+	// LabelsAPI is "ok" if the label API is accessible
+	LabelsAPI string `json:"labelsApi"`
+	// Warnings contain problems which don't prevent data queries
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// summary returns the short description of details for the health check message
+func (hd healthDetails) summary() string {
+	var parts []string
+	if hd.Version != "" {
+		parts = append(parts, "version "+hd.Version)
+	}
+	if hd.Mode != modeUnknown {
+		mode := hd.Mode
+		if hd.Backend != "" {
+			mode += " with " + hd.Backend + " backend"
+		}
+		parts = append(parts, mode)
+	}
+	if hd.LatencyMs > 0 {
+		parts = append(parts, fmt.Sprintf("latency %dms", hd.LatencyMs))
+	}
+	s := strings.Join(parts, ", ")
+	if len(hd.Warnings) > 0 {
+		if s != "" {
+			s += ". "
+		}
+		s += "Warnings: " + strings.Join(hd.Warnings, "; ")
+	}
+	return s
+}
+
+// healthDetails detects the version and the mode of VictoriaMetrics and checks permissions of the label API.
+// Failed probes are reported as warnings, since data queries may still work.
+func (di *DatasourceInstance) healthDetails(ctx context.Context) healthDetails {
+	hd := healthDetails{}
+	hd.Version, hd.Mode, hd.Backend = di.detectVersion(ctx)
+	hd.LabelsAPI = "ok"
+	if err := di.checkLabelsAPI(ctx); err != nil {
+		hd.LabelsAPI = "error"
+		hd.Warnings = append(hd.Warnings, "label API is not available, so label autocompletion won't work: "+err.Error())
+	}
+	return hd
+}
+
+// detectVersion returns the version and the mode of VictoriaMetrics and,
+// for vmauth, the mode of VictoriaMetrics behind it
+func (di *DatasourceInstance) detectVersion(ctx context.Context) (string, string, string) {
+	var version, backendMode string
+	mode := modeUnknown
+	if appVersion, shortVersion, err := di.fetchAppVersion(ctx); err == nil {
+		version = shortVersion
+		switch {
+		case strings.HasPrefix(appVersion, "victoria-metrics"):
+			mode = modeSingleNode
+		case strings.HasPrefix(appVersion, "vmselect"):
+			mode = modeCluster
+		case strings.HasPrefix(appVersion, "vmauth"):
+			mode = modeVMAuth
+		}
+	}
+	if mode == modeUnknown && tenantSegment(di.url) != "" {
+		mode = modeCluster
+	}
+	if mode == modeVMAuth {
+		backendMode = modeSingleNode
+		if tenantSegment(di.url) != "" {
+			backendMode = modeCluster
+		}
+	}
+	if version == "" {
+		if v, err := di.fetchBuildInfoVersion(ctx); err == nil {
+			version = v
+		}
+	}
+	return version, mode, backendMode
+}
+
+// fetchAppVersion returns the version labels of the vm_app_version metric
+func (di *DatasourceInstance) fetchAppVersion(ctx context.Context) (string, string, error) {
+	u, err := newURL(di.url, metricsPath, true)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := di.healthGet(ctx, u.String())
+	if err != nil {
+		return "", "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("got response code %d", resp.StatusCode)
+	}
+	sc := bufio.NewScanner(io.LimitReader(resp.Body, maxHealthResponseSize))
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		m := vmAppVersionRe.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		shortVersion := m[2]
+		if shortVersion == "" {
+			shortVersion = m[1]
+		}
+		return m[1], shortVersion, nil
+	}
+	if err := sc.Err(); err != nil {
+		return "", "", err
+	}
+	return "", "", fmt.Errorf("vm_app_version metric not found")
+}
+
+// fetchBuildInfoVersion returns the version reported by the Prometheus-compatible buildinfo API
+func (di *DatasourceInstance) fetchBuildInfoVersion(ctx context.Context) (string, error) {
+	u, err := newURL(di.url, buildInfoPath, false)
+	if err != nil {
+		return "", err
+	}
+	resp, err := di.healthGet(ctx, u.String())
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got response code %d", resp.StatusCode)
+	}
+	var r struct {
+		Data struct {
+			Version string `json:"version"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxHealthResponseSize)).Decode(&r); err != nil {
+		return "", fmt.Errorf("failed to decode buildinfo response: %w", err)
+	}
+	if r.Data.Version == "" {
+		return "", fmt.Errorf("buildinfo response contains no version")
+	}
+	return r.Data.Version, nil
+}
+
+// checkLabelsAPI requests label names for the last 5 minutes
+func (di *DatasourceInstance) checkLabelsAPI(ctx context.Context) error {
+	u, err := newURL(di.url, labelsPath, false)
+	if err != nil {
+		return err
+	}
+	values := u.Query()
+	for k, vl := range di.queryParams {
+		for _, v := range vl {
+			values.Add(k, v)
+		}
+	}
+	now := time.Now()
+	values.Set("start", strconv.FormatInt(now.Add(-5*time.Minute).Unix(), 10))
+	values.Set("end", strconv.FormatInt(now.Unix(), 10))
+	u.RawQuery = values.Encode()
+	resp, err := di.healthGet(ctx, u.String())
+	if err != nil {
+		return healthRequestError(u.Host, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return healthStatusError(labelsPath, resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (di *DatasourceInstance) healthGet(ctx context.Context, reqURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return di.httpClient.Do(req)
+}
+
+// healthRequestError returns the actionable error for the failed health check request to host
+func healthRequestError(host string, err error) error {
+	var dnsErr *net.DNSError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalid x509.CertificateInvalidError
+	var recordHeaderErr tls.RecordHeaderError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return fmt.Errorf("failed to resolve host %q: check the host name in the datasource url", dnsErr.Name)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("connection to %s refused: check that VictoriaMetrics is running and listens on the port from the datasource url", host)
+	case errors.As(err, &unknownAuthority):
+		return fmt.Errorf("TLS certificate of %s is signed by unknown authority: add the CA certificate to TLS settings or enable skip TLS verification", host)
+	case errors.As(err, &hostnameErr):
+		return fmt.Errorf("TLS certificate isn't valid for %s: %s", host, hostnameErr.Error())
+	case errors.As(err, &certInvalid):
+		return fmt.Errorf("TLS certificate of %s is invalid: %s", host, certInvalid.Error())
+	case errors.As(err, &recordHeaderErr):
+		return fmt.Errorf("%s doesn't speak TLS: use http:// scheme in the datasource url", host)
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return fmt.Errorf("%s didn't answer in time: check network connectivity from Grafana or increase the query timeout", host)
+	default:
+		return fmt.Errorf("request to %s failed: %w", host, err)
+	}
+}
+
+// healthStatusError returns the actionable error for the unexpected response status of the health check request
+func healthStatusError(path string, statusCode int, body []byte) error {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("%s: authentication failed (401): check credentials in the authentication settings", path)
+	case http.StatusForbidden:
+		return fmt.Errorf("%s: access denied (403): check that credentials are allowed to access the path, e.g. in vmauth url_map or url_prefix", path)
+	case http.StatusNotFound:
+		return fmt.Errorf("%s: not found (404): check the datasource url; it must point to the Prometheus API, e.g. http://vmselect:8481/select/0/prometheus for the cluster version", path)
+	}
+	msg := fmt.Sprintf("%s: got response code %d", path, statusCode)
+	if b := strings.TrimSpace(string(body)); b != "" {
+		msg += ": " + b
+	}
+	if statusCode >= 500 {
+		msg += "; check logs of VictoriaMetrics or the proxy in front of it"
+	}
+	return errors.New(msg)
+}
+
+// newHealthCheckResult returns the successful result with details
+func newHealthCheckResult(message string, hd healthDetails) *backend.CheckHealthResult {
+	if s := hd.summary(); s != "" {
+		message += ": " + s
+	}
+	res := &backend.CheckHealthResult{Status: backend.HealthStatusOk, Message: message}
+	if b, err := json.Marshal(hd); err == nil {
+		res.JSONDetails = b
+	}
+	return res
+}
@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+func TestCheckHealthDetails(t *testing.T) {
+	f := func(path, metrics string, labelsStatus int, want healthDetails, wantMessage string) {
+		t.Helper()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/metrics":
+				if metrics == "" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				_, _ = fmt.Fprint(w, metrics)
+			case strings.HasSuffix(r.URL.Path, buildInfoPath):
+				_, _ = w.Write([]byte(`{"status":"success","data":{"version":"2.24.0"}}`))
+			case strings.HasSuffix(r.URL.Path, labelsPath):
+				w.WriteHeader(labelsStatus)
+			default:
+				_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1583786142, "1"]}}`))
+			}
+		}))
+		defer srv.Close()
+
+		ds := &Datasource{logger: log.DefaultLogger}
+		di := &DatasourceInstance{
+			url:        srv.URL + path,
+			httpClient: srv.Client(),
+		}
+		res, err := ds.checkHealthWithInstance(context.Background(), di)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if res.Status != backend.HealthStatusOk {
+			t.Fatalf("expected HealthStatusOk; got %v: %s", res.Status, res.Message)
+		}
+		var got healthDetails
+		if err := json.Unmarshal(res.JSONDetails, &got); err != nil {
+			t.Fatalf("failed to unmarshal details %q: %s", res.JSONDetails, err)
+		}
+		if got.LatencyMs < 0 {
+			t.Fatalf("unexpected latency %d", got.LatencyMs)
+		}
+		got.LatencyMs = 0
+		if len(got.Warnings) != len(want.Warnings) {
+			t.Fatalf("expected warnings %q; got %q", want.Warnings, got.Warnings)
+		}
+		for i := range got.Warnings {
+			if !strings.Contains(got.Warnings[i], want.Warnings[i]) {
+				t.Fatalf("expected warning containing %q; got %q", want.Warnings[i], got.Warnings[i])
+			}
+		}
+		got.Warnings, want.Warnings = nil, nil
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected details %+v; got %+v", want, got)
+		}
+		if !strings.HasPrefix(res.Message, wantMessage) {
+			t.Fatalf("expected message starting with %q; got %q", wantMessage, res.Message)
+		}
+	}
+
+	// single-node
+	f("", `# HELP vm_app_version
+vm_app_version{version="victoria-metrics-20240603-v1.102.0",short_version="v1.102.0"} 1
+`, http.StatusOK, healthDetails{Version: "v1.102.0", Mode: modeSingleNode, LabelsAPI: "ok"},
+		"Data source is working: version v1.102.0, single-node")
+
+	// vmselect
+	f("/select/0/prometheus", `vm_app_version{version="vmselect-20240603-v1.102.0-cluster",short_version="v1.102.0"} 1
+`, http.StatusOK, healthDetails{Version: "v1.102.0", Mode: modeCluster, LabelsAPI: "ok"},
+		"Data source is working: version v1.102.0, cluster")
+
+	// vmauth in front of the cluster version with forbidden label API
+	f("/select/0/prometheus", `vm_app_version{version="vmauth-20240603-v1.102.0",short_version="v1.102.0"} 1
+`, http.StatusForbidden, healthDetails{Version: "v1.102.0", Mode: modeVMAuth, Backend: modeCluster, LabelsAPI: "error", Warnings: []string{"access denied (403)"}},
+		"Data source is working: version v1.102.0, vmauth with cluster backend")
+
+	// protected /metrics falls back to buildinfo and the datasource url
+	f("/select/0/prometheus", "", http.StatusOK, healthDetails{Version: "2.24.0", Mode: modeCluster, LabelsAPI: "ok"},
+		"Data source is working: version 2.24.0, cluster")
+
+	// unknown mode
+	f("", "", http.StatusOK, healthDetails{Version: "2.24.0", Mode: modeUnknown, LabelsAPI: "ok"},
+		"Data source is working: version 2.24.0")
+}
+
+func TestCheckHealthErrorMessages(t *testing.T) {
+	f := func(status int, wantMessage string) {
+		t.Helper()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte("error details"))
+		}))
+		defer srv.Close()
+
+		ds := &Datasource{logger: log.DefaultLogger}
+		di := &DatasourceInstance{url: srv.URL, httpClient: srv.Client()}
+		res, err := ds.checkHealthWithInstance(context.Background(), di)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if res.Status != backend.HealthStatusError {
+			t.Fatalf("expected HealthStatusError; got %v", res.Status)
+		}
+		if !strings.Contains(res.Message, wantMessage) {
+			t.Fatalf("expected message containing %q; got %q", wantMessage, res.Message)
+		}
+	}
+
+	f(http.StatusUnauthorized, "authentication failed (401)")
+	f(http.StatusForbidden, "access denied (403)")
+	f(http.StatusNotFound, "/select/0/prometheus")
+	f(http.StatusBadGateway, "got response code 502: error details; check logs")
+	f(http.StatusBadRequest, "got response code 400: error details")
+}
+
+func Test_healthRequestError(t *testing.T) {
+	f := func(err error, wantMessage string) {
+		t.Helper()
+		got := healthRequestError("vm:8428", err).Error()
+		if !strings.Contains(got, wantMessage) {
+			t.Fatalf("expected message containing %q; got %q", wantMessage, got)
+		}
+	}
+
+	f(&net.DNSError{Name: "vm", Err: "no such host", IsNotFound: true}, `failed to resolve host "vm"`)
+	f(context.DeadlineExceeded, "didn't answer in time")
+	f(fmt.Errorf("unexpected EOF"), "request to vm:8428 failed: unexpected EOF")
+
+	// real connection and TLS errors
+	_, err := http.Get("http://127.0.0.1:1")
+	f(err, "connection to vm:8428 refused")
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	_, err = http.Get(srv.URL)
+	f(err, "signed by unknown authority")
+}
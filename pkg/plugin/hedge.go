@@ -0,0 +1,245 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	defaultHedgePercentile   = 95
+	defaultHedgeInitialDelay = time.Second
+	defaultHedgeMinDelay     = 50 * time.Millisecond
+
+	// hedgeLatencySamples is the number of the latest query_range latencies used for the percentile
+	hedgeLatencySamples = 256
+	// hedgeMinLatencySamples is the number of latencies required to use the percentile instead of the initial delay
+	hedgeMinLatencySamples = 20
+)
+
+// HedgingSettings contains settings for hedged query_range requests.
+// If the datasource url doesn't answer within the configured percentile of recent latencies,
+// the same request is sent to one of replicas and the first answer is used.
+type HedgingSettings struct {
+	// Replicas contains urls of replicas serving the same data as the datasource url.
+	// The path of every url must end with the path of the datasource url.
+	Replicas []string `json:"replicas,omitempty"`
+	// Percentile of recent query_range latencies after which a hedged request is sent, 95 by default
+	Percentile float64 `json:"percentile,omitempty"`
+	// InitialDelay is used instead of the percentile until enough latencies are collected, 1s by default
+	InitialDelay string `json:"initialDelay,omitempty"`
+	// MinDelay is the lower bound of the delay before a hedged request, 50ms by default
+	MinDelay string `json:"minDelay,omitempty"`
+}
+
+// hedger sends hedged requests to replicas and tracks latencies of requests
+type hedger struct {
+	replicas     []*endpoint
+	percentile   float64
+	initialDelay time.Duration
+	minDelay     time.Duration
+	next         atomic.Uint64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	pos       int
+}
+
+// newHedger returns a hedger for the datasource url
+func newHedger(rawURL string, hs HedgingSettings) (*hedger, error) {
+	primary, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse datasource url: %w", err)
+	}
+	h := &hedger{
+		percentile:   defaultHedgePercentile,
+		initialDelay: defaultHedgeInitialDelay,
+		minDelay:     defaultHedgeMinDelay,
+	}
+	if hs.Percentile != 0 {
+		if hs.Percentile <= 0 || hs.Percentile >= 100 {
+			return nil, fmt.Errorf("percentile must be in range (0, 100); got %v", hs.Percentile)
+		}
+		h.percentile = hs.Percentile
+	}
+	if hs.InitialDelay != "" {
+		if h.initialDelay, err = time.ParseDuration(hs.InitialDelay); err != nil {
+			return nil, fmt.Errorf("failed to parse initial delay: %w", err)
+		}
+	}
+	if hs.MinDelay != "" {
+		if h.minDelay, err = time.ParseDuration(hs.MinDelay); err != nil {
+			return nil, fmt.Errorf("failed to parse min delay: %w", err)
+		}
+	}
+	for _, raw := range hs.Replicas {
+		e, err := newEndpoint(primary, raw)
+		if err != nil {
+			return nil, err
+		}
+		h.replicas = append(h.replicas, e)
+	}
+	return h, nil
+}
+
+// delay returns the duration to wait for the answer before sending a hedged request
+func (h *hedger) delay() time.Duration {
+	h.mu.Lock()
+	if len(h.latencies) < hedgeMinLatencySamples {
+		h.mu.Unlock()
+		return max(h.initialDelay, h.minDelay)
+	}
+	sorted := append([]time.Duration(nil), h.latencies...)
+	h.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(float64(len(sorted)-1) * h.percentile / 100)
+	return max(sorted[idx], h.minDelay)
+}
+
+func (h *hedger) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.latencies) < hedgeLatencySamples {
+		h.latencies = append(h.latencies, d)
+		return
+	}
+	h.latencies[h.pos] = d
+	h.pos = (h.pos + 1) % hedgeLatencySamples
+}
+
+func (h *hedger) nextReplica() *endpoint {
+	return h.replicas[int(h.next.Add(1)-1)%len(h.replicas)]
+}
+
+type hedgeResult struct {
+	resp    *http.Response
+	err     error
+	latency time.Duration
+	idx     int
+}
+
+// do sends the request to the datasource url and, if it isn't answered in time or fails,
+// to a replica. The first answer without a server error is returned and the other request is cancelled.
+func (h *hedger) do(ctx context.Context, cl *http.Client, method, reqURL string) (*http.Response, error) {
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	winner := -1
+	defer func() {
+		// the context of the returned response is cancelled when its body is closed
+		for i, cancel := range cancels {
+			if i != winner {
+				cancel()
+			}
+		}
+	}()
+	send := func(e *endpoint) {
+		reqCtx, cancel := context.WithCancel(ctx)
+		if e != nil {
+			reqCtx = withEndpoint(reqCtx, e)
+		}
+		idx := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			start := time.Now()
+			resp, err := doQueryRequest(reqCtx, cl, method, reqURL)
+			results <- hedgeResult{resp: resp, err: err, latency: time.Since(start), idx: idx}
+		}()
+	}
+
+	send(nil)
+	timer := time.NewTimer(h.delay())
+	defer timer.Stop()
+	pending := 1
+	for {
+		select {
+		case <-timer.C:
+			if len(cancels) == 1 {
+				log.DefaultLogger.Debug("Sending hedged request", "url", reqURL)
+				send(h.nextReplica())
+				pending++
+			}
+		case res := <-results:
+			pending--
+			failed := res.err != nil || res.resp.StatusCode >= http.StatusInternalServerError
+			if failed && len(cancels) == 1 && ctx.Err() == nil {
+				// the datasource url failed before the delay, so there is no reason to wait for it
+				if res.err == nil {
+					_ = res.resp.Body.Close()
+				}
+				log.DefaultLogger.Debug("Sending hedged request after failure", "url", reqURL)
+				send(h.nextReplica())
+				pending++
+				continue
+			}
+			if failed && pending > 0 {
+				// wait for the answer of the other request
+				if res.err == nil {
+					_ = res.resp.Body.Close()
+				}
+				continue
+			}
+			if res.err != nil {
+				return nil, res.err
+			}
+			if !failed {
+				h.observe(res.latency)
+			}
+			winner = res.idx
+			if pending > 0 {
+				go drainHedgeResults(results, pending)
+			}
+			res.resp.Body = &cancelOnCloseBody{ReadCloser: res.resp.Body, cancel: cancels[winner]}
+			return res.resp, nil
+		}
+	}
+}
+
+// replicaTransport sends requests pinned by the hedger to a replica.
+// It is used if failover across endpoints isn't configured, since failoverTransport routes pinned requests itself.
+type replicaTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (rt *replicaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e, ok := req.Context().Value(endpointKey{}).(*endpoint)
+	if !ok {
+		return rt.next.RoundTrip(req)
+	}
+	r, err := e.rewriteRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return rt.next.RoundTrip(r)
+}
+
+// drainHedgeResults closes responses of cancelled requests
+func drainHedgeResults(results <-chan hedgeResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.err == nil {
+			_ = res.resp.Body.Close()
+		}
+	}
+}
+
+// cancelOnCloseBody releases the request context when the response body is closed
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer interface
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
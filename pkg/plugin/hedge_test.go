@@ -0,0 +1,154 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestNewHedger(t *testing.T) {
+	f := func(hs HedgingSettings, wantErr bool) {
+		t.Helper()
+		_, err := newHedger("http://vmselect-a:8481/select/0/prometheus", hs)
+		if (err != nil) != wantErr {
+			t.Fatalf("newHedger() error = %v, wantErr %v", err, wantErr)
+		}
+	}
+
+	f(HedgingSettings{Replicas: []string{"http://vmselect-b:8481/select/0/prometheus"}}, false)
+	f(HedgingSettings{Replicas: []string{"http://vmselect-b:8481/select/0/prometheus"}, Percentile: 99, InitialDelay: "500ms", MinDelay: "10ms"}, false)
+	f(HedgingSettings{Replicas: []string{"http://vmselect-b:8481/select/1/prometheus"}}, true)
+	f(HedgingSettings{Replicas: []string{"http://vmselect-b:8481/select/0/prometheus"}, Percentile: 100}, true)
+	f(HedgingSettings{Replicas: []string{"http://vmselect-b:8481/select/0/prometheus"}, InitialDelay: "1"}, true)
+}
+
+func TestHedger_delay(t *testing.T) {
+	h, err := newHedger("http://a", HedgingSettings{Replicas: []string{"http://b"}, Percentile: 90, InitialDelay: "2s", MinDelay: "5ms"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d := h.delay(); d != 2*time.Second {
+		t.Fatalf("expected initial delay 2s; got %s", d)
+	}
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d := h.delay(); d != 90*time.Millisecond {
+		t.Fatalf("expected 90th percentile 90ms; got %s", d)
+	}
+	for i := 0; i < hedgeLatencySamples; i++ {
+		h.observe(time.Millisecond)
+	}
+	if d := h.delay(); d != 5*time.Millisecond {
+		t.Fatalf("expected min delay 5ms; got %s", d)
+	}
+}
+
+func TestDatasourceQueryWithHedging(t *testing.T) {
+	f := func(primaryDelay time.Duration, primaryStatus int, replicaDelay time.Duration, replicaDrops, wantReplicaCalls int32) {
+		t.Helper()
+		rangeResponse := []byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1670226733,"1"]]}]}}`)
+
+		primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(primaryDelay):
+			case <-r.Context().Done():
+				return
+			}
+			if primaryStatus != http.StatusOK {
+				w.WriteHeader(primaryStatus)
+				return
+			}
+			_, _ = w.Write(rangeResponse)
+		}))
+		defer primary.Close()
+
+		var replicaCalls atomic.Int32
+		replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if replicaCalls.Add(1) <= replicaDrops {
+				// the connection is closed by something in the middle
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Errorf("failed to hijack connection: %s", err)
+					return
+				}
+				_ = conn.Close()
+				return
+			}
+			if r.URL.Path != "/replica/select/0/prometheus/api/v1/query_range" {
+				t.Errorf("unexpected path: %s", r.URL.Path)
+			}
+			time.Sleep(replicaDelay)
+			_, _ = w.Write(rangeResponse)
+		}))
+		defer replica.Close()
+
+		ds := NewDatasource()
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+					URL:      primary.URL + "/select/0/prometheus",
+					JSONData: []byte(`{"httpMethod":"GET","hedging":{"replicas":["` + replica.URL + `/replica/select/0/prometheus"],"initialDelay":"100ms"}}`),
+				},
+			},
+			Queries: []backend.DataQuery{
+				{
+					RefID:     "A",
+					TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+					JSON:      []byte(`{"refId":"A","range":true,"expr":"up"}`),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if rsp.Responses["A"].Error != nil {
+			t.Fatalf("unexpected error: %s", rsp.Responses["A"].Error)
+		}
+		if len(rsp.Responses["A"].Frames) != 1 {
+			t.Fatalf("expected 1 frame; got %d", len(rsp.Responses["A"].Frames))
+		}
+		if n := replicaCalls.Load(); n != wantReplicaCalls {
+			t.Fatalf("expected %d calls to the replica; got %d", wantReplicaCalls, n)
+		}
+	}
+
+	// primary answers in time
+	f(0, http.StatusOK, 0, 0, 0)
+
+	// primary is slow, the replica answers first
+	f(5*time.Second, http.StatusOK, 0, 0, 1)
+
+	// the server error of the primary doesn't win against the replica answering later
+	f(200*time.Millisecond, http.StatusServiceUnavailable, 500*time.Millisecond, 0, 1)
+
+	// the fast server error of the primary sends the hedged request without waiting for the delay
+	f(0, http.StatusInternalServerError, 0, 0, 1)
+
+	// hedged requests are retried once on trivial network errors
+	f(5*time.Second, http.StatusOK, 0, 1, 2)
+}
+
+func TestNewDatasourceInstanceWithHedging(t *testing.T) {
+	inst, err := newDatasourceInstance(context.Background(), backend.DataSourceInstanceSettings{
+		URL:      "http://vmselect-a:8481/select/0/prometheus",
+		JSONData: []byte(`{"hedging":{"replicas":["http://vmselect-b:8481/select/0/prometheus"]}}`),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	di := inst.(*DatasourceInstance)
+	defer di.Dispose()
+	if di.hedger == nil {
+		t.Fatalf("expected hedger to be configured")
+	}
+	// hedging doesn't enable failover across replicas
+	if di.endpoints != nil {
+		t.Fatalf("expected no endpoint pool without endpoints settings")
+	}
+}
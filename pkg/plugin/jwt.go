@@ -0,0 +1,232 @@
+package plugin
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+const (
+	jwtAlgHS256 = "HS256"
+	jwtAlgRS256 = "RS256"
+
+	// jwtMiddlewareName is the name of the http client middleware attaching minted tokens
+	jwtMiddlewareName = "JWTIdentity"
+	// defaultJWTTTL is the default lifetime of minted tokens
+	defaultJWTTTL = 5 * time.Minute
+)
+
+// JWTSettings contains settings for minting JWTs with the Grafana user identity,
+// which are attached to every request, so vmauth or a proxy can enforce per-user access rules.
+// The signing key is stored in the "jwtKey" field of secure settings:
+// the shared secret for HS256 or the PEM-encoded RSA private key for RS256.
+type JWTSettings struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Algorithm is either "HS256" or "RS256"
+	Algorithm string `json:"algorithm,omitempty"`
+	Issuer    string `json:"issuer,omitempty"`
+	Audience  string `json:"audience,omitempty"`
+	// KeyID is set to the "kid" header of tokens
+	KeyID string `json:"keyId,omitempty"`
+	// TTL is the lifetime of tokens; 5m by default
+	TTL string `json:"ttl,omitempty"`
+	// Header is the request header for tokens. Tokens are sent as "Bearer <token>"
+	// in the Authorization header by default and as is in other headers.
+	Header string `json:"header,omitempty"`
+}
+
+// usesAuthorizationHeader returns true if tokens are sent in the Authorization header
+func (s JWTSettings) usesAuthorizationHeader() bool {
+	return s.Header == "" || http.CanonicalHeaderKey(s.Header) == "Authorization"
+}
+
+// TeamMembership assigns the matching Grafana users to the team.
+// Grafana doesn't pass team membership to plugins, so teams are defined in the datasource settings.
+// A request matches the membership if it matches any of users, roles or orgs.
+type TeamMembership struct {
+	// Name is the team name
+	Name string `json:"name"`
+	// Users contains Grafana user logins
+	Users []string `json:"users,omitempty"`
+	// Roles contains Grafana organization roles, e.g. Viewer, Editor or Admin
+	Roles []string `json:"roles,omitempty"`
+	// Orgs contains Grafana organization IDs
+	Orgs []int64 `json:"orgs,omitempty"`
+}
+
+func (tm TeamMembership) matches(rc requestContext) bool {
+	return TenantAccessRule{Users: tm.Users, Roles: tm.Roles, Orgs: tm.Orgs}.matches(rc)
+}
+
+// teams returns names of teams the request belongs to
+func teams(memberships []TeamMembership, rc requestContext) []string {
+	var names []string
+	for _, tm := range memberships {
+		if tm.matches(rc) {
+			names = append(names, tm.Name)
+		}
+	}
+	return names
+}
+
+// jwtClaims are claims of minted tokens
+type jwtClaims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  string   `json:"aud,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Email     string   `json:"email,omitempty"`
+	Role      string   `json:"role,omitempty"`
+	OrgID     int64    `json:"org_id"`
+	Teams     []string `json:"teams,omitempty"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// jwtMinter signs short-lived tokens with the Grafana user identity
+type jwtMinter struct {
+	settings JWTSettings
+	ttl      time.Duration
+	hmacKey  []byte
+	rsaKey   *rsa.PrivateKey
+	teams    []TeamMembership
+	now      func() time.Time
+}
+
+// newJWTMinter returns the minter for the settings and the key from the secure settings
+func newJWTMinter(s JWTSettings, key string, teams []TeamMembership) (*jwtMinter, error) {
+	m := &jwtMinter{settings: s, ttl: defaultJWTTTL, teams: teams, now: time.Now}
+	if s.TTL != "" {
+		ttl, err := time.ParseDuration(s.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid ttl %q: expecting positive duration", s.TTL)
+		}
+		m.ttl = ttl
+	}
+	if key == "" {
+		return nil, fmt.Errorf("signing key must be set in the secure settings")
+	}
+	switch s.Algorithm {
+	case jwtAlgHS256:
+		m.hmacKey = []byte(key)
+	case jwtAlgRS256:
+		rsaKey, err := parseRSAPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		m.rsaKey = rsaKey
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q; supported values are %q and %q", s.Algorithm, jwtAlgHS256, jwtAlgRS256)
+	}
+	return m, nil
+}
+
+func parseRSAPrivateKey(key string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM-encoded RSA private key")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RSA private key: %w", err)
+	}
+	rsaKey, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T; expecting RSA key", k)
+	}
+	return rsaKey, nil
+}
+
+// mint returns the signed token for the request
+func (m *jwtMinter) mint(rc requestContext) (string, error) {
+	now := m.now()
+	claims := jwtClaims{
+		Issuer:    m.settings.Issuer,
+		Audience:  m.settings.Audience,
+		OrgID:     rc.orgID,
+		Teams:     teams(m.teams, rc),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(m.ttl).Unix(),
+	}
+	if rc.user != nil {
+		claims.Subject = rc.user.Login
+		claims.Email = rc.user.Email
+		claims.Role = rc.user.Role
+	}
+	header := map[string]string{"alg": m.settings.Algorithm, "typ": "JWT"}
+	if m.settings.KeyID != "" {
+		header["kid"] = m.settings.KeyID
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	var signature []byte
+	if m.rsaKey != nil {
+		digest := sha256.Sum256([]byte(unsigned))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, m.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", fmt.Errorf("failed to sign token: %w", err)
+		}
+	} else {
+		mac := hmac.New(sha256.New, m.hmacKey)
+		mac.Write([]byte(unsigned))
+		signature = mac.Sum(nil)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// setToken mints the token for the request and sets it to h
+func (m *jwtMinter) setToken(h http.Header, rc requestContext) error {
+	token, err := m.mint(rc)
+	if err != nil {
+		return err
+	}
+	if m.settings.usesAuthorizationHeader() {
+		h.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	h.Set(m.settings.Header, token)
+	return nil
+}
+
+type requestIdentityKey struct{}
+
+// withRequestIdentity returns the context with the identity of the Grafana request
+func withRequestIdentity(ctx context.Context, rc requestContext) context.Context {
+	return context.WithValue(ctx, requestIdentityKey{}, rc)
+}
+
+// jwtMiddleware attaches the token minted for the request identity to every request.
+// Requests without identity, e.g. background health checks, get tokens with empty user claims.
+func jwtMiddleware(m *jwtMinter) httpclient.Middleware {
+	return httpclient.NamedMiddlewareFunc(jwtMiddlewareName, func(_ httpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			rc, _ := req.Context().Value(requestIdentityKey{}).(requestContext)
+			if err := m.setToken(req.Header, rc); err != nil {
+				return nil, fmt.Errorf("failed to mint jwt: %w", err)
+			}
+			return next.RoundTrip(req)
+		})
+	})
+}
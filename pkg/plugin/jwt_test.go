@@ -0,0 +1,212 @@
+package plugin
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// decodeJWT verifies the token signature with verify and returns its header and claims
+func decodeJWT(t *testing.T, token string, verify func(unsigned string, signature []byte) error) (map[string]string, jwtClaims) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected token with 3 parts; got %q", token)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("failed to decode signature: %s", err)
+	}
+	if err := verify(parts[0]+"."+parts[1], signature); err != nil {
+		t.Fatalf("invalid signature: %s", err)
+	}
+	var header map[string]string
+	var claims jwtClaims
+	for i, v := range []any{&header, &claims} {
+		b, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatalf("failed to decode token part %d: %s", i, err)
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			t.Fatalf("failed to unmarshal token part %d: %s", i, err)
+		}
+	}
+	return header, claims
+}
+
+func verifyHS256(key string) func(string, []byte) error {
+	return func(unsigned string, signature []byte) error {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(unsigned))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+}
+
+func TestJWTMinter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	rc := requestContext{
+		orgID: 2,
+		user:  &backend.User{Login: "alice", Email: "alice@example.com", Role: "Editor"},
+	}
+	memberships := []TeamMembership{
+		{Name: "infra", Users: []string{"alice"}},
+		{Name: "editors", Roles: []string{"Editor"}},
+		{Name: "other", Orgs: []int64{3}},
+	}
+
+	// HS256
+	m, err := newJWTMinter(JWTSettings{Enabled: true, Algorithm: "HS256", Issuer: "grafana", Audience: "vmauth", KeyID: "k1", TTL: "1m"}, "secret", memberships)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	m.now = func() time.Time { return now }
+	token, err := m.mint(rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	header, claims := decodeJWT(t, token, verifyHS256("secret"))
+	if want := map[string]string{"alg": "HS256", "typ": "JWT", "kid": "k1"}; !reflect.DeepEqual(header, want) {
+		t.Fatalf("expected header %v; got %v", want, header)
+	}
+	want := jwtClaims{
+		Issuer:    "grafana",
+		Audience:  "vmauth",
+		Subject:   "alice",
+		Email:     "alice@example.com",
+		Role:      "Editor",
+		OrgID:     2,
+		Teams:     []string{"infra", "editors"},
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Minute).Unix(),
+	}
+	if !reflect.DeepEqual(claims, want) {
+		t.Fatalf("expected claims %+v; got %+v", want, claims)
+	}
+
+	// RS256 with PKCS8 key
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	m, err = newJWTMinter(JWTSettings{Enabled: true, Algorithm: "RS256"}, pemKey, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	m.now = func() time.Time { return now }
+	token, err = m.mint(requestContext{orgID: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	header, claims = decodeJWT(t, token, func(unsigned string, signature []byte) error {
+		digest := sha256.Sum256([]byte(unsigned))
+		return rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature)
+	})
+	if header["alg"] != "RS256" {
+		t.Fatalf("expected RS256 algorithm; got %q", header["alg"])
+	}
+	want = jwtClaims{OrgID: 1, IssuedAt: now.Unix(), ExpiresAt: now.Add(defaultJWTTTL).Unix()}
+	if !reflect.DeepEqual(claims, want) {
+		t.Fatalf("expected claims %+v; got %+v", want, claims)
+	}
+}
+
+func TestNewJWTMinter_Failure(t *testing.T) {
+	f := func(s JWTSettings, key string) {
+		t.Helper()
+		if _, err := newJWTMinter(s, key, nil); err == nil {
+			t.Fatalf("expected error for settings %+v", s)
+		}
+	}
+
+	f(JWTSettings{Algorithm: "HS256"}, "")
+	f(JWTSettings{Algorithm: "ES256"}, "secret")
+	f(JWTSettings{Algorithm: "HS256", TTL: "-1m"}, "secret")
+	f(JWTSettings{Algorithm: "RS256"}, "not a pem key")
+}
+
+func TestDatasourceJWT(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("X-Grafana-JWT"))
+		mu.Unlock()
+		if r.URL.Path == instantQueryPath {
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+	}))
+	defer srv.Close()
+
+	pluginCtx := backend.PluginContext{
+		OrgID: 1,
+		User:  &backend.User{Login: "alice"},
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL:                     srv.URL,
+			JSONData:                []byte(`{"httpMethod":"GET","jwt":{"enabled":true,"algorithm":"HS256","header":"X-Grafana-JWT"},"teams":[{"name":"infra","users":["alice"]}]}`),
+			DecryptedSecureJSONData: map[string]string{"jwtKey": "secret"},
+		},
+	}
+	ds := NewDatasource()
+
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: pluginCtx,
+		Queries: []backend.DataQuery{
+			{
+				RefID:     "A",
+				TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+				JSON:      []byte(`{"refId":"A","expr":"up","instant":true}`),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if response := rsp.Responses["A"]; response.Error != nil {
+		t.Fatalf("unexpected error: %s", response.Error)
+	}
+
+	ctx := backend.WithPluginContext(context.Background(), pluginCtx)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/labels", nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	ds.withHeaderForwarding(http.HandlerFunc(ds.VMAPIQuery)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d; body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	if len(tokens) != 2 {
+		t.Fatalf("expected 2 requests; got %d", len(tokens))
+	}
+	for _, token := range tokens {
+		_, claims := decodeJWT(t, token, verifyHS256("secret"))
+		if claims.Subject != "alice" || claims.OrgID != 1 || !reflect.DeepEqual(claims.Teams, []string{"infra"}) {
+			t.Fatalf("unexpected claims %+v", claims)
+		}
+	}
+}
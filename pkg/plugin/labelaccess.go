@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"fmt"
+)
+
+// LabelAccessRule restricts series visible to the matching Grafana users to the listed filters.
+// A request matches the rule if it matches any of users, teams, roles or orgs.
+// Filters of all matching rules are combined, so a user sees series matching any of them.
+type LabelAccessRule struct {
+	// Users contains Grafana user logins
+	Users []string `json:"users,omitempty"`
+	// Teams contains names of teams defined in the datasource settings
+	Teams []string `json:"teams,omitempty"`
+	// Roles contains Grafana organization roles, e.g. Viewer, Editor or Admin
+	Roles []string `json:"roles,omitempty"`
+	// Orgs contains Grafana organization IDs. Alerting requests have no user,
+	// so they can be matched only by organization.
+	Orgs []int64 `json:"orgs,omitempty"`
+	// Filters contains series selectors, e.g. {namespace=~"team-a-.*"}.
+	// The empty selector {} allows all series.
+	Filters []string `json:"filters"`
+}
+
+func (r LabelAccessRule) matches(rc requestContext, teams []string) bool {
+	if (TenantAccessRule{Users: r.Users, Roles: r.Roles, Orgs: r.Orgs}).matches(rc) {
+		return true
+	}
+	for _, team := range r.Teams {
+		for _, t := range teams {
+			if team == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateLabelAccessRules checks that filters of rules can be enforced via extra_filters[]
+func validateLabelAccessRules(rules []LabelAccessRule) error {
+	for i, r := range rules {
+		if len(r.Filters) == 0 {
+			return fmt.Errorf("rule #%d has no filters", i+1)
+		}
+		for _, f := range r.Filters {
+			if _, err := filterInner(f); err != nil {
+				return fmt.Errorf("rule #%d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// labelAccessFilters returns series filters allowed for the request by the label access rules.
+// Requests matching no rule are denied.
+func labelAccessFilters(rules []LabelAccessRule, memberships []TeamMembership, rc requestContext) ([]string, error) {
+	userTeams := teams(memberships, rc)
+	var filters []string
+	seen := make(map[string]bool)
+	for _, r := range rules {
+		if !r.matches(rc, userTeams) {
+			continue
+		}
+		for _, f := range r.Filters {
+			if !seen[f] {
+				seen[f] = true
+				filters = append(filters, f)
+			}
+		}
+	}
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("no label access rules match the user")
+	}
+	return filters, nil
+}
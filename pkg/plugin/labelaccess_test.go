@@ -0,0 +1,168 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func Test_labelAccessFilters(t *testing.T) {
+	rules := []LabelAccessRule{
+		{Teams: []string{"team-a"}, Filters: []string{`{namespace=~"team-a-.*"}`}},
+		{Users: []string{"bob"}, Filters: []string{`{namespace="shared"}`, `{namespace=~"team-a-.*"}`}},
+		{Roles: []string{"Admin"}, Filters: []string{`{}`}},
+		{Orgs: []int64{5}, Filters: []string{`{job="alerts"}`}},
+	}
+	memberships := []TeamMembership{{Name: "team-a", Users: []string{"alice", "bob"}}}
+	f := func(rc requestContext, want []string, wantErr bool) {
+		t.Helper()
+		got, err := labelAccessFilters(rules, memberships, rc)
+		if (err != nil) != wantErr {
+			t.Fatalf("labelAccessFilters() error = %v, wantErr %v", err, wantErr)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("labelAccessFilters() got = %q, want %q", got, want)
+		}
+	}
+
+	// user matches by team
+	f(requestContext{user: &backend.User{Login: "alice", Role: "Viewer"}}, []string{`{namespace=~"team-a-.*"}`}, false)
+
+	// filters of all matching rules are combined without duplicates
+	f(requestContext{user: &backend.User{Login: "bob"}}, []string{`{namespace=~"team-a-.*"}`, `{namespace="shared"}`}, false)
+
+	// role
+	f(requestContext{user: &backend.User{Login: "root", Role: "admin"}}, []string{`{}`}, false)
+
+	// alerting request without user matches by org
+	f(requestContext{orgID: 5}, []string{`{job="alerts"}`}, false)
+
+	// no matching rules
+	f(requestContext{orgID: 1, user: &backend.User{Login: "eve", Role: "Viewer"}}, nil, true)
+}
+
+func Test_validateLabelAccessRules(t *testing.T) {
+	f := func(rules []LabelAccessRule, wantErr bool) {
+		t.Helper()
+		if err := validateLabelAccessRules(rules); (err != nil) != wantErr {
+			t.Fatalf("validateLabelAccessRules() error = %v, wantErr %v", err, wantErr)
+		}
+	}
+
+	f(nil, false)
+	f([]LabelAccessRule{{Users: []string{"alice"}, Filters: []string{`{namespace="a"}`, `{}`}}}, false)
+	f([]LabelAccessRule{{Users: []string{"alice"}}}, true)
+	f([]LabelAccessRule{{Users: []string{"alice"}, Filters: []string{`namespace="a"`}}}, true)
+	f([]LabelAccessRule{{Users: []string{"alice"}, Filters: []string{`{namespace="a" or namespace="b"}`}}}, true)
+}
+
+func TestDatasourceLabelAccess(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every extra filter must contain the enforced label filter
+		q := r.URL.Query()
+		filters := q["extra_filters[]"]
+		if len(filters) == 0 || q.Has("extra_filters") {
+			t.Errorf("expected only extra_filters[] in request %s", r.URL)
+		}
+		for _, f := range filters {
+			if !strings.Contains(f, `namespace=~"team-a-.*"`) {
+				t.Errorf("unexpected extra_filters[] %q in request %s", f, r.URL)
+			}
+		}
+		switch r.URL.Path {
+		case instantQueryPath:
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1583786142, "1"]}}`))
+		default:
+			_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+		}
+	}))
+	defer srv.Close()
+
+	ds := NewDatasource()
+	pluginCtx := backend.PluginContext{
+		OrgID: 1,
+		User:  &backend.User{Login: "alice"},
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL: srv.URL,
+			JSONData: []byte(`{
+				"httpMethod": "POST",
+				"vmalertUrl": "http://vmalert:8880",
+				"teams": [{"name": "team-a", "users": ["alice"]}],
+				"labelAccess": [{"teams": ["team-a"], "filters": ["{namespace=~\"team-a-.*\"}"]}]
+			}`),
+		},
+	}
+
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: pluginCtx,
+		Queries: []backend.DataQuery{
+			{
+				RefID:     "A",
+				TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+				JSON:      []byte(`{"refId":"A","instant":true,"expr":"1"}`),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rsp.Responses["A"].Error != nil {
+		t.Fatalf("unexpected error: %s", rsp.Responses["A"].Error)
+	}
+
+	ctx := backend.WithPluginContext(context.Background(), pluginCtx)
+	f := func(path string, wantStatus int) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		ds.VMAPIQuery(rr, req)
+		if rr.Code != wantStatus {
+			t.Fatalf("%s: expected status %d, got %d; body: %s", path, wantStatus, rr.Code, rr.Body.String())
+		}
+	}
+
+	// restricted routes
+	f("/api/v1/query?query=up", http.StatusOK)
+	f("/api/v1/series?match[]=up", http.StatusOK)
+	f("/api/v1/labels", http.StatusOK)
+	f("/api/v1/label/job/values", http.StatusOK)
+	f("/api/v1/export?match[]=up", http.StatusOK)
+	f("/api/v1/export/csv?match[]=up&format=__name__", http.StatusOK)
+
+	// user filters can only narrow the restriction
+	f("/api/v1/series?match[]=up&extra_filters="+url.QueryEscape(`{job="a"}`), http.StatusOK)
+
+	// "or" filters can't widen the restriction
+	f("/api/v1/series?match[]=up&extra_filters[]="+url.QueryEscape(`{job="a" or namespace="b"}`), http.StatusForbidden)
+
+	// routes ignoring extra_filters[]
+	f("/api/v1/metadata", http.StatusForbidden)
+	req := httptest.NewRequest(http.MethodGet, "/vmalert/api/v1/rules", nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	ds.VMAlertQuery(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("/vmalert/api/v1/rules: expected status %d, got %d; body: %s", http.StatusForbidden, rr.Code, rr.Body.String())
+	}
+	rsp, err = ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: pluginCtx,
+		Queries:       []backend.DataQuery{{RefID: "A", QueryType: queryTypeVMAlertAlerts, JSON: []byte(`{"refId":"A"}`)}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := rsp.Responses["A"].Status; got != backend.StatusForbidden {
+		t.Fatalf("vmalertAlerts: expected status %d, got %d", backend.StatusForbidden, got)
+	}
+
+	// user matching no rules
+	pluginCtx.User = &backend.User{Login: "bob"}
+	ctx = backend.WithPluginContext(context.Background(), pluginCtx)
+	f("/api/v1/labels", http.StatusForbidden)
+}
@@ -0,0 +1,272 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ResponseLimits contains hard limits for query responses decoded by the plugin.
+// They protect the plugin process from running out of memory on huge responses.
+// Zero values disable the corresponding limit.
+type ResponseLimits struct {
+	// MaxBytes is the maximum size of the response body in bytes
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// MaxSeries is the maximum number of series in the response
+	MaxSeries int64 `json:"maxSeries,omitempty"`
+	// MaxSamples is the maximum number of samples of all series in the response
+	MaxSamples int64 `json:"maxSamples,omitempty"`
+}
+
+// defaultMaxDecompressedBytes limits the size of decompressed responses if MaxBytes isn't set,
+// so a small compressed response can't expand to exhaust the memory of the plugin process
+const defaultMaxDecompressedBytes = 1 << 30
+
+// maxDecompressedBytes returns the limit for the size of decompressed responses
+func (l ResponseLimits) maxDecompressedBytes() int64 {
+	if l.MaxBytes > 0 {
+		return l.MaxBytes
+	}
+	return defaultMaxDecompressedBytes
+}
+
+func (l ResponseLimits) validate() error {
+	if l.MaxBytes < 0 || l.MaxSeries < 0 || l.MaxSamples < 0 {
+		return fmt.Errorf("response limits must be non-negative")
+	}
+	return nil
+}
+
+// newResponseLimitError returns the error for the response exceeding the limit
+func newResponseLimitError(what string, limit int64, setting string) *queryError {
+	qe := newQueryError(errorKindLimitExceeded, fmt.Errorf("query aborted: the response exceeds the limit of %d %s", limit, what))
+	qe.hint = fmt.Sprintf("reduce the time range, narrow down the selectors or aggregate the result, or raise %q in the response limits of the datasource settings", setting)
+	return qe
+}
+
+// limitedReader returns an error as soon as more than limit bytes are read
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+// Read implements io.Reader interface
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.read > lr.limit {
+		return 0, newResponseLimitError("bytes", lr.limit, "maxBytes")
+	}
+	// read at most one byte over the limit to detect the overflow
+	if rest := lr.limit - lr.read + 1; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := lr.r.Read(p)
+	lr.read += int64(n)
+	if lr.read > lr.limit {
+		return n, newResponseLimitError("bytes", lr.limit, "maxBytes")
+	}
+	return n, err
+}
+
+// decodeResponse decodes the response body while enforcing the limits.
+// Series and samples are counted while the body is read, so the read is aborted
+// as soon as a limit is exceeded instead of after the whole body is in memory.
+func (l ResponseLimits) decodeResponse(body io.Reader) (*Response, error) {
+	if l.MaxBytes > 0 {
+		body = &limitedReader{r: body, limit: l.MaxBytes}
+	}
+	var r Response
+	var err error
+	if l.MaxSeries > 0 || l.MaxSamples > 0 {
+		err = l.decodeCounting(body, &r)
+	} else {
+		err = json.NewDecoder(body).Decode(&r)
+	}
+	if err != nil {
+		var qe *queryError
+		if errors.As(err, &qe) {
+			return nil, qe
+		}
+		return nil, newQueryError(errorKindInternal, fmt.Errorf("failed to decode body response: %w", err))
+	}
+	return &r, nil
+}
+
+// decodeCounting walks over the response counting series and samples of data.result.
+// data.result isn't decoded twice: it references the read body, while the rest
+// of the response is small and is decoded with data.result replaced by null.
+// The body is already limited by maxBytes, so it can't be buffered past the limit.
+func (l ResponseLimits) decodeCounting(body io.Reader, r *Response) error {
+	var buf bytes.Buffer
+	dec := json.NewDecoder(io.TeeReader(body, &buf))
+	// start and end are offsets of data.result in buf
+	start, end := int64(-1), int64(-1)
+	err := walkObject(dec, func(key string) error {
+		if key != "data" {
+			return skipValue(dec)
+		}
+		return walkObject(dec, func(key string) error {
+			if key != "result" {
+				return skipValue(dec)
+			}
+			start = dec.InputOffset()
+			if err := l.countResult(dec); err != nil {
+				return err
+			}
+			end = dec.InputOffset()
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	b := buf.Bytes()[:dec.InputOffset()]
+	if start < 0 {
+		return json.Unmarshal(b, r)
+	}
+	// the offset after the key may precede the colon
+	result := bytes.TrimLeft(b[start:end], " \t\r\n:")
+	start = end - int64(len(result))
+	rest := make([]byte, 0, int64(len(b))-int64(len(result))+4)
+	rest = append(rest, b[:start]...)
+	rest = append(rest, "null"...)
+	rest = append(rest, b[end:]...)
+	if err := json.Unmarshal(rest, r); err != nil {
+		return err
+	}
+	r.Data.Result = result
+	return nil
+}
+
+// checkResult walks over series of the vector or matrix result without decoding values
+// and returns an error as soon as the number of series or samples exceeds the limits.
+func (l ResponseLimits) checkResult(d Data) error {
+	if l.MaxSeries <= 0 && l.MaxSamples <= 0 {
+		return nil
+	}
+	if d.ResultType != vector && d.ResultType != matrix {
+		return nil
+	}
+	return l.countResult(json.NewDecoder(bytes.NewReader(d.Result)))
+}
+
+// countResult reads the result from dec and returns an error as soon as
+// the number of series or samples exceeds the limits.
+// Elements of scalar and string results aren't series, so they aren't counted.
+func (l ResponseLimits) countResult(dec *json.Decoder) error {
+	ok, err := openDelim(dec, '[')
+	if err != nil || !ok {
+		return err
+	}
+	var series, samples int64
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("failed to decode result: %w", err)
+		}
+		if _, isDelim := t.(json.Delim); !isDelim {
+			continue
+		}
+		if t != json.Delim('{') {
+			return fmt.Errorf("failed to decode result: unexpected token %v; expecting series", t)
+		}
+		series++
+		if l.MaxSeries > 0 && series > l.MaxSeries {
+			return newResponseLimitError("series", l.MaxSeries, "maxSeries")
+		}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return fmt.Errorf("failed to decode result: %w", err)
+			}
+			switch key {
+			case "values":
+				if err := expectDelim(dec, '['); err != nil {
+					return err
+				}
+				for dec.More() {
+					samples++
+					if l.MaxSamples > 0 && samples > l.MaxSamples {
+						return newResponseLimitError("samples", l.MaxSamples, "maxSamples")
+					}
+					if err := skipValue(dec); err != nil {
+						return err
+					}
+				}
+				if err := expectDelim(dec, ']'); err != nil {
+					return err
+				}
+			case "value":
+				samples++
+				if l.MaxSamples > 0 && samples > l.MaxSamples {
+					return newResponseLimitError("samples", l.MaxSamples, "maxSamples")
+				}
+				fallthrough
+			default:
+				if err := skipValue(dec); err != nil {
+					return err
+				}
+			}
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// walkObject calls f with every key of the object read from dec; f must read the value of the key.
+// null values are skipped.
+func walkObject(dec *json.Decoder, f func(key string) error) error {
+	ok, err := openDelim(dec, '{')
+	if err != nil || !ok {
+		return err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("failed to decode result: %w", err)
+		}
+		key, _ := t.(string)
+		if err := f(key); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// openDelim reads the opening delimiter from dec. It returns false for null values.
+func openDelim(dec *json.Decoder, want json.Delim) (bool, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return false, fmt.Errorf("failed to decode result: %w", err)
+	}
+	if t == nil {
+		return false, nil
+	}
+	if d, ok := t.(json.Delim); !ok || d != want {
+		return false, fmt.Errorf("failed to decode result: unexpected token %v; expecting %q", t, want)
+	}
+	return true, nil
+}
+
+func skipValue(dec *json.Decoder) error {
+	var skip json.RawMessage
+	if err := dec.Decode(&skip); err != nil {
+		return fmt.Errorf("failed to decode result: %w", err)
+	}
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to decode result: %w", err)
+	}
+	if d, ok := t.(json.Delim); !ok || d != want {
+		return fmt.Errorf("failed to decode result: unexpected token %v; expecting %q", t, want)
+	}
+	return nil
+}
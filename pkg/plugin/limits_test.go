@@ -0,0 +1,175 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestResponseLimits_checkResult(t *testing.T) {
+	f := func(limits ResponseLimits, resultType, result string, wantErr string) {
+		t.Helper()
+		err := limits.checkResult(Data{ResultType: resultType, Result: []byte(result)})
+		if wantErr == "" {
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			return
+		}
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("expected error containing %q; got %v", wantErr, err)
+		}
+		var qe *queryError
+		if !errors.As(err, &qe) || qe.kind != errorKindLimitExceeded {
+			t.Fatalf("expected %q error; got %v", errorKindLimitExceeded, err)
+		}
+	}
+
+	matrixResult := `[{"metric":{"__name__":"up","job":"a"},"values":[[1,"1"],[2,"1"]]},{"metric":{"job":"b"},"values":[[1,"0"]]}]`
+	vectorResult := `[{"metric":{"job":"a"},"value":[1,"1"]},{"metric":{"job":"b"},"value":[1,"0"]}]`
+
+	// no limits
+	f(ResponseLimits{}, matrix, matrixResult, "")
+
+	// within limits
+	f(ResponseLimits{MaxSeries: 2, MaxSamples: 3}, matrix, matrixResult, "")
+	f(ResponseLimits{MaxSeries: 2, MaxSamples: 2}, vector, vectorResult, "")
+
+	// scalar results aren't checked
+	f(ResponseLimits{MaxSeries: 1, MaxSamples: 1}, scalar, `[1,"1"]`, "")
+
+	// series limit
+	f(ResponseLimits{MaxSeries: 1}, matrix, matrixResult, `the limit of 1 series; reduce the time range, narrow down the selectors or aggregate the result, or raise "maxSeries"`)
+	f(ResponseLimits{MaxSeries: 1}, vector, vectorResult, "the limit of 1 series")
+
+	// samples limit
+	f(ResponseLimits{MaxSamples: 2}, matrix, matrixResult, `the limit of 2 samples; reduce the time range, narrow down the selectors or aggregate the result, or raise "maxSamples"`)
+	f(ResponseLimits{MaxSamples: 1}, vector, vectorResult, "the limit of 1 samples")
+}
+
+func TestResponseLimits_decodeResponse(t *testing.T) {
+	f := func(limits ResponseLimits, body string, wantErr string) {
+		t.Helper()
+		r, err := limits.decodeResponse(strings.NewReader(body))
+		if wantErr == "" {
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if r.Status == "" {
+				t.Fatalf("expected the response to be decoded")
+			}
+			return
+		}
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("expected error containing %q; got %v", wantErr, err)
+		}
+	}
+
+	limits := ResponseLimits{MaxSeries: 2, MaxSamples: 3}
+	f(limits, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[[1,"1"],[2,"1"]]},{"metric":{"job":"b"},"values":[[1,"0"]]}]}}`, "")
+	f(limits, `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`, "")
+	f(limits, `{"status":"error","errorType":"bad_data","error":"cannot parse","data":null}`, "")
+	f(limits, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"1"]},{"metric":{},"value":[1,"1"]},{"metric":{},"value":[1,"1"]}]}}`, "the limit of 2 series")
+	f(limits, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1,"1"],[2,"1"],[3,"1"],[4,"1"]]}]}}`, "the limit of 3 samples")
+	f(limits, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{}`, "failed to decode body response")
+}
+
+func TestResponseLimits_decodeCounting(t *testing.T) {
+	f := func(body, wantResult string) {
+		t.Helper()
+		var r Response
+		if err := (ResponseLimits{MaxSeries: 10}).decodeCounting(strings.NewReader(body), &r); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(r.Data.Result) != wantResult {
+			t.Fatalf("expected result %s; got %s", wantResult, r.Data.Result)
+		}
+		if r.Status != "success" || r.Data.ResultType != matrix {
+			t.Fatalf("unexpected response: %+v", r)
+		}
+	}
+
+	result := `[{"metric":{"job":"a"},"values":[[1,"1"]]}]`
+	f(`{"status":"success","data":{"resultType":"matrix","result":`+result+`}}`, result)
+	f(`{"status" : "success", "data" : {"result" :`+"\n\t"+result+` , "resultType" : "matrix"}, "isPartial": true}`, result)
+	f(`{"status":"success","data":{"resultType":"matrix","result":null}}`, "null")
+	f(`{"status":"success","data":{"resultType":"matrix"}}`, "")
+}
+
+// errReader fails the read, so tests can detect reading past the limits
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("the body must not be read after the limit is exceeded")
+}
+
+func TestResponseLimits_decodeResponseStopsReading(t *testing.T) {
+	series := strings.Repeat(`{"metric":{"__name__":"up","job":"a"},"values":[[1670226733,"1"]]},`, 1000)
+	body := io.MultiReader(
+		strings.NewReader(`{"status":"success","data":{"resultType":"matrix","result":[`+series),
+		errReader{},
+	)
+	limits := ResponseLimits{MaxSeries: 10}
+	_, err := limits.decodeResponse(body)
+	var qe *queryError
+	if !errors.As(err, &qe) || qe.kind != errorKindLimitExceeded {
+		t.Fatalf("expected %q error before the body is fully read; got %v", errorKindLimitExceeded, err)
+	}
+}
+
+func TestDatasourceQueryResponseLimits(t *testing.T) {
+	body := `{"status":"success","data":{"resultType":"matrix","result":[` +
+		`{"metric":{"__name__":"up","job":"a"},"values":[[1670226733,"1"],[1670226763,"1"],[1670226793,"1"]]}]}}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	f := func(limits string, wantErr string) {
+		t.Helper()
+		ds := NewDatasource()
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+					URL:      srv.URL,
+					JSONData: []byte(`{"httpMethod":"GET","responseLimits":` + limits + `}`),
+				},
+			},
+			Queries: []backend.DataQuery{
+				{
+					RefID:     "A",
+					TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+					JSON:      []byte(`{"refId":"A","expr":"up","range":true,"interval":"30s"}`),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		response := rsp.Responses["A"]
+		if wantErr == "" {
+			if response.Error != nil {
+				t.Fatalf("unexpected error: %s", response.Error)
+			}
+			return
+		}
+		if response.Error == nil || !strings.Contains(response.Error.Error(), wantErr) {
+			t.Fatalf("expected error containing %q; got %v", wantErr, response.Error)
+		}
+		if response.Status != backend.Status(http.StatusUnprocessableEntity) {
+			t.Fatalf("unexpected status: %d", response.Status)
+		}
+	}
+
+	f(`{}`, "")
+	f(`{"maxBytes":1048576,"maxSeries":1,"maxSamples":3}`, "")
+	f(`{"maxBytes":32}`, `the limit of 32 bytes; reduce the time range, narrow down the selectors or aggregate the result, or raise "maxBytes"`)
+	f(`{"maxSamples":2}`, "the limit of 2 samples")
+}
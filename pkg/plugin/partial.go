@@ -0,0 +1,42 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// partialResponseAccept evaluates alerts on partial responses
+	partialResponseAccept = "accept"
+	// partialResponseFail fails alerting queries with errPartialResponse
+	partialResponseFail = "fail"
+	// partialResponseRetry repeats alerting queries with deny_partial_response=1
+	partialResponseRetry = "retry"
+)
+
+// errPartialResponse is returned for alerting queries if the response is partial and the policy is "fail"
+var errPartialResponse = errors.New("VictoriaMetrics returned a partial response because some vmstorage nodes are unavailable")
+
+var partialResponseNotice = data.Notice{
+	Severity: data.NoticeSeverityWarning,
+	Text:     "The response is partial because some vmstorage nodes are unavailable. The data may be incomplete.",
+}
+
+// PartialResponseSettings contains settings for partial responses of the cluster version of VictoriaMetrics
+type PartialResponseSettings struct {
+	// Alerting defines how alerting queries handle partial responses:
+	// "accept" (default), "fail" or "retry" with deny_partial_response=1
+	Alerting string `json:"alerting,omitempty"`
+}
+
+func (ps PartialResponseSettings) validate() error {
+	switch ps.Alerting {
+	case "", partialResponseAccept, partialResponseFail, partialResponseRetry:
+		return nil
+	default:
+		return fmt.Errorf("unsupported alerting policy %q; supported values are %q, %q and %q",
+			ps.Alerting, partialResponseAccept, partialResponseFail, partialResponseRetry)
+	}
+}
@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestDatasourceQueryWithPartialResponse(t *testing.T) {
+	type opts struct {
+		policy      string
+		forAlerting bool
+		wantStatus  backend.Status
+		wantNotice  bool
+		wantCalls   int
+	}
+	f := func(opts opts) {
+		t.Helper()
+		var calls int
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			isPartial := r.URL.Query().Get("deny_partial_response") != "1"
+			if isPartial {
+				_, _ = w.Write([]byte(`{"status":"success","isPartial":true,"data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1670226733,"1"]}]}}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1670226733,"1"]}]}}`))
+		}))
+		defer srv.Close()
+
+		headers := map[string]string{}
+		if opts.forAlerting {
+			headers[requestFromAlert] = "true"
+		}
+		ds := NewDatasource()
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+					URL:      srv.URL,
+					JSONData: []byte(`{"httpMethod":"GET","partialResponse":{"alerting":"` + opts.policy + `"}}`),
+				},
+			},
+			Headers: headers,
+			Queries: []backend.DataQuery{
+				{
+					RefID:     "A",
+					TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+					JSON:      []byte(`{"refId":"A","instant":true,"expr":"up"}`),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		response := rsp.Responses["A"]
+		if calls != opts.wantCalls {
+			t.Fatalf("expected %d calls; got %d", opts.wantCalls, calls)
+		}
+		if opts.wantStatus != 0 {
+			if response.Error == nil || response.Status != opts.wantStatus {
+				t.Fatalf("expected error with status %d; got %d: %v", opts.wantStatus, response.Status, response.Error)
+			}
+			return
+		}
+		if response.Error != nil {
+			t.Fatalf("unexpected error: %s", response.Error)
+		}
+		for _, frame := range response.Frames {
+			hasNotice := frame.Meta != nil && len(frame.Meta.Notices) == 1 && frame.Meta.Notices[0] == partialResponseNotice
+			if hasNotice != opts.wantNotice {
+				t.Fatalf("expected partial response notice %v; got %+v", opts.wantNotice, frame.Meta)
+			}
+		}
+	}
+
+	// dashboard query
+	f(opts{policy: partialResponseFail, wantNotice: true, wantCalls: 1})
+
+	// alerting query with default policy
+	f(opts{forAlerting: true, wantNotice: true, wantCalls: 1})
+
+	// alerting query with fail policy
+	f(opts{policy: partialResponseFail, forAlerting: true, wantStatus: backend.StatusBadGateway, wantCalls: 1})
+
+	// alerting query with retry policy
+	f(opts{policy: partialResponseRetry, forAlerting: true, wantCalls: 2})
+}
@@ -33,9 +33,22 @@ type Query struct {
 	Expr                 string `json:"expr"`
 	LegendFormat         string `json:"legendFormat"`
 	Trace                int    `json:"trace,omitempty"`
+	Tenant               string `json:"tenant,omitempty"`
 	MaxDataPoints        int64
 	TimeRange            TimeRange
 	BackendQueryInterval time.Duration
+
+	// Reducer reduces every series of the range query to a single value for alerting requests,
+	// e.g. "last", "avg", "min", "max", "count" or "percentile"
+	Reducer string `json:"reducer,omitempty"`
+	// ReducerPercentile is the percentile in range [0, 100] for the "percentile" reducer.
+	// It is a pointer to tell the missing value apart from the 0th percentile.
+	ReducerPercentile *float64 `json:"reducerPercentile,omitempty"`
+
+	// minStep is the lower bound for the calculated step enforced by the datasource
+	minStep time.Duration
+	// stepRaisedFrom is the calculated step if it was raised to minStep
+	stepRaisedFrom time.Duration
 }
 
 // TimeRange represents time range backend object
@@ -57,6 +70,11 @@ func (q *Query) getQueryURL(rawURL string, queryParams url.Values) (string, erro
 	}
 
 	step := q.calculateStep(minInterval)
+	q.stepRaisedFrom = 0
+	if step < q.minStep {
+		q.stepRaisedFrom = step
+		step = q.minStep
+	}
 	q.IntervalMs = step.Milliseconds()
 	expr := replaceTemplateVariable(q.Expr, q.BackendQueryInterval, step, originalQueryInterval, q.TimeInterval, timerange)
 
@@ -67,7 +85,7 @@ func (q *Query) getQueryURL(rawURL string, queryParams url.Values) (string, erro
 	var u *url.URL
 	var values url.Values
 
-	if q.Range || !q.Instant {
+	if q.isRangeQuery() {
 		u, err = newURL(rawURL, rangeQueryPath, false)
 		if err != nil {
 			return "", fmt.Errorf("failed to build query url: %w", err)
@@ -104,6 +122,11 @@ func (q *Query) getQueryURL(rawURL string, queryParams url.Values) (string, erro
 	return u.String(), nil
 }
 
+// isRangeQuery returns true if the query must be executed via range query API
+func (q *Query) isRangeQuery() bool {
+	return q.Range || !q.Instant
+}
+
 // withIntervalVariable checks does query has interval variable
 func (q *Query) withIntervalVariable() bool {
 	return q.Interval == varInterval || q.Interval == varIntervalMs || q.Interval == varRateInterval
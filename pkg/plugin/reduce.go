@@ -0,0 +1,120 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	reducerLast       = "last"
+	reducerAvg        = "avg"
+	reducerMin        = "min"
+	reducerMax        = "max"
+	reducerCount      = "count"
+	reducerPercentile = "percentile"
+)
+
+// seriesReducer reduces values of a series to a single value for alerting
+type seriesReducer struct {
+	fn string
+	// percentile is in range [0, 100] and is used by the "percentile" reducer
+	percentile float64
+}
+
+// newSeriesReducer returns a reducer for the given function.
+// It returns nil if fn is empty. percentile must be set for the "percentile" reducer.
+func newSeriesReducer(fn string, percentile *float64) (*seriesReducer, error) {
+	sr := &seriesReducer{fn: fn}
+	switch fn {
+	case "":
+		return nil, nil
+	case reducerLast, reducerAvg, reducerMin, reducerMax, reducerCount:
+	case reducerPercentile:
+		if percentile == nil {
+			return nil, fmt.Errorf("reducerPercentile must be set for the %q reducer", reducerPercentile)
+		}
+		if *percentile < 0 || *percentile > 100 {
+			return nil, fmt.Errorf("reducer percentile must be in range [0, 100]; got %v", *percentile)
+		}
+		sr.percentile = *percentile
+	default:
+		return nil, fmt.Errorf("unsupported reducer %q; supported values are %q, %q, %q, %q, %q and %q",
+			fn, reducerLast, reducerAvg, reducerMin, reducerMax, reducerCount, reducerPercentile)
+	}
+	return sr, nil
+}
+
+// reduce returns the reduced value of values. NaN values are ignored.
+// NaN is returned if there are no values to reduce, except for the "count" reducer.
+func (sr *seriesReducer) reduce(values []float64) float64 {
+	vs := make([]float64, 0, len(values))
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			vs = append(vs, v)
+		}
+	}
+	if sr.fn == reducerCount {
+		return float64(len(vs))
+	}
+	if len(vs) == 0 {
+		return math.NaN()
+	}
+	switch sr.fn {
+	case reducerLast:
+		return vs[len(vs)-1]
+	case reducerAvg:
+		var sum float64
+		for _, v := range vs {
+			sum += v
+		}
+		return sum / float64(len(vs))
+	case reducerMin:
+		m := vs[0]
+		for _, v := range vs[1:] {
+			m = math.Min(m, v)
+		}
+		return m
+	case reducerMax:
+		m := vs[0]
+		for _, v := range vs[1:] {
+			m = math.Max(m, v)
+		}
+		return m
+	default:
+		sort.Float64s(vs)
+		// nearest-rank percentile
+		idx := int(math.Ceil(sr.percentile/100*float64(len(vs)))) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		return vs[idx]
+	}
+}
+
+// reducedDataFrames returns a numeric-multi frame with the reduced value for every series
+func (pr promRange) reducedDataFrames(sr *seriesReducer) (data.Frames, error) {
+	frames := make(data.Frames, len(pr.Result))
+	for i, res := range pr.Result {
+		values := make([]float64, len(res.Values))
+		for j, value := range res.Values {
+			s, ok := value[1].(string)
+			if !ok {
+				return nil, fmt.Errorf("metric %v, unexpected value %v", res.Labels, value[1])
+			}
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("metric %v, unable to parse float64 from %s: %w", res.Labels, s, err)
+			}
+			values[j] = f
+		}
+
+		frames[i] = data.NewFrame("",
+			data.NewField(data.TimeSeriesValueFieldName, data.Labels(res.Labels), []float64{sr.reduce(values)}))
+		frames[i].Meta = &data.FrameMeta{Type: data.FrameTypeNumericMulti, TypeVersion: data.FrameTypeVersion{0, 1}, Custom: &CustomMeta{ResultType: matrix}}
+	}
+	return frames, nil
+}
@@ -0,0 +1,113 @@
+package plugin
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestSeriesReducer_reduce(t *testing.T) {
+	f := func(fn string, percentile float64, values []float64, want float64) {
+		t.Helper()
+		sr, err := newSeriesReducer(fn, &percentile)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got := sr.reduce(values)
+		if got != want && !(math.IsNaN(got) && math.IsNaN(want)) {
+			t.Errorf("%s(%v) = %v; want %v", fn, values, got, want)
+		}
+	}
+
+	values := []float64{3, math.NaN(), 1, 4, 1, 5}
+	f(reducerLast, 0, values, 5)
+	f(reducerAvg, 0, values, 2.8)
+	f(reducerMin, 0, values, 1)
+	f(reducerMax, 0, values, 5)
+	f(reducerCount, 0, values, 5)
+	f(reducerPercentile, 50, values, 3)
+	f(reducerPercentile, 95, values, 5)
+	f(reducerPercentile, 0, values, 1)
+
+	// no values
+	f(reducerLast, 0, []float64{math.NaN()}, math.NaN())
+	f(reducerCount, 0, nil, 0)
+}
+
+func TestNewSeriesReducer(t *testing.T) {
+	f := func(fn string, percentile *float64, wantErr bool) {
+		t.Helper()
+		_, err := newSeriesReducer(fn, percentile)
+		if (err != nil) != wantErr {
+			t.Fatalf("newSeriesReducer() error = %v, wantErr %v", err, wantErr)
+		}
+	}
+
+	percentile := func(v float64) *float64 { return &v }
+
+	f("", nil, false)
+	f(reducerAvg, nil, false)
+	f(reducerPercentile, percentile(99.9), false)
+	f(reducerPercentile, percentile(0), false)
+	f(reducerPercentile, percentile(101), true)
+
+	// missing percentile must not act as the 0th percentile
+	f(reducerPercentile, nil, true)
+	f("median", nil, true)
+}
+
+func TestDatasourceQueryWithReducer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != rangeQueryPath {
+			t.Errorf("expected range query; got %s", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[` +
+			`{"metric":{"job":"a"},"values":[[1670226733,"1"],[1670226748,"3"]]},` +
+			`{"metric":{"job":"b"},"values":[[1670226733,"10"],[1670226748,"NaN"]]}]}}`))
+	}))
+	defer srv.Close()
+
+	ds := NewDatasource()
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+				URL:      srv.URL,
+				JSONData: []byte(`{"httpMethod":"GET"}`),
+			},
+		},
+		Headers: map[string]string{requestFromAlert: "true"},
+		Queries: []backend.DataQuery{
+			{
+				RefID:     "A",
+				TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+				JSON:      []byte(`{"refId":"A","instant":true,"expr":"up","reducer":"avg"}`),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	response := rsp.Responses["A"]
+	if response.Error != nil {
+		t.Fatalf("unexpected error: %s", response.Error)
+	}
+	if len(response.Frames) != 2 {
+		t.Fatalf("expected 2 frames; got %d", len(response.Frames))
+	}
+	want := map[string]float64{"a": 2, "b": 10}
+	for _, frame := range response.Frames {
+		if frame.Meta.Type != data.FrameTypeNumericMulti {
+			t.Errorf("expected numeric multi frame; got %q", frame.Meta.Type)
+		}
+		field := frame.Fields[0]
+		if got := field.At(0).(float64); got != want[field.Labels["job"]] {
+			t.Errorf("unexpected value for job %q: %v", field.Labels["job"], got)
+		}
+	}
+}
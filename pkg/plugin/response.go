@@ -17,6 +17,8 @@ type CustomMeta struct {
 	Trace Trace `json:"trace,omitempty"`
 	// ResultType represents the type of the query response: "vector" | "matrix" | "scalar" | "trace"
 	ResultType string `json:"resultType"`
+	// StorageTiers contains names of storage tiers which answered the query
+	StorageTiers []string `json:"storageTiers,omitempty"`
 }
 
 // Result represents timeseries from query
@@ -42,12 +44,18 @@ type Data struct {
 
 // Response contains fields from query response
 type Response struct {
-	Status      string `json:"status"`
-	ErrorType   string `json:"errorType,omitempty"`
-	Error       string `json:"error,omitempty"`
-	Data        Data   `json:"data"`
-	Trace       *Trace `json:"trace,omitempty"`
-	ForAlerting bool   `json:"-"`
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Data      Data   `json:"data"`
+	Trace     *Trace `json:"trace,omitempty"`
+	IsPartial bool   `json:"isPartial,omitempty"`
+	// Warnings and Infos contain annotations of the result, e.g. about truncated results
+	Warnings    []string `json:"warnings,omitempty"`
+	Infos       []string `json:"infos,omitempty"`
+	ForAlerting bool     `json:"-"`
+	// Reducer is set if series of the range query must be reduced for alerting
+	Reducer *seriesReducer `json:"-"`
 }
 
 // Trace represents data for query tracing
@@ -212,7 +220,11 @@ func (r *Response) getDataFrames() (fss data.Frames, err error) {
 			return nil, fmt.Errorf("unmarshal err %w; \n %#v", err, string(r.Data.Result))
 		}
 		if r.ForAlerting {
-			return pi.alertingDataFrames()
+			frames, err := pi.alertingDataFrames()
+			if err != nil {
+				return nil, err
+			}
+			return addNoticesToFrames(frames, r.notices()...), nil
 		}
 		df = pi
 	case matrix:
@@ -220,6 +232,13 @@ func (r *Response) getDataFrames() (fss data.Frames, err error) {
 		if err = json.Unmarshal(r.Data.Result, &pr.Result); err != nil {
 			return nil, fmt.Errorf("unmarshal err %w; \n %#v", err, string(r.Data.Result))
 		}
+		if r.ForAlerting && r.Reducer != nil {
+			frames, err := pr.reducedDataFrames(r.Reducer)
+			if err != nil {
+				return nil, err
+			}
+			return addNoticesToFrames(frames, r.notices()...), nil
+		}
 		df = pr
 	case scalar:
 		var ps promScalar
@@ -233,6 +252,37 @@ func (r *Response) getDataFrames() (fss data.Frames, err error) {
 	if frames, err := df.dataframes(); err != nil {
 		return nil, err
 	} else {
-		return append(fss, frames...), nil
+		return addNoticesToFrames(append(fss, frames...), r.notices()...), nil
+	}
+}
+
+// notices returns warnings and infos of the response as frame notices
+func (r *Response) notices() []data.Notice {
+	var notices []data.Notice
+	for _, w := range r.Warnings {
+		notices = append(notices, data.Notice{Severity: data.NoticeSeverityWarning, Text: w})
+	}
+	for _, info := range r.Infos {
+		notices = append(notices, data.Notice{Severity: data.NoticeSeverityInfo, Text: info})
+	}
+	return notices
+}
+
+// addNoticesToFrames attaches notices to every frame of the response, so they stay visible
+// even if some frames are filtered out by transformations. Grafana deduplicates notices by text.
+// An empty frame is created if the response has no frames.
+func addNoticesToFrames(frames data.Frames, notices ...data.Notice) data.Frames {
+	if len(notices) == 0 {
+		return frames
+	}
+	if len(frames) == 0 {
+		frames = append(frames, data.NewFrame(""))
+	}
+	for _, frame := range frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		frame.Meta.Notices = append(frame.Meta.Notices, notices...)
 	}
+	return frames
 }
@@ -17,6 +17,8 @@ func TestResponse_getDataFrames(t *testing.T) {
 		want        func() data.Frames
 		wantErr     bool
 		trace       *Trace
+		warnings    []string
+		infos       []string
 	}
 	f := func(opts opts) {
 		t.Helper()
@@ -25,6 +27,8 @@ func TestResponse_getDataFrames(t *testing.T) {
 			Data:        opts.data,
 			ForAlerting: opts.forAlerting,
 			Trace:       opts.trace,
+			Warnings:    opts.warnings,
+			Infos:       opts.infos,
 		}
 		got, err := r.getDataFrames()
 		if (err != nil) != opts.wantErr {
@@ -215,4 +219,50 @@ func TestResponse_getDataFrames(t *testing.T) {
 		},
 	}
 	f(o)
+
+	// matrix response with warnings and infos
+	o = opts{
+		status: "success",
+		data: Data{
+			ResultType: "matrix",
+			Result:     []byte(`[{"metric":{"__name__":"vm_rows"},"values":[[1670324477.542,"1"]]}]`),
+		},
+		warnings: []string{"the response contains only 1 series because of -search.maxSeries limit"},
+		infos:    []string{"query was executed in partial mode"},
+		query:    Query{},
+		want: func() data.Frames {
+			return []*data.Frame{
+				data.NewFrame("",
+					data.NewField(data.TimeSeriesTimeFieldName, nil, []time.Time{time.Unix(1670324477, 542*1e6)}),
+					data.NewField(data.TimeSeriesValueFieldName, data.Labels{"__name__": "vm_rows"}, []float64{1}),
+				).SetMeta(&data.FrameMeta{
+					Custom: &CustomMeta{ResultType: matrix},
+					Notices: []data.Notice{
+						{Severity: data.NoticeSeverityWarning, Text: "the response contains only 1 series because of -search.maxSeries limit"},
+						{Severity: data.NoticeSeverityInfo, Text: "query was executed in partial mode"},
+					},
+				}),
+			}
+		},
+	}
+	f(o)
+
+	// empty vector response with warnings
+	o = opts{
+		status: "success",
+		data: Data{
+			ResultType: "vector",
+			Result:     []byte(`[]`),
+		},
+		warnings: []string{"some warning"},
+		query:    Query{},
+		want: func() data.Frames {
+			return []*data.Frame{
+				data.NewFrame("").SetMeta(&data.FrameMeta{
+					Notices: []data.Notice{{Severity: data.NoticeSeverityWarning, Text: "some warning"}},
+				}),
+			}
+		},
+	}
+	f(o)
 }
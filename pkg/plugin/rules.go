@@ -0,0 +1,312 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.yaml.in/yaml/v2"
+)
+
+const (
+	// defaultRuleGroupInterval is the default evaluation interval of vmalert groups
+	defaultRuleGroupInterval = time.Minute
+	// maxDryRunEvaluations limits the number of evaluations per rule in a dry-run
+	maxDryRunEvaluations = 11000
+
+	ruleTypeAlerting  = "alerting"
+	ruleTypeRecording = "recording"
+)
+
+// ruleGroups is a file with vmalert rule groups
+type ruleGroups struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+// ruleGroup is a vmalert rule group. Only fields affecting evaluation results are supported.
+type ruleGroup struct {
+	Name     string `yaml:"name"`
+	Interval string `yaml:"interval,omitempty"`
+	Rules    []rule `yaml:"rules"`
+}
+
+// rule is a vmalert alerting or recording rule
+type rule struct {
+	Alert  string            `yaml:"alert,omitempty"`
+	Record string            `yaml:"record,omitempty"`
+	Expr   string            `yaml:"expr"`
+	For    string            `yaml:"for,omitempty"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// dryRunRequest is the request of the rules dry-run resource
+type dryRunRequest struct {
+	// Groups contains rule groups in vmalert YAML format
+	Groups string `json:"groups"`
+	// Start and End are unix timestamps in seconds of the evaluation window
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// Tenant is the tenant key for the "variable" tenant mode
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// dryRunResult contains evaluation results of a single rule
+type dryRunResult struct {
+	Group  string      `json:"group"`
+	Name   string      `json:"name"`
+	Type   string      `json:"type"`
+	Error  string      `json:"error,omitempty"`
+	Frames data.Frames `json:"frames,omitempty"`
+}
+
+// alertActivation describes a period when the alerting rule was active for a series
+type alertActivation struct {
+	labels     data.Labels
+	activeAt   time.Time
+	firingAt   *time.Time
+	resolvedAt *time.Time
+}
+
+// RulesDryRun evaluates vmalert rule groups over the requested window and returns per-rule frames.
+// Alerting rules return the periods when series were pending and firing according to "for",
+// recording rules return the resulting series with rule labels applied.
+// Label templates are not expanded.
+func (d *Datasource) RulesDryRun(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	pluginCxt := backend.PluginConfigFromContext(ctx)
+	di, err := d.getInstance(ctx, pluginCxt)
+	if err != nil {
+		d.logger.Error("Error loading datasource", "error", err)
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("unsupported method %q; expecting POST", req.Method))
+		return
+	}
+	var drReq dryRunRequest
+	if err := json.NewDecoder(req.Body).Decode(&drReq); err != nil {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("failed to decode request body: %w", err))
+		return
+	}
+	var rg ruleGroups
+	if err := yaml.Unmarshal([]byte(drReq.Groups), &rg); err != nil {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("failed to parse rule groups: %w", err))
+		return
+	}
+	if drReq.End <= drReq.Start {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("end must be greater than start"))
+		return
+	}
+
+	rc := newResourceRequestContext(req)
+	baseURL, err := di.getBaseURL(rc, drReq.Tenant)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("failed to resolve tenant: %w", err))
+		return
+	}
+	tr := TimeRange{From: time.Unix(drReq.Start, 0), To: time.Unix(drReq.End, 0)}
+	var results []dryRunResult
+	for _, g := range rg.Groups {
+		for _, r := range g.Rules {
+			results = append(results, di.dryRunRule(ctx, rc, baseURL, g, r, tr))
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(results); err != nil {
+		d.logger.Error("Error writing response", "error", err)
+	}
+}
+
+// dryRunRule evaluates the rule as a range query over tr with the group interval as step
+func (di *DatasourceInstance) dryRunRule(ctx context.Context, rc requestContext, baseURL string, g ruleGroup, r rule, tr TimeRange) dryRunResult {
+	result := dryRunResult{Group: g.Name, Name: r.Record, Type: ruleTypeRecording}
+	if r.Alert != "" {
+		result.Name, result.Type = r.Alert, ruleTypeAlerting
+	}
+	frames, err := di.evaluateRule(ctx, rc, baseURL, g, r, tr)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Frames = frames
+	return result
+}
+
+func (di *DatasourceInstance) evaluateRule(ctx context.Context, rc requestContext, baseURL string, g ruleGroup, r rule, tr TimeRange) (data.Frames, error) {
+	if (r.Alert == "") == (r.Record == "") {
+		return nil, fmt.Errorf("either alert or record must be set")
+	}
+	interval := defaultRuleGroupInterval
+	if g.Interval != "" {
+		d, err := gtime.ParseDuration(g.Interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid group interval %q", g.Interval)
+		}
+		interval = d
+	}
+	var forDuration time.Duration
+	if r.For != "" {
+		d, err := gtime.ParseDuration(r.For)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid for duration %q", r.For)
+		}
+		forDuration = d
+	}
+	if n := tr.To.Sub(tr.From) / interval; n > maxDryRunEvaluations {
+		return nil, fmt.Errorf("the window requires %d evaluations, which exceeds the limit of %d; reduce the window", n, maxDryRunEvaluations)
+	}
+
+	// rules are evaluated at the group interval, so the step can't be raised like the step of queries
+	q := Query{Expr: r.Expr, Range: true, TimeRange: tr, IntervalMs: interval.Milliseconds()}
+	if p := downsamplingMinStep(di.downsampling, &q, time.Now()); p.interval > interval {
+		return nil, fmt.Errorf("samples older than %s are downsampled to %s intervals, which is coarser than the group interval %s; reduce the window",
+			gtime.FormatInterval(p.offset), p.interval, interval)
+	}
+	params, err := di.restrictParams(rc, di.queryParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restrict access: %w", err)
+	}
+	if di.settings.QueryCostLimits.enabled() {
+		step, _, err := di.checkQueryCost(ctx, baseURL, params, &q)
+		if err != nil {
+			return nil, err
+		}
+		if step > 0 {
+			return nil, newCostLimitError(fmt.Errorf("evaluations at the group interval %s exceed query cost limits; reduce the window", interval))
+		}
+	}
+	u, err := newURL(baseURL, rangeQueryPath, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build query url: %w", err)
+	}
+	params.Set("query", r.Expr)
+	params.Set("start", strconv.FormatInt(tr.From.Unix(), 10))
+	params.Set("end", strconv.FormatInt(tr.To.Unix(), 10))
+	params.Set("step", interval.String())
+	u.RawQuery = params.Encode()
+
+	var resp *Response
+	if len(di.tiers) == 0 {
+		resp, err = di.fetchResponse(ctx, u.String(), true)
+	} else {
+		resp, _, err = di.fetchFromTiers(ctx, baseURL, u.String(), &q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Data.ResultType != matrix {
+		return nil, fmt.Errorf("unexpected result type %q; expecting %q", resp.Data.ResultType, matrix)
+	}
+	var pr promRange
+	if err := json.Unmarshal(resp.Data.Result, &pr.Result); err != nil {
+		return nil, fmt.Errorf("failed to decode result: %w", err)
+	}
+
+	if r.Record != "" {
+		for i := range pr.Result {
+			pr.Result[i].Labels = ruleLabels(pr.Result[i].Labels, r.Labels, "__name__", r.Record)
+		}
+		frames, err := pr.dataframes()
+		if err != nil {
+			return nil, err
+		}
+		for _, frame := range frames {
+			frame.Name = r.Record
+		}
+		return frames, nil
+	}
+
+	var activations []alertActivation
+	for _, res := range pr.Result {
+		labels := ruleLabels(res.Labels, r.Labels, "alertname", r.Alert)
+		activations = append(activations, alertActivations(res.Values, labels, interval, forDuration)...)
+	}
+	return data.Frames{alertActivationsFrame(r.Alert, activations)}, nil
+}
+
+// ruleLabels returns series labels with rule labels and the name label applied
+func ruleLabels(series Labels, ruleLabels map[string]string, nameLabel, name string) Labels {
+	labels := make(Labels, len(series)+len(ruleLabels)+1)
+	for k, v := range series {
+		labels[k] = v
+	}
+	if nameLabel == "alertname" {
+		// vmalert drops the metric name from alert labels
+		delete(labels, "__name__")
+	}
+	for k, v := range ruleLabels {
+		labels[k] = v
+	}
+	labels[nameLabel] = name
+	return labels
+}
+
+// alertActivations returns periods when the alerting rule was active for the series.
+// The rule is active at every evaluation returning a value for the series and
+// becomes firing after being active for the "for" duration, like in vmalert.
+func alertActivations(values []Value, labels Labels, interval, forDuration time.Duration) []alertActivation {
+	var activations []alertActivation
+	var cur *alertActivation
+	var prev time.Time
+	for _, v := range values {
+		f, ok := v[0].(float64)
+		if !ok {
+			continue
+		}
+		ts, err := parseFloatToTime(f)
+		if err != nil {
+			continue
+		}
+		if cur != nil && ts.Sub(prev) > interval {
+			// the series was missing at the previous evaluation
+			resolvedAt := prev.Add(interval)
+			cur.resolvedAt = &resolvedAt
+			activations = append(activations, *cur)
+			cur = nil
+		}
+		if cur == nil {
+			cur = &alertActivation{labels: data.Labels(labels), activeAt: ts}
+		}
+		if cur.firingAt == nil && ts.Sub(cur.activeAt) >= forDuration {
+			firingAt := ts
+			cur.firingAt = &firingAt
+		}
+		prev = ts
+	}
+	if cur != nil {
+		activations = append(activations, *cur)
+	}
+	return activations
+}
+
+// alertActivationsFrame returns a table frame with a row per activation
+func alertActivationsFrame(name string, activations []alertActivation) *data.Frame {
+	sort.SliceStable(activations, func(i, j int) bool {
+		return activations[i].activeAt.Before(activations[j].activeAt)
+	})
+	labels := make([]string, len(activations))
+	activeAt := make([]time.Time, len(activations))
+	firingAt := make([]*time.Time, len(activations))
+	resolvedAt := make([]*time.Time, len(activations))
+	for i, a := range activations {
+		labels[i] = labelsToString(a.labels)
+		activeAt[i] = a.activeAt
+		firingAt[i] = a.firingAt
+		resolvedAt[i] = a.resolvedAt
+	}
+	return data.NewFrame(name,
+		data.NewField("labels", nil, labels),
+		data.NewField("activeAt", nil, activeAt),
+		data.NewField("firingAt", nil, firingAt),
+		data.NewField("resolvedAt", nil, resolvedAt),
+	)
+}
@@ -0,0 +1,220 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func Test_alertActivations(t *testing.T) {
+	type activation struct {
+		activeAt, firingAt, resolvedAt int64
+	}
+	f := func(timestamps []int64, forDuration time.Duration, want []activation) {
+		t.Helper()
+		values := make([]Value, len(timestamps))
+		for i, ts := range timestamps {
+			values[i] = Value{float64(ts), "1"}
+		}
+		got := alertActivations(values, Labels{"job": "a"}, time.Minute, forDuration)
+		if len(got) != len(want) {
+			t.Fatalf("expected %d activations; got %d", len(want), len(got))
+		}
+		unix := func(ts *time.Time) int64 {
+			if ts == nil {
+				return 0
+			}
+			return ts.Unix()
+		}
+		for i, a := range got {
+			g := activation{activeAt: a.activeAt.Unix(), firingAt: unix(a.firingAt), resolvedAt: unix(a.resolvedAt)}
+			if g != want[i] {
+				t.Errorf("activation %d: expected %+v; got %+v", i, want[i], g)
+			}
+		}
+	}
+
+	// no values
+	f(nil, 0, nil)
+
+	// fires immediately without for
+	f([]int64{60, 120}, 0, []activation{{activeAt: 60, firingAt: 60}})
+
+	// pending shorter than for
+	f([]int64{60, 120, 240, 300, 360}, 2*time.Minute, []activation{
+		{activeAt: 60, resolvedAt: 180},
+		{activeAt: 240, firingAt: 360},
+	})
+
+	// fires and resolves
+	f([]int64{60, 120, 180, 240, 600}, time.Minute, []activation{
+		{activeAt: 60, firingAt: 120, resolvedAt: 300},
+		{activeAt: 600},
+	})
+}
+
+func TestDatasource_RulesDryRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		if r.URL.Path != rangeQueryPath {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if step := params.Get("step"); step != "30s" {
+			t.Errorf("expected step 30s; got %s", step)
+		}
+		switch params.Get("query") {
+		case "up == 0":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"__name__":"up","job":"a"},"values":[[1670226030,"0"],[1670226060,"0"],[1670226090,"0"]]}]}}`))
+		case "sum(up) by (job)":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"job":"a"},"values":[[1670226030,"1"]]}]}}`))
+		default:
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"422","error":"cannot parse query"}`))
+		}
+	}))
+	defer srv.Close()
+
+	groups := `
+groups:
+  - name: test
+    interval: 30s
+    rules:
+      - alert: ServiceDown
+        expr: up == 0
+        for: 1m
+        labels:
+          severity: critical
+        annotations:
+          summary: "{{ $labels.job }} is down"
+      - record: job:up:sum
+        expr: sum(up) by (job)
+      - alert: Broken
+        expr: sum(
+`
+	body, err := json.Marshal(dryRunRequest{Groups: groups, Start: 1670226000, End: 1670226600})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ds := NewDatasource()
+	pluginCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL:      srv.URL,
+			JSONData: []byte(`{"httpMethod":"GET"}`),
+		},
+	}
+	ctx := backend.WithPluginContext(context.Background(), pluginCtx)
+	req := httptest.NewRequest(http.MethodPost, "/rules/dry-run", strings.NewReader(string(body))).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	ds.RulesDryRun(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d; body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var results []struct {
+		Group  string            `json:"group"`
+		Name   string            `json:"name"`
+		Type   string            `json:"type"`
+		Error  string            `json:"error"`
+		Frames []json.RawMessage `json:"frames"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results; got %d", len(results))
+	}
+
+	alert := results[0]
+	if alert.Type != ruleTypeAlerting || alert.Error != "" || len(alert.Frames) != 1 {
+		t.Fatalf("unexpected alerting rule result: %+v", alert)
+	}
+	frame := string(alert.Frames[0])
+	for _, want := range []string{`alertname=\"ServiceDown\"`, `severity=\"critical\"`, `1670226090000`} {
+		if !strings.Contains(frame, want) {
+			t.Errorf("expected alerting rule frame to contain %q; got %s", want, frame)
+		}
+	}
+
+	record := results[1]
+	if record.Type != ruleTypeRecording || record.Error != "" || len(record.Frames) != 1 {
+		t.Fatalf("unexpected recording rule result: %+v", record)
+	}
+	if frame := string(record.Frames[0]); !strings.Contains(frame, `"__name__":"job:up:sum"`) {
+		t.Errorf("expected recording rule frame to contain the record name; got %s", frame)
+	}
+
+	if broken := results[2]; !strings.Contains(broken.Error, "cannot parse query") {
+		t.Fatalf("expected error for the broken rule; got %+v", broken)
+	}
+}
+
+func TestDatasource_RulesDryRunWithStorageTiers(t *testing.T) {
+	var hotCalls, coldCalls atomic.Int32
+	newTier := func(calls *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			if step := r.URL.Query().Get("step"); step != "24h0m0s" {
+				t.Errorf("expected step of the group interval; got %s", step)
+			}
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		}))
+	}
+	hot, cold := newTier(&hotCalls), newTier(&coldCalls)
+	defer hot.Close()
+	defer cold.Close()
+
+	f := func(jsonData string, from, to time.Duration, wantErr string, wantHot, wantCold int32) {
+		t.Helper()
+		ds := NewDatasource()
+		hotCalls.Store(0)
+		coldCalls.Store(0)
+		now := time.Now()
+		groups := "groups:\n  - name: test\n    interval: 1d\n    rules:\n      - alert: Down\n        expr: up == 0\n        for: 1w\n"
+		body, err := json.Marshal(dryRunRequest{Groups: groups, Start: now.Add(-from).Unix(), End: now.Add(-to).Unix()})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		pluginCtx := backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+				URL:      hot.URL,
+				JSONData: []byte(jsonData),
+			},
+		}
+		ctx := backend.WithPluginContext(context.Background(), pluginCtx)
+		req := httptest.NewRequest(http.MethodPost, "/rules/dry-run", strings.NewReader(string(body))).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		ds.RulesDryRun(rr, req)
+		var results []dryRunResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 1 {
+			t.Fatalf("unexpected response %q: %v", rr.Body.String(), err)
+		}
+		if gotErr := results[0].Error; (wantErr == "" && gotErr != "") || !strings.Contains(gotErr, wantErr) {
+			t.Fatalf("expected error %q; got %q", wantErr, gotErr)
+		}
+		if hotCalls.Load() != wantHot || coldCalls.Load() != wantCold {
+			t.Fatalf("expected %d and %d requests to hot and cold tiers; got %d and %d", wantHot, wantCold, hotCalls.Load(), coldCalls.Load())
+		}
+	}
+
+	tiers := fmt.Sprintf(`{"httpMethod":"GET","storageTiers":[{"name":"hot","retention":"2d"},{"name":"cold","url":%q,"retention":"365d"}]}`, cold.URL)
+
+	// windows older than the retention of the hot tier are evaluated on the cold tier
+	f(tiers, 30*day, 20*day, "", 0, 1)
+
+	// windows spanning tiers are stitched
+	f(tiers, 30*day, 0, "", 1, 1)
+
+	// downsampled data can't be evaluated at the group interval
+	f(`{"httpMethod":"GET","downsamplingPeriods":"10d:1w"}`, 30*day, 0, "downsampled to 168h0m0s intervals", 0, 0)
+}
@@ -0,0 +1,146 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+const (
+	sigV4AuthKeys        = "keys"
+	sigV4AuthDefault     = "default"
+	sigV4AuthCredentials = "credentials"
+	sigV4AuthEC2IAMRole  = "ec2_iam_role"
+
+	// sigV4MiddlewareName is the name of the http client middleware signing requests
+	sigV4MiddlewareName = "SigV4"
+	// defaultSigV4Service is the service name of AWS API Gateway
+	defaultSigV4Service = "execute-api"
+	// sigV4RoleSessionName identifies sessions of the assumed role
+	sigV4RoleSessionName = "victoriametrics-datasource"
+)
+
+// sigV4Signer signs requests with credentials resolved by the AWS SDK
+type sigV4Signer struct {
+	region  string
+	service string
+	creds   aws.CredentialsProvider
+	signer  *v4.Signer
+	now     func() time.Time
+}
+
+// newSigV4Signer returns the signer for SigV4 options parsed by the SDK from datasource settings.
+// The service defaults to AWS API Gateway.
+// Credentials are resolved by the AWS SDK, which also picks STS and IMDS endpoints
+// for the partition of the region unless they are overridden via AWS_ENDPOINT_URL_STS
+// and AWS_EC2_METADATA_SERVICE_ENDPOINT environment variables.
+func newSigV4Signer(ctx context.Context, cfg httpclient.SigV4Config, service string) (*sigV4Signer, error) {
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("region is required")
+	}
+	opts := []func(*config.LoadOptions) error{config.WithRegion(cfg.Region)}
+	switch cfg.AuthType {
+	case sigV4AuthKeys:
+		if cfg.AccessKey == "" || cfg.SecretKey == "" {
+			return nil, fmt.Errorf("access key and secret key are required for %q auth type", cfg.AuthType)
+		}
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, cfg.SessionToken)))
+	case sigV4AuthCredentials:
+		profile := cfg.Profile
+		if profile == "" {
+			profile = envOr("AWS_PROFILE", config.DefaultSharedConfigProfile)
+		}
+		// the explicit profile makes the SDK read credentials from the shared files only
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	case "", sigV4AuthDefault, sigV4AuthEC2IAMRole:
+		if cfg.Profile != "" {
+			opts = append(opts, config.WithSharedConfigProfile(cfg.Profile))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported sigv4 auth type %q; supported values are %q, %q, %q and %q",
+			cfg.AuthType, sigV4AuthKeys, sigV4AuthDefault, sigV4AuthCredentials, sigV4AuthEC2IAMRole)
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aws config: %w", err)
+	}
+	if cfg.AuthType == sigV4AuthEC2IAMRole {
+		awsCfg.Credentials = aws.NewCredentialsCache(ec2rolecreds.New(func(o *ec2rolecreds.Options) {
+			o.Client = imds.NewFromConfig(awsCfg)
+		}))
+	}
+	if cfg.AssumeRoleARN != "" {
+		awsCfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), cfg.AssumeRoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = sigV4RoleSessionName
+			if cfg.ExternalID != "" {
+				o.ExternalID = aws.String(cfg.ExternalID)
+			}
+		}))
+	}
+	if service == "" {
+		service = defaultSigV4Service
+	}
+	return &sigV4Signer{
+		region:  cfg.Region,
+		service: service,
+		creds:   awsCfg.Credentials,
+		signer:  v4.NewSigner(),
+		now:     time.Now,
+	}, nil
+}
+
+// sign adds AWS Signature Version 4 headers to the request
+func (s *sigV4Signer) sign(req *http.Request) error {
+	creds, err := s.creds.Retrieve(req.Context())
+	if err != nil {
+		return fmt.Errorf("failed to get aws credentials: %w", err)
+	}
+	payload := []byte{}
+	if req.Body != nil && req.Body != http.NoBody {
+		body := req.Body
+		if req.GetBody != nil {
+			if body, err = req.GetBody(); err != nil {
+				return fmt.Errorf("failed to read request body: %w", err)
+			}
+		}
+		b, err := io.ReadAll(body)
+		_ = body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read request body: %w", err)
+		}
+		payload = b
+		req.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	payloadHash := sha256.Sum256(payload)
+	if err := s.signer.SignHTTP(req.Context(), creds, req, hex.EncodeToString(payloadHash[:]), s.service, s.region, s.now()); err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+	return nil
+}
+
+// sigV4Middleware signs every request with AWS Signature Version 4
+func sigV4Middleware(s *sigV4Signer) httpclient.Middleware {
+	return httpclient.NamedMiddlewareFunc(sigV4MiddlewareName, func(_ httpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if err := s.sign(req); err != nil {
+				return nil, err
+			}
+			return next.RoundTrip(req)
+		})
+	})
+}
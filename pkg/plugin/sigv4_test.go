@@ -0,0 +1,208 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+func TestSigV4Signer_sign(t *testing.T) {
+	// test vectors from the AWS Signature Version 4 test suite and documentation
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	f := func(method, reqURL string, headers map[string]string, region, service, wantAuthorization string) {
+		t.Helper()
+		s, err := newSigV4Signer(context.Background(), httpclient.SigV4Config{
+			AuthType:  sigV4AuthKeys,
+			Region:    region,
+			AccessKey: "AKIDEXAMPLE",
+			SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		}, service)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		s.now = func() time.Time { return now }
+		req, err := http.NewRequest(method, reqURL, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		if err := s.sign(req); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+			t.Errorf("unexpected X-Amz-Date: %q", got)
+		}
+		if got := req.Header.Get("Authorization"); got != wantAuthorization {
+			t.Errorf("unexpected Authorization:\nexpected %q\ngot      %q", wantAuthorization, got)
+		}
+	}
+
+	// get-vanilla
+	f(http.MethodGet, "https://example.amazonaws.com/", nil, "us-east-1", "service",
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, "+
+			"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31")
+
+	// get-vanilla-query-order-key-case
+	f(http.MethodGet, "https://example.amazonaws.com/?Param2=value2&Param1=value1", nil, "us-east-1", "service",
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, "+
+			"Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500")
+
+	// IAM ListUsers example of the signing documentation
+	f(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08",
+		map[string]string{"Content-Type": "application/x-www-form-urlencoded; charset=utf-8"}, "us-east-1", "iam",
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, "+
+			"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7")
+}
+
+func TestNewSigV4Signer(t *testing.T) {
+	f := func(cfg httpclient.SigV4Config, wantErr bool) {
+		t.Helper()
+		_, err := newSigV4Signer(context.Background(), cfg, "")
+		if (err != nil) != wantErr {
+			t.Fatalf("expected error %v; got %v", wantErr, err)
+		}
+	}
+	f(httpclient.SigV4Config{AuthType: sigV4AuthKeys, Region: "us-east-1", AccessKey: "a", SecretKey: "s"}, false)
+	f(httpclient.SigV4Config{AuthType: sigV4AuthDefault, Region: "us-east-1"}, false)
+	f(httpclient.SigV4Config{AuthType: sigV4AuthKeys, Region: "us-east-1"}, true)
+	f(httpclient.SigV4Config{AuthType: sigV4AuthDefault}, true)
+	f(httpclient.SigV4Config{AuthType: "sso", Region: "us-east-1"}, true)
+}
+
+func TestSigV4Signer_credentials(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/api/token":
+			w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "300")
+			_, _ = w.Write([]byte("imds-token"))
+		case "/latest/meta-data/iam/security-credentials/":
+			_, _ = w.Write([]byte("grafana-role"))
+		case "/latest/meta-data/iam/security-credentials/grafana-role":
+			if r.Header.Get("X-aws-ec2-metadata-token") != "imds-token" {
+				t.Errorf("expected IMDSv2 token")
+			}
+			_, _ = w.Write([]byte(`{"Code":"Success","AccessKeyId":"EC2KEY","SecretAccessKey":"ec2-secret","Token":"ec2-token","Expiration":"` + expiration + `"}`))
+		case "/":
+			if got := r.FormValue("RoleArn"); got != "arn:aws:iam::123456789012:role/vm" {
+				t.Errorf("unexpected role: %q", got)
+			}
+			if !strings.Contains(r.Header.Get("Authorization"), "/sts/aws4_request") {
+				t.Errorf("expected signed sts request; got %q", r.Header.Get("Authorization"))
+			}
+			_, _ = w.Write([]byte(`<AssumeRoleResponse><AssumeRoleResult><Credentials>` +
+				`<AccessKeyId>ROLEKEY</AccessKeyId><SecretAccessKey>role-secret</SecretAccessKey>` +
+				`<SessionToken>role-token</SessionToken><Expiration>` + expiration + `</Expiration>` +
+				`</Credentials></AssumeRoleResult></AssumeRoleResponse>`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	credentialsFile := filepath.Join(t.TempDir(), "credentials")
+	content := "[default]\naws_access_key_id = FILEKEY\naws_secret_access_key = file-secret\n\n[prod]\naws_access_key_id = PRODKEY\naws_secret_access_key = prod-secret\n"
+	if err := os.WriteFile(credentialsFile, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write credentials file: %s", err)
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	// the SDK resolves STS and IMDS endpoints for the region unless they are overridden
+	t.Setenv("AWS_ENDPOINT_URL_STS", srv.URL)
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", srv.URL)
+
+	f := func(cfg httpclient.SigV4Config, wantKey, wantToken string) {
+		t.Helper()
+		cfg.Region = "us-east-1"
+		s, err := newSigV4Signer(context.Background(), cfg, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		creds, err := s.creds.Retrieve(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if creds.AccessKeyID != wantKey || creds.SessionToken != wantToken {
+			t.Fatalf("expected key %q and token %q; got %q and %q", wantKey, wantToken, creds.AccessKeyID, creds.SessionToken)
+		}
+	}
+
+	f(httpclient.SigV4Config{AuthType: sigV4AuthKeys, AccessKey: "KEY", SecretKey: "secret"}, "KEY", "")
+	f(httpclient.SigV4Config{AuthType: sigV4AuthCredentials, Profile: "prod"}, "PRODKEY", "")
+	f(httpclient.SigV4Config{AuthType: sigV4AuthEC2IAMRole}, "EC2KEY", "ec2-token")
+	f(httpclient.SigV4Config{AuthType: sigV4AuthKeys, AccessKey: "KEY", SecretKey: "secret", AssumeRoleARN: "arn:aws:iam::123456789012:role/vm"}, "ROLEKEY", "role-token")
+
+	// the default chain prefers the environment over the shared credentials file
+	f(httpclient.SigV4Config{AuthType: sigV4AuthDefault}, "FILEKEY", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "ENVKEY")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	f(httpclient.SigV4Config{AuthType: sigV4AuthDefault}, "ENVKEY", "")
+}
+
+func TestDatasourceSigV4(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=KEY/") || !strings.Contains(auth, "/eu-west-1/execute-api/aws4_request") {
+			t.Errorf("unexpected Authorization header for %s: %q", r.URL.Path, auth)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case instantQueryPath:
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		default:
+			_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+		}
+	}))
+	defer srv.Close()
+
+	pluginCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL:                     srv.URL,
+			JSONData:                []byte(`{"httpMethod":"POST","sigV4Auth":true,"sigV4AuthType":"keys","sigV4Region":"eu-west-1"}`),
+			DecryptedSecureJSONData: map[string]string{"sigV4AccessKey": "KEY", "sigV4SecretKey": "secret"},
+		},
+	}
+	ds := NewDatasource()
+
+	// data queries
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: pluginCtx,
+		Queries: []backend.DataQuery{
+			{
+				RefID:     "A",
+				TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+				JSON:      []byte(`{"refId":"A","expr":"up","instant":true}`),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if response := rsp.Responses["A"]; response.Error != nil {
+		t.Fatalf("unexpected error: %s", response.Error)
+	}
+
+	// proxied API routes
+	ctx := backend.WithPluginContext(context.Background(), pluginCtx)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/labels", nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	ds.VMAPIQuery(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d; body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,354 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	tenantModeOrg      = "org"
+	tenantModeHeader   = "header"
+	tenantModeVariable = "variable"
+	// tenantModeMultitenant routes requests to /select/multitenant/ endpoints
+	// and restricts them to tenants allowed for the Grafana user
+	tenantModeMultitenant = "multitenant"
+
+	// tenantParam is the resource request param containing the tenant key in "variable" mode
+	tenantParam = "tenant"
+	// selectPathPrefix is the path prefix of vmselect endpoints in the cluster version of VictoriaMetrics
+	selectPathPrefix = "/select/"
+)
+
+var tenantIDRe = regexp.MustCompile(`^\d+(:\d+)?$`)
+
+// TenantSettings contains settings for routing requests to tenants of the cluster version of VictoriaMetrics.
+// The datasource url must contain the tenant segment, e.g. http://vmselect:8481/select/0/prometheus,
+// which is replaced with the tenant resolved for every request.
+type TenantSettings struct {
+	// Mode defines the source of the tenant key: "org", "header" or "variable"
+	Mode string `json:"mode,omitempty"`
+	// Header is the name of the request header containing the tenant key in "header" mode
+	Header string `json:"header,omitempty"`
+	// Mapping maps tenant keys to tenant IDs in "accountID" or "accountID:projectID" format.
+	// In "org" mode keys are Grafana organization IDs. In "header" and "variable" modes
+	// keys are the received values; if the mapping is empty, values are used as tenant IDs.
+	Mapping map[string]string `json:"mapping,omitempty"`
+	// DefaultTenant is used if the tenant key is missing or has no mapping
+	DefaultTenant string `json:"defaultTenant,omitempty"`
+	// AllowedTenants defines tenants available to Grafana users in "multitenant" mode
+	AllowedTenants []TenantAccessRule `json:"allowedTenants,omitempty"`
+}
+
+// TenantAccessRule allows the matching Grafana users to query the listed tenants.
+// A request matches the rule if it matches any of users, roles or orgs.
+// Tenants of all matching rules are combined.
+type TenantAccessRule struct {
+	// Users contains Grafana user logins
+	Users []string `json:"users,omitempty"`
+	// Roles contains Grafana organization roles, e.g. Viewer, Editor or Admin
+	Roles []string `json:"roles,omitempty"`
+	// Orgs contains Grafana organization IDs. Alerting requests have no user,
+	// so they can be matched only by organization.
+	Orgs []int64 `json:"orgs,omitempty"`
+	// Tenants contains tenant IDs in "accountID" or "accountID:projectID" format
+	Tenants []string `json:"tenants"`
+}
+
+func (r TenantAccessRule) matches(rc requestContext) bool {
+	for _, org := range r.Orgs {
+		if org == rc.orgID {
+			return true
+		}
+	}
+	if rc.user == nil {
+		return false
+	}
+	for _, login := range r.Users {
+		if login == rc.user.Login {
+			return true
+		}
+	}
+	for _, role := range r.Roles {
+		if strings.EqualFold(role, rc.user.Role) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ts TenantSettings) enabled() bool {
+	return ts.Mode != ""
+}
+
+func (ts TenantSettings) validate(rawURL string) error {
+	switch ts.Mode {
+	case "":
+		return nil
+	case tenantModeOrg, tenantModeVariable:
+	case tenantModeMultitenant:
+		if len(ts.AllowedTenants) == 0 {
+			return fmt.Errorf("allowed tenants must be set in %q mode", tenantModeMultitenant)
+		}
+		for _, rule := range ts.AllowedTenants {
+			for _, tenant := range rule.Tenants {
+				if !tenantIDRe.MatchString(tenant) {
+					return fmt.Errorf("invalid allowed tenant %q: expecting accountID or accountID:projectID", tenant)
+				}
+			}
+		}
+	case tenantModeHeader:
+		if ts.Header == "" {
+			return fmt.Errorf("header name must be set in %q mode", tenantModeHeader)
+		}
+	default:
+		return fmt.Errorf("unsupported tenant mode %q; supported values are %q, %q, %q and %q",
+			ts.Mode, tenantModeOrg, tenantModeHeader, tenantModeVariable, tenantModeMultitenant)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse datasource url: %s", err)
+	}
+	if segment := tenantSegment(u.Path); !tenantIDRe.MatchString(segment) && segment != tenantModeMultitenant {
+		return fmt.Errorf("datasource url %q must contain %s<tenant>/ segment for tenant routing", rawURL, selectPathPrefix)
+	}
+	for k, v := range ts.Mapping {
+		if !tenantIDRe.MatchString(v) {
+			return fmt.Errorf("invalid tenant %q for key %q: expecting accountID or accountID:projectID", v, k)
+		}
+	}
+	if ts.DefaultTenant != "" && !tenantIDRe.MatchString(ts.DefaultTenant) {
+		return fmt.Errorf("invalid default tenant %q: expecting accountID or accountID:projectID", ts.DefaultTenant)
+	}
+	return nil
+}
+
+// requestContext contains request-scoped details required to execute queries
+type requestContext struct {
+	forAlerting bool
+	orgID       int64
+	user        *backend.User
+	headers     http.Header
+}
+
+// resolveTenant returns the tenant ID for the request.
+// variable is the value of the tenant template variable, if any.
+func (ts TenantSettings) resolveTenant(rc requestContext, variable string) (string, error) {
+	var key string
+	switch ts.Mode {
+	case tenantModeOrg:
+		key = strconv.FormatInt(rc.orgID, 10)
+	case tenantModeHeader:
+		key = rc.headers.Get(ts.Header)
+	case tenantModeVariable:
+		key = variable
+	}
+
+	if key != "" {
+		if len(ts.Mapping) == 0 && ts.Mode != tenantModeOrg {
+			if !tenantIDRe.MatchString(key) {
+				return "", fmt.Errorf("invalid tenant %q: expecting accountID or accountID:projectID", key)
+			}
+			return key, nil
+		}
+		if tenant, ok := ts.Mapping[key]; ok {
+			return tenant, nil
+		}
+	}
+	if ts.DefaultTenant != "" {
+		return ts.DefaultTenant, nil
+	}
+	return "", fmt.Errorf("no tenant is mapped for %q in %q tenant mode", key, ts.Mode)
+}
+
+// getBaseURL returns the datasource url for the request.
+// If tenant routing is enabled, the tenant segment of the url is replaced with the resolved tenant.
+func (di *DatasourceInstance) getBaseURL(rc requestContext, variable string) (string, error) {
+	if !di.settings.Tenant.enabled() {
+		return di.url, nil
+	}
+	if di.settings.Tenant.Mode == tenantModeMultitenant {
+		return tenantURL(di.url, tenantModeMultitenant)
+	}
+	tenant, err := di.settings.Tenant.resolveTenant(rc, variable)
+	if err != nil {
+		return "", err
+	}
+	return tenantURL(di.url, tenant)
+}
+
+// allowedTenantFilters returns series filters matching tenants allowed for the request in "multitenant" mode
+func (ts TenantSettings) allowedTenantFilters(rc requestContext) ([]string, error) {
+	var filters []string
+	seen := make(map[string]bool)
+	for _, rule := range ts.AllowedTenants {
+		if !rule.matches(rc) {
+			continue
+		}
+		for _, tenant := range rule.Tenants {
+			accountID, projectID, _ := strings.Cut(tenant, ":")
+			if projectID == "" {
+				projectID = "0"
+			}
+			filter := fmt.Sprintf(`{vm_account_id=%q,vm_project_id=%q}`, accountID, projectID)
+			if !seen[filter] {
+				seen[filter] = true
+				filters = append(filters, filter)
+			}
+		}
+	}
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("no tenants are allowed for the user")
+	}
+	return filters, nil
+}
+
+// accessRestricted returns true if requests are restricted to tenants and series with extra_filters[]
+func (di *DatasourceInstance) accessRestricted() bool {
+	return di.settings.Tenant.Mode == tenantModeMultitenant || len(di.settings.LabelAccess) > 0
+}
+
+// restrictablePaths are resource paths supporting extra_filters[] or not reading stored data
+var restrictablePaths = map[string]bool{
+	"/api/v1/query":      true,
+	"/api/v1/series":     true,
+	"/api/v1/labels":     true,
+	"/api/v1/export":     true,
+	"/api/v1/export/csv": true,
+	"/prettify-query":    true,
+	"/expand-with-exprs": true,
+}
+
+// isRestrictablePath returns true if requests to the resource path can be restricted with extra_filters[]
+func isRestrictablePath(p string) bool {
+	return restrictablePaths[p] || (strings.HasPrefix(p, "/api/v1/label/") && strings.HasSuffix(p, "/values"))
+}
+
+// restrictParams returns a copy of params restricted to tenants and series allowed for the request
+func (di *DatasourceInstance) restrictParams(rc requestContext, params url.Values) (url.Values, error) {
+	restricted := make(url.Values, len(params))
+	for k, vl := range params {
+		restricted[k] = append([]string(nil), vl...)
+	}
+	if di.settings.Tenant.Mode == tenantModeMultitenant {
+		filters, err := di.settings.Tenant.allowedTenantFilters(rc)
+		if err != nil {
+			return nil, err
+		}
+		if err := restrictExtraFilters(restricted, filters); err != nil {
+			return nil, err
+		}
+	}
+	if len(di.settings.LabelAccess) > 0 {
+		filters, err := labelAccessFilters(di.settings.LabelAccess, di.settings.Teams, rc)
+		if err != nil {
+			return nil, err
+		}
+		// tenant filters are combined with every label filter, so both restrictions apply
+		if err := restrictExtraFilters(restricted, filters); err != nil {
+			return nil, err
+		}
+	}
+	return restricted, nil
+}
+
+// restrictExtraFilters adds the required series filters to extra_filters[] params.
+// VictoriaMetrics combines multiple extra_filters[] with "or", so existing filters
+// are combined with every required filter to prevent escaping the restriction.
+func restrictExtraFilters(params url.Values, required []string) error {
+	var existing []string
+	for _, key := range []string{"extra_filters", "extra_filters[]"} {
+		existing = append(existing, params[key]...)
+		params.Del(key)
+	}
+	if len(existing) == 0 {
+		params["extra_filters[]"] = append([]string(nil), required...)
+		return nil
+	}
+	for _, e := range existing {
+		eInner, err := filterInner(e)
+		if err != nil {
+			return err
+		}
+		for _, r := range required {
+			rInner, err := filterInner(r)
+			if err != nil {
+				return err
+			}
+			switch {
+			case eInner == "":
+				params.Add("extra_filters[]", "{"+rInner+"}")
+			case rInner == "":
+				params.Add("extra_filters[]", "{"+eInner+"}")
+			default:
+				params.Add("extra_filters[]", "{"+eInner+","+rInner+"}")
+			}
+		}
+	}
+	return nil
+}
+
+// filterInner returns label filters of the series selector without enclosing braces
+func filterInner(filter string) (string, error) {
+	s := strings.TrimSpace(filter)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return "", fmt.Errorf("unsupported extra filter %q: expecting {label=\"value\",...}", filter)
+	}
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	// "or" filters can't be safely combined with required filters
+	for i := 0; i < len(inner); {
+		switch c := inner[i]; {
+		case c == '"' || c == '\'' || c == '`':
+			i = skipString(inner, i)
+		case isIdentStart(c):
+			start := i
+			for i < len(inner) && isIdentChar(inner[i]) {
+				i++
+			}
+			if strings.EqualFold(inner[start:i], "or") {
+				return "", fmt.Errorf("unsupported extra filter %q: \"or\" filters are not allowed with access restrictions", filter)
+			}
+		default:
+			i++
+		}
+	}
+	return inner, nil
+}
+
+// tenantSegment returns the path segment following /select/
+func tenantSegment(p string) string {
+	idx := strings.Index(p, selectPathPrefix)
+	if idx == -1 {
+		return ""
+	}
+	segment := p[idx+len(selectPathPrefix):]
+	if i := strings.IndexByte(segment, '/'); i != -1 {
+		segment = segment[:i]
+	}
+	return segment
+}
+
+// tenantURL replaces the tenant segment following /select/ in rawURL with the given tenant
+func tenantURL(rawURL, tenant string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse datasource url: %s", err)
+	}
+	idx := strings.Index(u.Path, selectPathPrefix)
+	if idx == -1 {
+		return "", fmt.Errorf("datasource url %q must contain %s<tenant>/ segment for tenant routing", rawURL, selectPathPrefix)
+	}
+	rest := u.Path[idx+len(selectPathPrefix):]
+	if i := strings.IndexByte(rest, '/'); i != -1 {
+		rest = rest[i:]
+	} else {
+		rest = ""
+	}
+	u.Path = u.Path[:idx] + selectPathPrefix + tenant + rest
+	return u.String(), nil
+}
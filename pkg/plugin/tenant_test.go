@@ -0,0 +1,340 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestTenantSettings_validate(t *testing.T) {
+	f := func(ts TenantSettings, rawURL string, wantErr bool) {
+		t.Helper()
+		err := ts.validate(rawURL)
+		if (err != nil) != wantErr {
+			t.Errorf("validate() error = %v, wantErr %v", err, wantErr)
+		}
+	}
+
+	// disabled tenant routing doesn't require /select/ url
+	f(TenantSettings{}, "http://localhost:8428", false)
+
+	// org mode
+	f(TenantSettings{Mode: tenantModeOrg, Mapping: map[string]string{"1": "1:0"}}, "http://vmselect:8481/select/0/prometheus", false)
+
+	// url without tenant segment
+	f(TenantSettings{Mode: tenantModeOrg}, "http://localhost:8428", true)
+	f(TenantSettings{Mode: tenantModeOrg}, "http://vmselect:8481/select/prometheus", true)
+
+	// header mode without header name
+	f(TenantSettings{Mode: tenantModeHeader}, "http://vmselect:8481/select/0/prometheus", true)
+
+	// invalid mapping
+	f(TenantSettings{Mode: tenantModeVariable, Mapping: map[string]string{"a": "team-a"}}, "http://vmselect:8481/select/0/prometheus", true)
+
+	// invalid default tenant
+	f(TenantSettings{Mode: tenantModeVariable, DefaultTenant: "0:a"}, "http://vmselect:8481/select/0/prometheus", true)
+
+	// unknown mode
+	f(TenantSettings{Mode: "team"}, "http://vmselect:8481/select/0/prometheus", true)
+}
+
+func TestTenantSettings_resolveTenant(t *testing.T) {
+	type opts struct {
+		settings TenantSettings
+		rc       requestContext
+		variable string
+		want     string
+		wantErr  bool
+	}
+	f := func(opts opts) {
+		t.Helper()
+		got, err := opts.settings.resolveTenant(opts.rc, opts.variable)
+		if (err != nil) != opts.wantErr {
+			t.Fatalf("resolveTenant() error = %v, wantErr %v", err, opts.wantErr)
+		}
+		if got != opts.want {
+			t.Errorf("resolveTenant() got = %q, want %q", got, opts.want)
+		}
+	}
+
+	mapping := map[string]string{"1": "10:1", "team-a": "20"}
+
+	// org mode with mapping
+	f(opts{
+		settings: TenantSettings{Mode: tenantModeOrg, Mapping: mapping},
+		rc:       requestContext{orgID: 1},
+		want:     "10:1",
+	})
+
+	// org mode falls back to default tenant
+	f(opts{
+		settings: TenantSettings{Mode: tenantModeOrg, Mapping: mapping, DefaultTenant: "0"},
+		rc:       requestContext{orgID: 2},
+		want:     "0",
+	})
+
+	// org mode without default tenant
+	f(opts{
+		settings: TenantSettings{Mode: tenantModeOrg, Mapping: mapping},
+		rc:       requestContext{orgID: 2},
+		wantErr:  true,
+	})
+
+	// header mode with mapping
+	f(opts{
+		settings: TenantSettings{Mode: tenantModeHeader, Header: "X-Team", Mapping: mapping},
+		rc:       requestContext{headers: http.Header{"X-Team": []string{"team-a"}}},
+		want:     "20",
+	})
+
+	// header mode without mapping uses header value as tenant
+	f(opts{
+		settings: TenantSettings{Mode: tenantModeHeader, Header: "X-Tenant"},
+		rc:       requestContext{headers: http.Header{"X-Tenant": []string{"3:4"}}},
+		want:     "3:4",
+	})
+
+	// header mode without mapping rejects invalid tenant
+	f(opts{
+		settings: TenantSettings{Mode: tenantModeHeader, Header: "X-Tenant", DefaultTenant: "0"},
+		rc:       requestContext{headers: http.Header{"X-Tenant": []string{"../../admin"}}},
+		wantErr:  true,
+	})
+
+	// variable mode
+	f(opts{
+		settings: TenantSettings{Mode: tenantModeVariable},
+		variable: "5",
+		want:     "5",
+	})
+
+	// variable mode with empty variable
+	f(opts{
+		settings: TenantSettings{Mode: tenantModeVariable, DefaultTenant: "0:0"},
+		want:     "0:0",
+	})
+}
+
+func Test_tenantURL(t *testing.T) {
+	f := func(rawURL, tenant, want string, wantErr bool) {
+		t.Helper()
+		got, err := tenantURL(rawURL, tenant)
+		if (err != nil) != wantErr {
+			t.Fatalf("tenantURL() error = %v, wantErr %v", err, wantErr)
+		}
+		if got != want {
+			t.Errorf("tenantURL() got = %q, want %q", got, want)
+		}
+	}
+
+	f("http://vmselect:8481/select/0/prometheus", "1:2", "http://vmselect:8481/select/1:2/prometheus", false)
+	f("http://vmselect:8481/select/0/prometheus/", "1", "http://vmselect:8481/select/1/prometheus/", false)
+	f("http://vmauth:8427/base/select/0:0/prometheus?extra_label=a%3Db", "3", "http://vmauth:8427/base/select/3/prometheus?extra_label=a%3Db", false)
+	f("http://vmselect:8481/select/0", "1", "http://vmselect:8481/select/1", false)
+	f("http://localhost:8428", "1", "", true)
+}
+
+func TestDatasourceQueryWithTenant(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/select/7:1/prometheus/api/v1/query", "/select/7:1/prometheus/api/v1/labels":
+			if r.URL.Query().Has(tenantParam) {
+				t.Errorf("tenant param must not be forwarded")
+			}
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1583786142, "1"]}}`))
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ds := NewDatasource()
+	pluginCtx := backend.PluginContext{
+		OrgID: 3,
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL:      srv.URL + "/select/0/prometheus",
+			JSONData: []byte(`{"httpMethod":"GET","tenant":{"mode":"variable","mapping":{"team-a":"7:1"}}}`),
+		},
+	}
+
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: pluginCtx,
+		Queries: []backend.DataQuery{
+			{
+				RefID:     "A",
+				TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+				JSON:      []byte(`{"refId":"A","instant":true,"expr":"1","tenant":"team-a"}`),
+			},
+			{
+				RefID:     "B",
+				TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+				JSON:      []byte(`{"refId":"B","instant":true,"expr":"1","tenant":"team-b"}`),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rsp.Responses["A"].Error != nil {
+		t.Fatalf("unexpected error: %s", rsp.Responses["A"].Error)
+	}
+	if rsp.Responses["B"].Error == nil {
+		t.Fatalf("expected error for unmapped tenant")
+	}
+
+	ctx := backend.WithPluginContext(context.Background(), pluginCtx)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/labels?tenant=team-a", nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	ds.VMAPIQuery(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d; body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+}
+
+func TestTenantSettings_allowedTenantFilters(t *testing.T) {
+	ts := TenantSettings{
+		Mode: tenantModeMultitenant,
+		AllowedTenants: []TenantAccessRule{
+			{Users: []string{"alice"}, Tenants: []string{"1", "2:3"}},
+			{Roles: []string{"Admin"}, Tenants: []string{"1:0", "4"}},
+			{Orgs: []int64{5}, Tenants: []string{"5:5"}},
+		},
+	}
+	f := func(rc requestContext, want []string, wantErr bool) {
+		t.Helper()
+		got, err := ts.allowedTenantFilters(rc)
+		if (err != nil) != wantErr {
+			t.Fatalf("allowedTenantFilters() error = %v, wantErr %v", err, wantErr)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("allowedTenantFilters() got = %q, want %q", got, want)
+		}
+	}
+
+	// user matches by login and role
+	f(requestContext{user: &backend.User{Login: "alice", Role: "admin"}}, []string{
+		`{vm_account_id="1",vm_project_id="0"}`,
+		`{vm_account_id="2",vm_project_id="3"}`,
+		`{vm_account_id="4",vm_project_id="0"}`,
+	}, false)
+
+	// alerting request without user matches by org
+	f(requestContext{orgID: 5}, []string{`{vm_account_id="5",vm_project_id="5"}`}, false)
+
+	// no matching rules
+	f(requestContext{orgID: 1, user: &backend.User{Login: "bob", Role: "Viewer"}}, nil, true)
+}
+
+func Test_restrictExtraFilters(t *testing.T) {
+	f := func(params url.Values, required []string, want url.Values, wantErr bool) {
+		t.Helper()
+		err := restrictExtraFilters(params, required)
+		if (err != nil) != wantErr {
+			t.Fatalf("restrictExtraFilters() error = %v, wantErr %v", err, wantErr)
+		}
+		if err == nil && !reflect.DeepEqual(params, want) {
+			t.Errorf("restrictExtraFilters() got = %v, want %v", params, want)
+		}
+	}
+
+	required := []string{`{vm_account_id="1"}`, `{vm_account_id="2"}`}
+
+	// no existing filters
+	f(url.Values{"query": {"up"}}, required, url.Values{
+		"query":           {"up"},
+		"extra_filters[]": required,
+	}, false)
+
+	// existing filters are combined with every required filter
+	f(url.Values{"extra_filters[]": {`{job="a"}`}, "extra_filters": {`{job="b"}`}}, required, url.Values{
+		"extra_filters[]": {
+			`{job="b",vm_account_id="1"}`,
+			`{job="b",vm_account_id="2"}`,
+			`{job="a",vm_account_id="1"}`,
+			`{job="a",vm_account_id="2"}`,
+		},
+	}, false)
+
+	// "or" filters are rejected
+	f(url.Values{"extra_filters[]": {`{job="a" or vm_account_id="3"}`}}, required, nil, true)
+
+	// "or" inside label values is allowed
+	f(url.Values{"extra_filters[]": {`{job="a or b"}`}}, required[:1], url.Values{
+		"extra_filters[]": {`{job="a or b",vm_account_id="1"}`},
+	}, false)
+
+	// invalid filter
+	f(url.Values{"extra_filters[]": {`job="a"`}}, required, nil, true)
+}
+
+func TestDatasourceQueryWithMultitenant(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/select/multitenant/prometheus/api/v1/query" && r.URL.Path != "/select/multitenant/prometheus/api/v1/series" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		want := []string{`{job="a",vm_account_id="1",vm_project_id="0"}`}
+		if got := r.URL.Query()["extra_filters[]"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected extra_filters[]: %q, want %q", got, want)
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1583786142, "1"]}}`))
+	}))
+	defer srv.Close()
+
+	ds := NewDatasource()
+	pluginCtx := backend.PluginContext{
+		OrgID: 1,
+		User:  &backend.User{Login: "alice"},
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL: srv.URL + "/select/0/prometheus",
+			JSONData: []byte(`{
+				"httpMethod": "GET",
+				"customQueryParameters": "extra_filters[]={job=\"a\"}",
+				"tenant": {"mode": "multitenant", "allowedTenants": [{"users": ["alice"], "tenants": ["1"]}]}
+			}`),
+		},
+	}
+
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: pluginCtx,
+		Queries: []backend.DataQuery{
+			{
+				RefID:     "A",
+				TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+				JSON:      []byte(`{"refId":"A","instant":true,"expr":"1"}`),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rsp.Responses["A"].Error != nil {
+		t.Fatalf("unexpected error: %s", rsp.Responses["A"].Error)
+	}
+
+	ctx := backend.WithPluginContext(context.Background(), pluginCtx)
+	req := httptest.NewRequest(http.MethodGet, `/api/v1/series?extra_filters[]={job="a"}`, nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	ds.VMAPIQuery(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d; body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	// user without allowed tenants
+	pluginCtx.User = &backend.User{Login: "bob"}
+	ctx = backend.WithPluginContext(context.Background(), pluginCtx)
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/series", nil).WithContext(ctx)
+	rr = httptest.NewRecorder()
+	ds.VMAPIQuery(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d; body: %s", http.StatusForbidden, rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,322 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// StorageTier is VictoriaMetrics storing samples for the retention window,
+// e.g. a short-retention high-resolution cluster or a long-retention downsampled one
+type StorageTier struct {
+	// Name is recorded in the frame metadata of responses answered by the tier
+	Name string `json:"name"`
+	// URL is the datasource url of the tier; the datasource url is used if empty
+	URL string `json:"url,omitempty"`
+	// Retention is how far back the tier stores samples, e.g. "7d".
+	// The tier with the longest retention answers queries reaching beyond all retentions.
+	Retention string `json:"retention"`
+}
+
+type storageTier struct {
+	name      string
+	url       string
+	retention time.Duration
+}
+
+// parseStorageTiers returns tiers sorted by retention, so the hottest tier goes first
+func parseStorageTiers(tiers []StorageTier, defaultURL string, ts TenantSettings) ([]storageTier, error) {
+	parsed := make([]storageTier, 0, len(tiers))
+	names := make(map[string]bool, len(tiers))
+	for _, t := range tiers {
+		if t.Name == "" {
+			return nil, fmt.Errorf("tier name can't be empty")
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate tier name %q", t.Name)
+		}
+		names[t.Name] = true
+		retention, err := gtime.ParseDuration(t.Retention)
+		if err != nil || retention <= 0 {
+			return nil, fmt.Errorf("invalid retention %q of tier %q: expecting positive duration, e.g. 7d", t.Retention, t.Name)
+		}
+		tierURL := t.URL
+		if tierURL == "" {
+			tierURL = defaultURL
+		}
+		if _, err := url.Parse(tierURL); err != nil {
+			return nil, fmt.Errorf("failed to parse url of tier %q: %w", t.Name, err)
+		}
+		if err := ts.validate(tierURL); err != nil {
+			return nil, fmt.Errorf("invalid url of tier %q: %w", t.Name, err)
+		}
+		parsed = append(parsed, storageTier{name: t.Name, url: tierURL, retention: retention})
+	}
+	sort.Slice(parsed, func(i, j int) bool {
+		return parsed[i].retention < parsed[j].retention
+	})
+	for i := 1; i < len(parsed); i++ {
+		if parsed[i].retention == parsed[i-1].retention {
+			return nil, fmt.Errorf("tiers %q and %q have the same retention", parsed[i-1].name, parsed[i].name)
+		}
+	}
+	return parsed, nil
+}
+
+// tierSegment is the part of the query time range answered by the tier
+type tierSegment struct {
+	tier       storageTier
+	start, end time.Time
+}
+
+// splitByTiers splits the time range between tiers, starting from the hottest one.
+// Boundaries are aligned to the step grid starting at start, so points of all segments
+// match points of the whole range. Adjacent segments share the boundary point.
+func splitByTiers(tiers []storageTier, start, end time.Time, step time.Duration, now time.Time) []tierSegment {
+	var segments []tierSegment
+	for i, t := range tiers {
+		segStart := start
+		if i < len(tiers)-1 {
+			if b := alignToGrid(now.Add(-t.retention), start, step); b.After(segStart) {
+				segStart = b
+			}
+		}
+		if segStart.After(end) {
+			// the range is older than the retention of the tier
+			continue
+		}
+		segments = append(segments, tierSegment{tier: t, start: segStart, end: end})
+		if !segStart.After(start) {
+			break
+		}
+		end = segStart
+	}
+	return segments
+}
+
+// alignToGrid returns the first point of the grid start+N*step not before t
+func alignToGrid(t, start time.Time, step time.Duration) time.Time {
+	if step <= 0 || !t.After(start) {
+		return t
+	}
+	n := (t.Sub(start) + step - 1) / step
+	return start.Add(n * step)
+}
+
+// querySegments returns segments of the query time range answered by storage tiers,
+// from the oldest to the most recent data
+func (di *DatasourceInstance) querySegments(q *Query, now time.Time) []tierSegment {
+	if !q.isRangeQuery() {
+		return splitByTiers(di.tiers, q.TimeRange.To, q.TimeRange.To, 0, now)
+	}
+	// the start param of range queries is truncated to seconds
+	start := time.Unix(q.TimeRange.From.Unix(), 0)
+	step := time.Duration(q.IntervalMs) * time.Millisecond
+	segments := splitByTiers(di.tiers, start, q.TimeRange.To, step, now)
+	for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+		segments[i], segments[j] = segments[j], segments[i]
+	}
+	return segments
+}
+
+// fetchFromTiers executes the query prepared as reqURL for baseURL on storage tiers covering its time range.
+// Range queries spanning several tiers are split at tier boundaries and stitched together.
+// It returns names of tiers which answered the query, from the oldest to the most recent data.
+func (di *DatasourceInstance) fetchFromTiers(ctx context.Context, baseURL, reqURL string, q *Query) (*Response, []string, error) {
+	segments := di.querySegments(q, time.Now())
+	names := make([]string, len(segments))
+	for i, s := range segments {
+		names[i] = s.tier.name
+	}
+	if len(segments) == 1 {
+		r, err := di.fetchSegment(ctx, baseURL, reqURL, segments[0], nil, q.isRangeQuery())
+		return r, names, err
+	}
+
+	responses := make([]*Response, len(segments))
+	errs := make([]error, len(segments))
+	var wg sync.WaitGroup
+	for i, s := range segments {
+		params := url.Values{}
+		if i > 0 {
+			params.Set("start", formatUnixTime(s.start))
+		}
+		if i < len(segments)-1 {
+			params.Set("end", formatUnixTime(s.end))
+		}
+		wg.Add(1)
+		go func(i int, s tierSegment) {
+			defer wg.Done()
+			responses[i], errs[i] = di.fetchSegment(ctx, baseURL, reqURL, s, params, true)
+		}(i, s)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, nil, fmt.Errorf("tier %q: %w", segments[i].tier.name, err)
+		}
+	}
+	r, err := stitchResponses(responses, segments)
+	if err != nil {
+		return nil, nil, err
+	}
+	// limits are checked per segment, so the stitched result may exceed them
+	if err := di.settings.ResponseLimits.checkResult(r.Data); err != nil {
+		return nil, nil, err
+	}
+	return r, names, nil
+}
+
+// fetchSegment executes reqURL on the tier of the segment with params overriding query params
+func (di *DatasourceInstance) fetchSegment(ctx context.Context, baseURL, reqURL string, s tierSegment, params url.Values, hedge bool) (*Response, error) {
+	tierBase, err := di.tierURL(baseURL, s.tier)
+	if err != nil {
+		return nil, err
+	}
+	u, err := rebaseURL(reqURL, baseURL, tierBase)
+	if err != nil {
+		return nil, err
+	}
+	values := u.Query()
+	for k, vl := range params {
+		values[k] = vl
+	}
+	u.RawQuery = values.Encode()
+	// hedged requests are sent to replicas of the datasource url only
+	return di.fetchResponse(ctx, u.String(), hedge && s.tier.url == di.url)
+}
+
+// tierURL returns the url of the tier for the tenant of baseURL
+func (di *DatasourceInstance) tierURL(baseURL string, t storageTier) (string, error) {
+	if !di.settings.Tenant.enabled() {
+		return t.url, nil
+	}
+	return tenantURL(t.url, tenantSegment(baseURL))
+}
+
+// rebaseURL replaces baseURL at the beginning of reqURL with newBase
+func rebaseURL(reqURL, baseURL, newBase string) (*url.URL, error) {
+	u, err := url.Parse(reqURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse request url: %w", err)
+	}
+	b, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse datasource url: %w", err)
+	}
+	nb, err := url.Parse(newBase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tier url: %w", err)
+	}
+	rel := strings.TrimPrefix(u.Path, strings.TrimSuffix(b.Path, "/"))
+	u.Scheme, u.Host, u.User = nb.Scheme, nb.Host, nb.User
+	u.Path = path.Join("/", nb.Path, rel)
+	return u, nil
+}
+
+func formatUnixTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1e3, 'f', -1, 64)
+}
+
+// stitchResponses merges matrix responses of segments ordered from the oldest to the most recent data.
+// Samples of older segments at or after the start of the next segment are dropped,
+// so the more recent tier wins at the boundary.
+func stitchResponses(responses []*Response, segments []tierSegment) (*Response, error) {
+	merged := &Response{Status: "success", Data: Data{ResultType: matrix}}
+	var series []*Result
+	byLabels := make(map[string]*Result)
+	for i, r := range responses {
+		if r.Data.ResultType != matrix {
+			return nil, fmt.Errorf("tier %q: unexpected result type %q; expecting %q", segments[i].tier.name, r.Data.ResultType, matrix)
+		}
+		var results []Result
+		if err := json.Unmarshal(r.Data.Result, &results); err != nil {
+			return nil, fmt.Errorf("tier %q: failed to unmarshal result: %w", segments[i].tier.name, err)
+		}
+		if i > 0 {
+			boundary := float64(segments[i].start.UnixMilli()) / 1e3
+			for _, s := range series {
+				s.Values = valuesBefore(s.Values, boundary)
+			}
+		}
+		for _, res := range results {
+			key := labelsKey(res.Labels)
+			if s, ok := byLabels[key]; ok {
+				s.Values = append(s.Values, res.Values...)
+				continue
+			}
+			s := res
+			byLabels[key] = &s
+			series = append(series, &s)
+		}
+		merged.IsPartial = merged.IsPartial || r.IsPartial
+		merged.Warnings = append(merged.Warnings, r.Warnings...)
+		merged.Infos = append(merged.Infos, r.Infos...)
+		if r.Trace != nil {
+			merged.Trace = r.Trace
+		}
+	}
+	results := make([]Result, 0, len(series))
+	for _, s := range series {
+		if len(s.Values) > 0 {
+			results = append(results, *s)
+		}
+	}
+	b, err := json.Marshal(results)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal stitched result: %w", err)
+	}
+	merged.Data.Result = b
+	return merged, nil
+}
+
+// valuesBefore returns values with timestamps before ts
+func valuesBefore(values []Value, ts float64) []Value {
+	for i, v := range values {
+		if t, ok := v[0].(float64); ok && t >= ts {
+			return values[:i]
+		}
+	}
+	return values
+}
+
+func labelsKey(labels Labels) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(strconv.Quote(k))
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[k]))
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+// setStorageTiers records names of tiers which answered the query in the frame metadata
+func setStorageTiers(frames data.Frames, names []string) {
+	for _, f := range frames {
+		if f.Meta == nil {
+			f.Meta = &data.FrameMeta{}
+		}
+		switch cm := f.Meta.Custom.(type) {
+		case *CustomMeta:
+			cm.StorageTiers = names
+		case nil:
+			f.Meta.Custom = &CustomMeta{StorageTiers: names}
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func Test_parseStorageTiers(t *testing.T) {
+	f := func(tiers []StorageTier, want []storageTier, wantErr bool) {
+		t.Helper()
+		got, err := parseStorageTiers(tiers, "http://vm:8428", TenantSettings{})
+		if (err != nil) != wantErr {
+			t.Fatalf("parseStorageTiers() error = %v, wantErr %v", err, wantErr)
+		}
+		if !wantErr && !reflect.DeepEqual(got, want) {
+			t.Errorf("parseStorageTiers() got = %v, want %v", got, want)
+		}
+	}
+
+	f(nil, []storageTier{}, false)
+
+	// tiers are sorted by retention and default to the datasource url
+	f([]StorageTier{
+		{Name: "cold", URL: "http://cold:8428", Retention: "365d"},
+		{Name: "hot", Retention: "7d"},
+	}, []storageTier{
+		{name: "hot", url: "http://vm:8428", retention: 7 * day},
+		{name: "cold", url: "http://cold:8428", retention: 365 * day},
+	}, false)
+
+	f([]StorageTier{{Retention: "7d"}}, nil, true)
+	f([]StorageTier{{Name: "hot", Retention: "foo"}}, nil, true)
+	f([]StorageTier{{Name: "hot", Retention: "7d"}, {Name: "hot", Retention: "365d"}}, nil, true)
+	f([]StorageTier{{Name: "hot", Retention: "7d"}, {Name: "cold", Retention: "7d"}}, nil, true)
+}
+
+func Test_splitByTiers(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tiers := []storageTier{
+		{name: "hot", retention: day},
+		{name: "warm", retention: 7 * day},
+		{name: "cold", retention: 365 * day},
+	}
+	f := func(from, to time.Duration, step time.Duration, want []string) {
+		t.Helper()
+		start, end := now.Add(-from), now.Add(-to)
+		segments := splitByTiers(tiers, start, end, step, now)
+		var got []string
+		for _, s := range segments {
+			got = append(got, fmt.Sprintf("%s:%s-%s", s.tier.name, now.Sub(s.start), now.Sub(s.end)))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("splitByTiers() got = %q, want %q", got, want)
+		}
+	}
+
+	// recent data
+	f(time.Hour, 0, time.Minute, []string{"hot:1h0m0s-0s"})
+
+	// old data
+	f(3*day, 2*day, time.Minute, []string{"warm:72h0m0s-48h0m0s"})
+	f(30*day, 20*day, time.Minute, []string{"cold:720h0m0s-480h0m0s"})
+
+	// data older than all retentions is queried from the coldest tier
+	f(400*day, 390*day, time.Minute, []string{"cold:9600h0m0s-9360h0m0s"})
+
+	// spanning ranges share boundary points
+	f(2*day, 0, time.Minute, []string{"hot:24h0m0s-0s", "warm:48h0m0s-24h0m0s"})
+	f(10*day, 0, time.Minute, []string{"hot:24h0m0s-0s", "warm:168h0m0s-24h0m0s", "cold:240h0m0s-168h0m0s"})
+
+	// boundaries are aligned to the step grid
+	f(2*day+90*time.Second, 0, time.Hour, []string{"hot:23h1m30s-0s", "warm:48h1m30s-23h1m30s"})
+}
+
+func TestDatasourceQueryWithStorageTiers(t *testing.T) {
+	type request struct {
+		start, end float64
+	}
+	var mu sync.Mutex
+	requests := make(map[string][]request)
+	newTier := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/prometheus/api/v1/query_range" {
+				t.Errorf("unexpected path %q", r.URL.Path)
+			}
+			q := r.URL.Query()
+			start, _ := strconv.ParseFloat(q.Get("start"), 64)
+			end, _ := strconv.ParseFloat(q.Get("end"), 64)
+			step, _ := time.ParseDuration(q.Get("step"))
+			mu.Lock()
+			requests[name] = append(requests[name], request{start: start, end: end})
+			mu.Unlock()
+
+			// the hot tier returns 1 and the cold tier returns 0 at every point of the range
+			val := "0"
+			if name == "hot" {
+				val = "1"
+			}
+			var values []Value
+			for ts := start; ts <= end; ts += step.Seconds() {
+				values = append(values, Value{ts, val})
+			}
+			result, _ := json.Marshal([]Result{{Labels: Labels{"__name__": "up"}, Values: values}})
+			_, _ = fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":%s}}`, result)
+		}))
+	}
+	hot, cold := newTier("hot"), newTier("cold")
+	defer hot.Close()
+	defer cold.Close()
+
+	ds := NewDatasource()
+	pluginCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL: hot.URL + "/prometheus",
+			JSONData: []byte(fmt.Sprintf(`{"httpMethod":"GET","storageTiers":[
+				{"name":"hot","retention":"1d"},
+				{"name":"cold","url":%q,"retention":"1y"}
+			]}`, cold.URL+"/prometheus")),
+		},
+	}
+	f := func(from, to time.Duration, wantTiers []string, wantPoints int) {
+		t.Helper()
+		mu.Lock()
+		requests = make(map[string][]request)
+		mu.Unlock()
+		now := time.Now()
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: pluginCtx,
+			Queries: []backend.DataQuery{
+				{
+					RefID:         "A",
+					MaxDataPoints: 1000,
+					Interval:      time.Hour,
+					TimeRange:     backend.TimeRange{From: now.Add(-from), To: now.Add(-to)},
+					JSON:          []byte(`{"refId":"A","expr":"up","intervalMs":3600000}`),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp := rsp.Responses["A"]
+		if resp.Error != nil {
+			t.Fatalf("unexpected error: %s", resp.Error)
+		}
+		for _, name := range []string{"hot", "cold"} {
+			wantRequests := 0
+			for _, tier := range wantTiers {
+				if tier == name {
+					wantRequests = 1
+				}
+			}
+			if got := len(requests[name]); got != wantRequests {
+				t.Fatalf("expected %d requests to tier %q; got %d", wantRequests, name, got)
+			}
+		}
+		if len(resp.Frames) != 1 {
+			t.Fatalf("expected 1 frame; got %d", len(resp.Frames))
+		}
+		frame := resp.Frames[0]
+		cm, ok := frame.Meta.Custom.(*CustomMeta)
+		if !ok || !reflect.DeepEqual(cm.StorageTiers, wantTiers) {
+			t.Fatalf("expected storage tiers %q in frame metadata; got %+v", wantTiers, frame.Meta.Custom)
+		}
+		if n := frame.Rows(); n != wantPoints {
+			t.Fatalf("expected %d points; got %d", wantPoints, n)
+		}
+		if len(wantTiers) < 2 {
+			return
+		}
+
+		// the hot tier answers the boundary point and the stitched series has no gaps
+		boundary := requests["hot"][0].start
+		if requests["cold"][0].end != boundary {
+			t.Fatalf("expected the cold tier to be queried till the boundary %v; got %v", boundary, requests["cold"][0].end)
+		}
+		var prev time.Time
+		for i := 0; i < frame.Rows(); i++ {
+			ts := frame.Fields[0].At(i).(time.Time)
+			if i > 0 && ts.Sub(prev) != time.Hour {
+				t.Fatalf("expected points every hour; got %s between points %d and %d", ts.Sub(prev), i-1, i)
+			}
+			prev = ts
+			wantValue := "cold"
+			if float64(ts.Unix()) >= boundary {
+				wantValue = "hot"
+			}
+			if got := frame.Fields[1].At(i).(float64); (wantValue == "hot") != (got == 1) {
+				t.Fatalf("expected point %d at %s to be answered by %q", i, ts, wantValue)
+			}
+		}
+	}
+
+	// recent data
+	f(12*time.Hour, 0, []string{"hot"}, 13)
+
+	// old data
+	f(3*day, 2*day, []string{"cold"}, 25)
+
+	// spanning ranges are stitched
+	f(2*day, 0, []string{"cold", "hot"}, 49)
+}
+
+func TestDatasourceStorageTiersRouting(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	newTier := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			mu.Lock()
+			requests = append(requests, name+":"+r.URL.Path+":"+q.Get("query"))
+			mu.Unlock()
+			switch r.URL.Path {
+			case tsdbStatusPath:
+				_, _ = w.Write([]byte(`{"status":"success","data":{"totalSeries":1}}`))
+			case "/api/v1/query_range":
+				start, _ := strconv.ParseFloat(q.Get("start"), 64)
+				end, _ := strconv.ParseFloat(q.Get("end"), 64)
+				step, _ := time.ParseDuration(q.Get("step"))
+				var values []Value
+				for ts := start; ts <= end; ts += step.Seconds() {
+					values = append(values, Value{ts, "1"})
+				}
+				metric := "up"
+				if strings.HasPrefix(q.Get("query"), alertsMetric) {
+					metric = alertsMetric
+				}
+				result, _ := json.Marshal([]Result{{Labels: Labels{"__name__": metric, "alertname": "a", "alertstate": "firing"}, Values: values}})
+				_, _ = fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":%s}}`, result)
+			default:
+				t.Errorf("unexpected path %q", r.URL.Path)
+			}
+		}))
+	}
+	hot, cold := newTier("hot"), newTier("cold")
+	defer hot.Close()
+	defer cold.Close()
+
+	ds := NewDatasource()
+	pluginCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			URL: hot.URL,
+			JSONData: []byte(fmt.Sprintf(`{"httpMethod":"GET",
+				"queryCostLimits":{"maxSeries":10},
+				"responseLimits":{"maxSamples":40},
+				"storageTiers":[{"name":"hot","retention":"1d"},{"name":"cold","url":%q,"retention":"365d"}]
+			}`, cold.URL)),
+		},
+	}
+	f := func(queryType, expr string, from, to time.Duration, wantRequests []string, wantErr string) {
+		t.Helper()
+		mu.Lock()
+		requests = nil
+		mu.Unlock()
+		now := time.Now()
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: pluginCtx,
+			Queries: []backend.DataQuery{
+				{
+					RefID:         "A",
+					QueryType:     queryType,
+					MaxDataPoints: 1000,
+					Interval:      time.Hour,
+					TimeRange:     backend.TimeRange{From: now.Add(-from), To: now.Add(-to)},
+					JSON:          []byte(fmt.Sprintf(`{"refId":"A","expr":%q,"intervalMs":3600000}`, expr)),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp := rsp.Responses["A"]
+		if wantErr == "" && resp.Error != nil {
+			t.Fatalf("unexpected error: %s", resp.Error)
+		}
+		if wantErr != "" && (resp.Error == nil || !strings.Contains(resp.Error.Error(), wantErr)) {
+			t.Fatalf("expected error containing %q; got %v", wantErr, resp.Error)
+		}
+		sort.Strings(requests)
+		sort.Strings(wantRequests)
+		if !reflect.DeepEqual(requests, wantRequests) {
+			t.Fatalf("unexpected requests:\nexpected %q\ngot      %q", wantRequests, requests)
+		}
+	}
+
+	// the cost is estimated and ALERTS_FOR_STATE are requested from the tier answering the query
+	f(queryTypeAlertAnnotations, "", 3*day, 2*day, []string{
+		"cold:" + tsdbStatusPath + ":",
+		"cold:/api/v1/query_range:ALERTS",
+		"cold:/api/v1/query_range:ALERTS_FOR_STATE",
+	}, "")
+
+	// limits are applied to the stitched response
+	f("", "up", 2*day, 0, []string{
+		"cold:" + tsdbStatusPath + ":",
+		"hot:" + tsdbStatusPath + ":",
+		"cold:/api/v1/query_range:up",
+		"hot:/api/v1/query_range:up",
+	}, "the limit of 40 samples")
+}
@@ -0,0 +1,221 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// queryTypeVMAlertRules returns rules of vmalert as a table
+	queryTypeVMAlertRules = "vmalertRules"
+	// queryTypeVMAlertAlerts returns active alerts of vmalert as a table
+	queryTypeVMAlertAlerts = "vmalertAlerts"
+
+	vmalertRulesPath = "/api/v1/rules"
+	// vmalertResourcePrefix is the prefix of resource routes proxied to vmalert
+	vmalertResourcePrefix = "/vmalert"
+)
+
+// vmalertRulesResponse is the response of vmalert /api/v1/rules
+type vmalertRulesResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Data   struct {
+		Groups []vmalertGroup `json:"groups"`
+	} `json:"data"`
+}
+
+type vmalertGroup struct {
+	Name  string        `json:"name"`
+	Rules []vmalertRule `json:"rules"`
+}
+
+type vmalertRule struct {
+	Name           string            `json:"name"`
+	Type           string            `json:"type"`
+	State          string            `json:"state"`
+	Health         string            `json:"health"`
+	Labels         map[string]string `json:"labels"`
+	LastError      string            `json:"lastError"`
+	LastEvaluation time.Time         `json:"lastEvaluation"`
+	Alerts         []vmalertAlert    `json:"alerts"`
+}
+
+type vmalertAlert struct {
+	Name     string            `json:"name"`
+	State    string            `json:"state"`
+	Value    string            `json:"value"`
+	Labels   map[string]string `json:"labels"`
+	ActiveAt time.Time         `json:"activeAt"`
+}
+
+// queryVMAlert returns rules or active alerts of vmalert as a table frame
+func (di *DatasourceInstance) queryVMAlert(ctx context.Context, queryType string) backend.DataResponse {
+	if di.settings.VMAlertURL == "" {
+		return newQueryErrorResponse(newQueryError(errorKindBadQuery, fmt.Errorf("vmalert url is not configured in datasource settings")))
+	}
+	if err := di.checkVMAlertAccess(); err != nil {
+		return newQueryErrorResponse(newAccessDeniedError(err))
+	}
+	groups, err := di.fetchVMAlertGroups(ctx)
+	if err != nil {
+		return newQueryErrorResponse(err)
+	}
+	if queryType == queryTypeVMAlertRules {
+		return backend.DataResponse{Frames: data.Frames{vmalertRulesFrame(groups)}}
+	}
+	return backend.DataResponse{Frames: data.Frames{vmalertAlertsFrame(groups)}}
+}
+
+// fetchVMAlertGroups returns rule groups with active alerts from vmalert
+func (di *DatasourceInstance) fetchVMAlertGroups(ctx context.Context) ([]vmalertGroup, error) {
+	u, err := newURL(di.settings.VMAlertURL, vmalertRulesPath, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build vmalert url: %w", err)
+	}
+	resp, err := di.vmalertGet(ctx, u.String())
+	if err != nil {
+		return nil, classifyRequestError(err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.DefaultLogger.Error("failed to close response body", "err", err.Error())
+		}
+	}()
+
+	var r vmalertRulesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, classifyResponseError(resp.StatusCode, fmt.Errorf("got unexpected response status code from vmalert: %d", resp.StatusCode))
+		}
+		return nil, newQueryError(errorKindInternal, fmt.Errorf("failed to decode vmalert response: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK || r.Status == "error" {
+		return nil, classifyResponseError(resp.StatusCode, fmt.Errorf("vmalert returned error: %s", r.Error))
+	}
+	return r.Data.Groups, nil
+}
+
+// checkVMAlertAccess returns an error if access restrictions are configured.
+// vmalert returns rules and alerts of all tenants and doesn't support extra_filters[],
+// so it can't be restricted to tenants and series allowed for the user.
+func (di *DatasourceInstance) checkVMAlertAccess() error {
+	if di.settings.Tenant.enabled() || len(di.settings.LabelAccess) > 0 {
+		return fmt.Errorf("vmalert can't be queried when tenant routing or label access rules are configured")
+	}
+	return nil
+}
+
+// vmalertGet sends the GET request to vmalert
+func (di *DatasourceInstance) vmalertGet(ctx context.Context, reqURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new request with context: %w", err)
+	}
+	return di.vmalertClient.Do(req)
+}
+
+func vmalertRulesFrame(groups []vmalertGroup) *data.Frame {
+	var names, groupNames, types, states, healths, labels, lastErrors []string
+	var lastEvaluations []time.Time
+	for _, g := range groups {
+		for _, r := range g.Rules {
+			state := r.State
+			if r.Type == ruleTypeRecording {
+				// recording rules have no state
+				state = ""
+			}
+			names = append(names, r.Name)
+			groupNames = append(groupNames, g.Name)
+			types = append(types, r.Type)
+			states = append(states, state)
+			healths = append(healths, r.Health)
+			labels = append(labels, labelsToString(r.Labels))
+			lastErrors = append(lastErrors, r.LastError)
+			lastEvaluations = append(lastEvaluations, r.LastEvaluation)
+		}
+	}
+	return data.NewFrame("rules",
+		data.NewField("name", nil, names),
+		data.NewField("group", nil, groupNames),
+		data.NewField("type", nil, types),
+		data.NewField("state", nil, states),
+		data.NewField("health", nil, healths),
+		data.NewField("labels", nil, labels),
+		data.NewField("lastError", nil, lastErrors),
+		data.NewField("lastEvaluation", nil, lastEvaluations),
+	)
+}
+
+func vmalertAlertsFrame(groups []vmalertGroup) *data.Frame {
+	var names, groupNames, states, labels []string
+	var activeAts []time.Time
+	var values []*float64
+	for _, g := range groups {
+		for _, r := range g.Rules {
+			for _, a := range r.Alerts {
+				names = append(names, a.Name)
+				groupNames = append(groupNames, g.Name)
+				states = append(states, a.State)
+				labels = append(labels, labelsToString(a.Labels))
+				activeAts = append(activeAts, a.ActiveAt)
+				var value *float64
+				if f, err := strconv.ParseFloat(a.Value, 64); err == nil {
+					value = &f
+				}
+				values = append(values, value)
+			}
+		}
+	}
+	return data.NewFrame("alerts",
+		data.NewField("name", nil, names),
+		data.NewField("group", nil, groupNames),
+		data.NewField("state", nil, states),
+		data.NewField("labels", nil, labels),
+		data.NewField("activeAt", nil, activeAts),
+		data.NewField("value", nil, values),
+	)
+}
+
+// VMAlertQuery proxies requests to vmalert API configured in datasource settings
+func (d *Datasource) VMAlertQuery(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	pluginCxt := backend.PluginConfigFromContext(ctx)
+	di, err := d.getInstance(ctx, pluginCxt)
+	if err != nil {
+		d.logger.Error("Error loading datasource", "error", err)
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	if di.settings.VMAlertURL == "" {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("vmalert url is not configured in datasource settings"))
+		return
+	}
+	if err := di.checkVMAlertAccess(); err != nil {
+		writeError(rw, http.StatusForbidden, err)
+		return
+	}
+	u, err := newURL(di.settings.VMAlertURL, strings.TrimPrefix(req.URL.Path, vmalertResourcePrefix), false)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("failed to build vmalert url: %w", err))
+		return
+	}
+	u.RawQuery = req.URL.RawQuery
+	resp, err := di.vmalertGet(ctx, u.String())
+	if err != nil {
+		qe := classifyRequestError(err)
+		writeError(rw, int(qe.status), qe)
+		return
+	}
+	defer resp.Body.Close()
+	d.proxyResponse(rw, resp, "vmalert")
+}
@@ -0,0 +1,159 @@
+package plugin
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const vmalertRulesResponseBody = `{"status":"success","data":{"groups":[{"name":"vm-health","rules":[
+{"name":"ServiceDown","type":"alerting","state":"firing","health":"ok","labels":{"severity":"critical"},"lastEvaluation":"2022-12-05T08:00:00Z",
+ "alerts":[{"name":"ServiceDown","state":"firing","value":"0","labels":{"job":"vmagent","severity":"critical"},"activeAt":"2022-12-05T07:50:00Z"}]},
+{"name":"job:up:sum","type":"recording","state":"","health":"err","lastError":"cannot parse query","lastEvaluation":"2022-12-05T08:00:00Z"}
+]}]}}`
+
+func TestDatasourceQueryVMAlert(t *testing.T) {
+	vmalert := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != vmalertRulesPath {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(vmalertRulesResponseBody))
+	}))
+	defer vmalert.Close()
+
+	ds := NewDatasource()
+	query := func(queryType string) backend.DataResponse {
+		t.Helper()
+		rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{
+				DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+					URL: "http://victoria-a:8428",
+					// failover must not rewrite requests to vmalert
+					JSONData: []byte(`{"vmalertUrl":"` + vmalert.URL + `","endpoints":{"urls":["http://victoria-b:8428"],"strategy":"round-robin"}}`),
+				},
+			},
+			Queries: []backend.DataQuery{
+				{
+					RefID:     "A",
+					QueryType: queryType,
+					TimeRange: backend.TimeRange{From: time.Unix(1670226733, 0), To: time.Unix(1670226793, 0)},
+					JSON:      []byte(`{"refId":"A"}`),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		response := rsp.Responses["A"]
+		if response.Error != nil {
+			t.Fatalf("unexpected error: %s", response.Error)
+		}
+		if len(response.Frames) != 1 {
+			t.Fatalf("expected 1 frame; got %d", len(response.Frames))
+		}
+		return response
+	}
+
+	rules := query(queryTypeVMAlertRules).Frames[0]
+	if n := rules.Rows(); n != 2 {
+		t.Fatalf("expected 2 rules; got %d", n)
+	}
+	if got := rules.Fields[1].At(0).(string); got != "vm-health" {
+		t.Errorf("unexpected group: %q", got)
+	}
+	if got := rules.Fields[6].At(1).(string); got != "cannot parse query" {
+		t.Errorf("unexpected last error: %q", got)
+	}
+
+	// repeat the query, so the round-robin strategy picks another endpoint
+	query(queryTypeVMAlertAlerts)
+	alerts := query(queryTypeVMAlertAlerts).Frames[0]
+	if n := alerts.Rows(); n != 1 {
+		t.Fatalf("expected 1 alert; got %d", n)
+	}
+	if got := alerts.Fields[3].At(0).(string); got != `{job="vmagent",severity="critical"}` {
+		t.Errorf("unexpected labels: %q", got)
+	}
+	if got := alerts.Fields[4].At(0).(time.Time); !got.Equal(time.Date(2022, 12, 5, 7, 50, 0, 0, time.UTC)) {
+		t.Errorf("unexpected activeAt: %s", got)
+	}
+	if got := alerts.Fields[5].At(0).(*float64); got == nil || *got != 0 {
+		t.Errorf("unexpected value: %v", got)
+	}
+}
+
+func TestDatasource_VMAlertQuery(t *testing.T) {
+	vmalert := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/alerts" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("group_id") != "1" {
+			t.Errorf("expected query params to be proxied; got %s", r.URL.RawQuery)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Errorf("expected credentials of VictoriaMetrics not to be sent to vmalert; got %q", auth)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"alerts":[]}}`))
+	}))
+	defer vmalert.Close()
+
+	f := func(jsonData string, wantStatus int) {
+		t.Helper()
+		ds := NewDatasource()
+		pluginCtx := backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+				URL:                     "http://victoria:8428",
+				JSONData:                []byte(jsonData),
+				BasicAuthEnabled:        true,
+				BasicAuthUser:           "user",
+				DecryptedSecureJSONData: map[string]string{"basicAuthPassword": "secret"},
+			},
+		}
+		ctx := backend.WithPluginContext(context.Background(), pluginCtx)
+		req := httptest.NewRequest(http.MethodGet, "/vmalert/api/v1/alerts?group_id=1", nil).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		ds.VMAlertQuery(rr, req)
+		if rr.Code != wantStatus {
+			t.Fatalf("expected status %d, got %d; body: %s", wantStatus, rr.Code, rr.Body.String())
+		}
+	}
+
+	f(`{"vmalertUrl":"`+vmalert.URL+`"}`, http.StatusOK)
+	f(`{}`, http.StatusBadRequest)
+
+	// vmalert returns rules and alerts regardless of access restrictions
+	f(`{"vmalertUrl":"`+vmalert.URL+`","labelAccess":[{"roles":["Viewer"],"filters":["{team=\"a\"}"]}]}`, http.StatusForbidden)
+}
+
+func TestDatasourceQueryVMAlertTLS(t *testing.T) {
+	vmalert := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(vmalertRulesResponseBody))
+	}))
+	defer vmalert.Close()
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: vmalert.Certificate().Raw})
+
+	ds := NewDatasource()
+	rsp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+				URL:                     "http://vm:8428",
+				JSONData:                []byte(`{"httpMethod":"GET","tlsAuthWithCACert":true,"vmalertUrl":"` + vmalert.URL + `"}`),
+				DecryptedSecureJSONData: map[string]string{"tlsCACert": string(caCert)},
+			},
+		},
+		Queries: []backend.DataQuery{{RefID: "A", QueryType: queryTypeVMAlertRules}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// vmalert signed by the custom CA of the datasource is trusted
+	if resp := rsp.Responses["A"]; resp.Error != nil {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+}
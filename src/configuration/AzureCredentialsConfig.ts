@@ -69,6 +69,10 @@ export function getCredentials(options: DataSourceSettings<any, any>): AzureCred
           azureCloud: getDefaultAzureCloud(),
         };
       }
+    case 'workloadidentity':
+      return {
+        authType: 'workloadidentity',
+      };
     case 'clientsecret':
       return {
         authType: 'clientsecret',
@@ -102,6 +106,19 @@ export function updateCredentials(
 
       return options;
 
+    case 'workloadidentity':
+      options = {
+        ...options,
+        jsonData: {
+          ...options.jsonData,
+          azureCredentials: {
+            authType: 'workloadidentity',
+          },
+        },
+      };
+
+      return options;
+
     case 'clientsecret':
       options = {
         ...options,
@@ -37,6 +37,10 @@ const authTypeOptions: Array<SelectableValue<AzureAuthType>> = [
     value: 'msi',
     label: 'Managed Identity',
   },
+  {
+    value: 'workloadidentity',
+    label: 'Workload Identity',
+  },
   {
     value: 'clientsecret',
     label: 'App Registration',
@@ -159,6 +159,24 @@ export const PromSettings = (props: Props) => {
             />
           </div>
         </div>
+        <div className='gf-form-inline'>
+          <div className='gf-form max-width-30'>
+            <FormField
+              label='vmalert URL'
+              labelWidth={14}
+              tooltip={<>The URL of vmalert evaluating rules for this datasource. It is used to show rules and active alerts</>}
+              inputEl={
+                <Input
+                  className='width-25'
+                  value={defaultOptions.jsonData.vmalertUrl}
+                  onChange={onChangeHandler('vmalertUrl', defaultOptions, onOptionsChange)}
+                  spellCheck={false}
+                  placeholder='http://vmalert:8880'
+                />
+              }
+            />
+          </div>
+        </div>
       </div>
     </>
   );
@@ -417,6 +417,19 @@ describe('PrometheusDatasource', () => {
       expect(interpolatedQuery.interval).toBe(step);
     });
 
+    it('should call replace function for tenant', () => {
+      const query = {
+        expr: 'test{job="bar"}',
+        tenant: '$tenant',
+        refId: 'A',
+      };
+      const tenant = '1:0';
+      replaceMock.mockReturnValue(tenant);
+
+      const interpolatedQuery = ds.applyTemplateVariables(query, { tenant: { text: tenant, value: tenant } });
+      expect(interpolatedQuery.tenant).toBe(tenant);
+    });
+
     it('should call replace function for expr', () => {
       const query = {
         expr: 'test{job="$job"}',
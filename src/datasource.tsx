@@ -56,7 +56,7 @@ import PrometheusMetricFindQuery from './metric_find_query';
 import { getInitHints, getQueryHints } from './query_hints';
 import { getOriginalMetricName, transformV2 } from './result_transformer';
 import { getTimeSrv, TimeSrv } from './services/TimeSrv';
-import { AutocompleteSettings, ExemplarTraceIdDestination, LimitMetrics, PromOptions, PromQuery, PromQueryType } from './types';
+import { AutocompleteSettings, Capabilities, ExemplarTraceIdDestination, LimitMetrics, PromOptions, PromQuery, PromQueryType } from './types';
 import { utf8Support, wrapUtf8Filters } from './utf8_support';
 import { PrometheusVariableSupport } from './variables';
 
@@ -89,6 +89,7 @@ export class PrometheusDatasource
   withTemplates: WithTemplate[];
   limitMetrics: LimitMetrics;
   autocompleteSettings: AutocompleteSettings;
+  capabilities?: Capabilities;
 
   constructor(
     instanceSettings: DataSourceInstanceSettings<PromOptions>,
@@ -129,7 +130,7 @@ export class PrometheusDatasource
   }
 
   init = async () => {
-    await this.loadRules();
+    await Promise.all([this.loadRules(), this.loadCapabilities()]);
   };
 
   getQueryDisplayText(query: PromQuery) {
@@ -463,6 +464,16 @@ export class PrometheusDatasource
     }
   }
 
+  async loadCapabilities() {
+    try {
+      this.capabilities = await this.getResource('capabilities', {}, { hideFromInspector: true, showErrorAlert: false });
+      // unknown support doesn't disable exemplars
+      this.exemplarsAvailable = this.capabilities?.exemplars ?? true;
+    } catch (e) {
+      console.error('Failed to load VictoriaMetrics capabilities', e);
+    }
+  }
+
   modifyQuery(query: PromQuery, action: QueryFixAction): PromQuery {
     let expression = query.expr ?? '';
     switch (action.type) {
@@ -526,7 +537,7 @@ export class PrometheusDatasource
   }
 
   useOptimizedLabelsApi(): boolean {
-    return this.autocompleteSettings?.useOptimizedLabelsApi ?? true;
+    return this.autocompleteSettings?.useOptimizedLabelsApi ?? this.capabilities?.labelsMatch ?? true;
   }
 
   getOriginalMetricName(labelData: { [key: string]: string }) {
@@ -589,6 +600,7 @@ export class PrometheusDatasource
       // withTemplate is a variable reference ("$withTemplate") used by processTargetV2
       // to read the raw template value. It does not need interpolation here.
       withTemplate: target.withTemplate,
+      tenant: this.templateSrv.replace(target.tenant, variables),
     };
   }
 
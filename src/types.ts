@@ -44,6 +44,12 @@ export interface PromQuery extends DataQuery {
   fromExploreMetrics?: boolean;
   /** Reference to dashboard variable with WITH template, e.g. "$withTemplate" */
   withTemplate?: string;
+  /** Tenant key for the "variable" tenant mode, e.g. "$tenant" */
+  tenant?: string;
+  /** Reduces every series of the range query to a single value in alerting requests */
+  reducer?: 'last' | 'avg' | 'min' | 'max' | 'count' | 'percentile';
+  /** Percentile in range [0, 100] for the "percentile" reducer */
+  reducerPercentile?: number;
 }
 
 export interface PromOptions extends DataSourceJsonData {
@@ -52,6 +58,7 @@ export interface PromOptions extends DataSourceJsonData {
   httpMethod?: string;
   directUrl?: string;
   vmuiUrl?: string;
+  vmalertUrl?: string;
   customQueryParameters?: string;
   disableMetricsLookup?: boolean;
   exemplarTraceIdDestinations?: ExemplarTraceIdDestination[];
@@ -63,6 +70,9 @@ export interface PromOptions extends DataSourceJsonData {
 
 export enum PromQueryType {
   timeSeriesQuery = 'timeSeriesQuery',
+  vmalertRules = 'vmalertRules',
+  vmalertAlerts = 'vmalertAlerts',
+  alertAnnotations = 'alertAnnotations',
 }
 
 export type LimitMetrics = {
@@ -75,6 +85,23 @@ export type AutocompleteSettings = {
   useOptimizedLabelsApi?: boolean;
 };
 
+// Capabilities of the connected VictoriaMetrics returned by the /capabilities resource
+export type Capabilities = {
+  version?: string;
+  mode: 'single-node' | 'cluster' | 'vmauth' | 'unknown';
+  backend?: string;
+  tenant?: string;
+  tenantMode?: string;
+  functions?: Record<string, boolean>;
+  // features are omitted if they are unknown, e.g. because probes were rejected by authentication
+  labelsMatch?: boolean;
+  labelsLimit?: boolean;
+  exemplars?: boolean;
+  export?: boolean;
+  tsdbStatus?: boolean;
+  checkedAt: string;
+};
+
 export type ExemplarTraceIdDestination = {
   name: string;
   url?: string;